@@ -0,0 +1,363 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// An album can have a display title, a description, a chosen cover and an
+// order for its images.  They are read from an album.txt file in the
+// originals folder, and can be edited through the API.  The edits are
+// stored apart from the file and win over it, field by field.
+//
+// album.txt has one "key: value" per line, blank lines and lines starting
+// with "#" are ignored:
+//
+//	title: Lyon, la fête des lumières
+//	description: Trois jours chez les cousins.
+//	description: A second description line.
+//	cover: IMG_0042.jpg
+//	order: manual
+//	image: IMG_0042.jpg
+//	image: IMG_0007.jpg
+//
+// The order is "name", "time" or "manual".  The manual order lists the
+// images first, in the given order, the images it does not list follow.
+const albumFileName = "album.txt"
+
+var albumOrders = []string{"name", "time", "manual"}
+
+func checkOrder(order string) error {
+	if order == "" {
+		return nil
+	}
+	for _, o := range albumOrders {
+		if order == o {
+			return nil
+		}
+	}
+	return errors.New("Bad order: " + order)
+}
+
+func parseAlbumFile(data []byte) (*store.Album, error) {
+	alb := new(store.Album)
+	var desc []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing ':'", n)
+		}
+		key, val := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "title":
+			alb.Title = proto.String(val)
+		case "description":
+			desc = append(desc, val)
+		case "cover":
+			alb.Cover = proto.String(val)
+		case "order":
+			if err := checkOrder(val); err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err.Error())
+			}
+			alb.OrderBy = proto.String(val)
+		case "image":
+			alb.ManualOrder = append(alb.ManualOrder, val)
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+	}
+	if desc != nil {
+		alb.Description = proto.String(strings.Join(desc, "\n"))
+	}
+	return alb, scanner.Err()
+}
+
+// The album.txt of the originals folder origd, nil if there is none.
+func readAlbumFile(origd string) (*store.Album, error) {
+	file := path.Join(origd, albumFileName)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	alb, err := parseAlbumFile(data)
+	if err != nil {
+		return nil, errors.New(file + ": " + err.Error())
+	}
+	return alb, nil
+}
+
+// Set the album.txt metadata of sdir, logging the errors: a bad file must
+// not prevent loading the images.
+func updateAlbumFile(origd string, sdir *store.Directory) {
+	alb, err := readAlbumFile(origd)
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+	}
+	sdir.AlbumFile = alb
+}
+
+// The album metadata of sdir: its edits over its album.txt, over the
+// order of the index.
+func mergedAlbum(sdir *store.Directory) *store.Album {
+	alb := &store.Album{OrderBy: sdir.OrderBy}
+	for _, a := range []*store.Album{sdir.AlbumFile, sdir.Album} {
+		if a == nil {
+			continue
+		}
+		if a.Title != nil {
+			alb.Title = a.Title
+		}
+		if a.Description != nil {
+			alb.Description = a.Description
+		}
+		if a.Cover != nil {
+			alb.Cover = a.Cover
+		}
+		if a.OrderBy != nil {
+			alb.OrderBy = a.OrderBy
+		}
+		if len(a.ManualOrder) > 0 {
+			alb.ManualOrder = a.ManualOrder
+		}
+	}
+	return alb
+}
+
+// Set the album metadata of dir from sdir.
+func (dir *Directory) setAlbum(sdir *store.Directory) {
+	dir.index_order_by = sdir.GetOrderBy()
+	if sdir.AlbumFile != nil {
+		dir.album_file = proto.Clone(sdir.AlbumFile).(*store.Album)
+	}
+	if sdir.Album != nil {
+		dir.album_edits = proto.Clone(sdir.Album).(*store.Album)
+	}
+	alb := mergedAlbum(&store.Directory{OrderBy: sdir.OrderBy,
+		AlbumFile: dir.album_file, Album: dir.album_edits})
+	dir.title = alb.GetTitle()
+	dir.description = alb.GetDescription()
+	dir.cover = alb.GetCover()
+	dir.order_by = alb.GetOrderBy()
+	dir.manual_order = alb.ManualOrder
+}
+
+// Sort the images of dir in the order of the album, if it has one.
+func (dir *Directory) sortImages() {
+	imgs := dir.images
+	switch dir.order_by {
+	case "name":
+		sort.Stable(ByName(imgs))
+	case "time":
+		sort.SliceStable(imgs, func(i, j int) bool {
+			return imgs[i].ItemTime().Before(imgs[j].ItemTime())
+		})
+	case "manual":
+		pos := make(map[string]int, len(dir.manual_order))
+		for i, name := range dir.manual_order {
+			if _, ok := pos[name]; !ok {
+				pos[name] = i
+			}
+		}
+		sort.SliceStable(imgs, func(i, j int) bool {
+			pos_i, ok_i := pos[imgs[i].Name()]
+			pos_j, ok_j := pos[imgs[j].Name()]
+			if ok_i && ok_j {
+				return pos_i < pos_j
+			}
+			return ok_i
+		})
+	}
+}
+
+// An edit of the metadata of an album.  Nil fields are not edited, empty
+// ones hide the value of album.txt.
+type albumEdit struct {
+	title, description, cover, order *string
+	manual_order                     []string
+	reset                            bool // Drop the previous edits first.
+}
+
+func (e *albumEdit) check() error {
+	if e.title == nil && e.description == nil && e.cover == nil &&
+		e.order == nil && e.manual_order == nil && !e.reset {
+		return errors.New("Nothing to edit")
+	}
+	if e.order != nil {
+		return checkOrder(*e.order)
+	}
+	return nil
+}
+
+// The value of the album edits in the journal, nil fields are not edited.
+type AlbumValue struct {
+	Title       *string  `json:",omitempty"`
+	Description *string  `json:",omitempty"`
+	Cover       *string  `json:",omitempty"`
+	Order       *string  `json:",omitempty"`
+	Images      []string `json:",omitempty"` // The manual order.
+}
+
+func albumJson(alb *store.Album) json.RawMessage {
+	var val *AlbumValue
+	if alb != nil {
+		val = &AlbumValue{alb.Title, alb.Description, alb.Cover, alb.OrderBy, alb.ManualOrder}
+	}
+	data, _ := json.Marshal(val)
+	return data
+}
+
+func setAlbumValue(sdir *store.Directory, data json.RawMessage) error {
+	var val *AlbumValue
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	sdir.Album = nil
+	if val != nil {
+		sdir.Album = &store.Album{Title: val.Title, Description: val.Description,
+			Cover: val.Cover, OrderBy: val.Order, ManualOrder: val.Images}
+	}
+	return nil
+}
+
+// Like mutateDirectory, recording the edit of the album metadata in the
+// journal.
+func (db *Database) mutateAlbum(c Change, rel_pat string,
+	edit func(sdir *store.Directory) error) error {
+	var before json.RawMessage
+	return db.recordedMutation(rel_pat, func(sdir *store.Directory) error {
+		before = albumJson(sdir.Album)
+		return edit(sdir)
+	}, func(sdir *store.Directory) error {
+		after := albumJson(sdir.Album)
+		if bytes.Equal(before, after) {
+			return nil
+		}
+		return db.appendJournal([]JournalEntry{{Time: time.Now(), User: c.User,
+			Album: rel_pat, Field: "album", Old: before, New: after, Undo: c.Undo}})
+	})
+}
+
+// Set the edits of the album of e back to their old value.  Returns false
+// if they changed since, or if the album is gone.
+func (db *Database) undoAlbumEntry(c Change, e *JournalEntry) (bool, error) {
+	found := false
+	for _, dir := range db.Snapshot().Directories() {
+		found = found || dir.RelPat() == e.Album
+	}
+	if !found {
+		return false, nil
+	}
+	undone := false
+	err := db.mutateAlbum(c, e.Album, func(sdir *store.Directory) error {
+		if !bytes.Equal(albumJson(sdir.Album), e.New) {
+			return nil
+		}
+		undone = true
+		return setAlbumValue(sdir, e.Old)
+	})
+	return undone && err == nil, err
+}
+
+// Edit the metadata of the album rel_pat, and publish it.
+func (db *Database) EditAlbum(c Change, rel_pat string, e *albumEdit) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	return db.mutateAlbum(c, rel_pat, func(sdir *store.Directory) error {
+		if e.cover != nil && *e.cover != "" && findItem(sdir, *e.cover) == nil {
+			return errors.New("Unknown image: " + *e.cover)
+		}
+		for _, name := range e.manual_order {
+			if findItem(sdir, name) == nil {
+				return errors.New("Unknown image: " + name)
+			}
+		}
+		alb := sdir.Album
+		if alb == nil || e.reset {
+			alb = new(store.Album)
+		}
+		if e.title != nil {
+			alb.Title = proto.String(*e.title)
+		}
+		if e.description != nil {
+			alb.Description = proto.String(*e.description)
+		}
+		if e.cover != nil {
+			alb.Cover = proto.String(*e.cover)
+		}
+		if e.order != nil {
+			alb.OrderBy = proto.String(*e.order)
+		}
+		if e.manual_order != nil {
+			alb.ManualOrder = e.manual_order
+		}
+		sdir.Album = alb
+		if proto.Equal(alb, new(store.Album)) {
+			sdir.Album = nil
+		}
+		if merged := mergedAlbum(sdir); merged.GetOrderBy() == "manual" &&
+			len(merged.ManualOrder) == 0 {
+			return errors.New("Pass the images of the manual order")
+		}
+		return nil
+	})
+}
+
+// The value of the form field key, nil if it is not in the form.
+func formString(r *http.Request, key string) *string {
+	if vals, ok := r.Form[key]; ok && len(vals) > 0 {
+		return proto.String(strings.TrimSpace(vals[0]))
+	}
+	return nil
+}
+
+// POST with the album path in "album", and the fields to edit: "title",
+// "description", "cover" (an image name), "order" and the images of the
+// manual order in "image", repeatable.  An empty field hides the value of
+// album.txt, "reset" drops the previous edits.
+func HandleAlbum(w http.ResponseWriter, r *http.Request, db *Database) {
+	var res StringResults
+	userEmail := r.Context().Value("userEmail").(string)
+	err := r.ParseForm()
+	if err == nil && r.Method != "POST" {
+		err = errors.New("Use POST to edit an album")
+	}
+	if _, ok := r.Form["album"]; err == nil && !ok {
+		err = errors.New("Pass an album")
+	}
+	if err == nil {
+		e := &albumEdit{title: formString(r, "title"),
+			description: formString(r, "description"), cover: formString(r, "cover"),
+			order: formString(r, "order"), manual_order: r.Form["image"],
+			reset: r.FormValue("reset") != ""}
+		log.Printf("Album from %s: %v", userEmail, r.Form)
+		err = db.EditAlbum(Change{User: userEmail}, r.FormValue("album"), e)
+	}
+	if err == nil {
+		res.Message = "ok"
+	} else {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
@@ -0,0 +1,160 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+func Test_ParseAlbumFile(t *testing.T) {
+	alb, err := parseAlbumFile([]byte(`# Fête des lumières
+Title: Lyon
+description: Trois jours.
+
+description: Chez les cousins.
+cover: b.jpg
+order: manual
+image: c.jpg
+image: a.jpg
+`))
+	want := &store.Album{Title: proto.String("Lyon"),
+		Description: proto.String("Trois jours.\nChez les cousins."), Cover: proto.String("b.jpg"),
+		OrderBy: proto.String("manual"), ManualOrder: []string{"c.jpg", "a.jpg"}}
+	if err != nil || !proto.Equal(alb, want) {
+		t.Errorf("bad album %v %v", alb, err)
+	}
+	for _, bad := range []string{"title Lyon", "order: random", "author: me"} {
+		if _, err := parseAlbumFile([]byte(bad)); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+// The names of the images of the album rel_pat, in order.
+func albumNames(db *Database, rel_pat string) string {
+	var names []string
+	for _, dir := range db.Snapshot().Directories() {
+		if dir.RelPat() == rel_pat {
+			for _, img := range dir.Images() {
+				names = append(names, img.Name())
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func albumNamed(db *Database, rel_pat string) *Directory {
+	for _, dir := range db.Snapshot().Directories() {
+		if dir.RelPat() == rel_pat {
+			return dir
+		}
+	}
+	return nil
+}
+
+func Test_Album(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	os.MkdirAll(path.Join(orig, "lyon"), 0777)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestJpeg(t, path.Join(orig, "lyon", name), 8, 6)
+	}
+	ioutil.WriteFile(path.Join(orig, "lyon", "a.xmp"), []byte(testXmp("5")), 0777)
+	ioutil.WriteFile(path.Join(orig, "lyon", albumFileName), []byte(
+		"title: Fête des lumières\ndescription: Chez les cousins.\ncover: b.jpg\n"+
+			"order: manual\nimage: c.jpg\nimage: a.jpg\n"), 0777)
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+
+	dir := albumNamed(db, "lyon")
+	if got := albumNames(db, "lyon"); got != "c.jpg a.jpg b.jpg" {
+		t.Errorf("bad manual order %q", got)
+	}
+	var jdir JsonDirectory
+	dir.Json(&jdir)
+	if jdir.Ttl != "Fête des lumières" || jdir.Desc != "Chez les cousins." ||
+		jdir.CovName != "b.jpg" || jdir.Order != "manual" {
+		t.Errorf("bad json %+v", jdir)
+	}
+	if item := dir.RSSItem("http://x/db/"); !strings.Contains(item, "<title>Fête des lumières</title>") ||
+		!strings.Contains(item, "<p>Chez les cousins.</p>") {
+		t.Errorf("bad RSS item %s", item)
+	}
+	for q, want := range map[string]string{
+		`"album:fête des lumières`: "a.jpg b.jpg c.jpg",
+		"titre:lumières":           "a.jpg b.jpg c.jpg",
+		"album:lumières":           "",
+	} {
+		if got := queryNames(db, q); got != want {
+			t.Errorf("%q: got %q, want %q", q, got, want)
+		}
+	}
+
+	// The album queries keep the order of the album, not the ratings.
+	req := httptest.NewRequest("GET", "/q?q=album:lyon", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "userEmail", "alice"))
+	rec := httptest.NewRecorder()
+	HandleQuery(rec, req, db)
+	var jimgs []JsonImage
+	json.Unmarshal(rec.Body.Bytes(), &jimgs)
+	if len(jimgs) != 3 || jimgs[0].In != "c.jpg" || jimgs[1].In != "a.jpg" || jimgs[2].In != "b.jpg" {
+		t.Errorf("album query not in the album order %+v", jimgs)
+	}
+
+	edit := func(form url.Values, want string) {
+		var res StringResults
+		postAs(t, "alice", db, HandleAlbum, form, &res)
+		if res.Message != want {
+			t.Errorf("%v: got %q, want %q", form, res.Message, want)
+		}
+	}
+	edit(url.Values{"album": {"lyon"}, "title": {"Noël"}, "order": {"time"}, "cover": {""}}, "ok")
+	edit(url.Values{"album": {"lyon"}, "cover": {"x.jpg"}}, "Unknown image: x.jpg")
+	edit(url.Values{"album": {"paris"}, "title": {"Paris"}}, "Unknown directory: paris")
+	edit(url.Values{"album": {"lyon"}}, "Nothing to edit")
+	edit(url.Values{"album": {"lyon"}, "order": {"random"}}, "Bad order: random")
+
+	// The edits survive a rescan, and win over album.txt.
+	if err := db.ReloadDirectories([]string{"lyon"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	dir = albumNamed(db, "lyon")
+	if dir.Title() != "Noël" || dir.Description() != "Chez les cousins." ||
+		dir.OrderBy() != "time" || dir.Cover().Name() != "a.jpg" {
+		t.Errorf("bad edited album %q %q %q %q", dir.Title(), dir.Description(),
+			dir.OrderBy(), dir.Cover().Name())
+	}
+	if got := albumNames(db, "lyon"); got != "a.jpg b.jpg c.jpg" {
+		t.Errorf("bad time order %q", got)
+	}
+
+	edit(url.Values{"album": {"lyon"}, "reset": {"1"}, "image": {"b.jpg"}}, "ok")
+	if dir = albumNamed(db, "lyon"); dir.Title() != "Fête des lumières" ||
+		albumNames(db, "lyon") != "b.jpg a.jpg c.jpg" {
+		t.Errorf("bad reset album %q %q", dir.Title(), albumNames(db, "lyon"))
+	}
+
+	// The edits are journaled with their user, and can be undone.
+	lyon := func(e *JournalEntry) bool { return e.Album == "lyon" }
+	if entries, err := db.ReadJournal(lyon); err != nil || len(entries) != 2 ||
+		entries[0].User != "alice" || entries[0].Field != "album" {
+		t.Errorf("bad journal %+v %v", entries, err)
+	}
+	if n, skipped, err := db.Undo("bob", lyon); n != 2 || skipped != 0 || err != nil {
+		t.Errorf("undo: %d %d %v", n, skipped, err)
+	}
+	if dir = albumNamed(db, "lyon"); dir.Title() != "Fête des lumières" || dir.OrderBy() != "manual" ||
+		albumNames(db, "lyon") != "c.jpg a.jpg b.jpg" {
+		t.Errorf("bad undone album %q %q", dir.Title(), albumNames(db, "lyon"))
+	}
+}
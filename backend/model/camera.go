@@ -0,0 +1,256 @@
+package model
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+import "github.com/rwcarlsen/goexif/exif"
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// The camera and exposure settings of an image.  Zero fields are unknown.
+type Camera struct {
+	Make         string  `json:",omitempty"`
+	Model        string  `json:",omitempty"`
+	Lens         string  `json:",omitempty"`
+	FocalLength  float32 `json:",omitempty"` // In mm.
+	Aperture     float32 `json:",omitempty"` // The f-number.
+	ExposureTime float32 `json:",omitempty"` // In seconds.
+	Iso          int32   `json:",omitempty"`
+}
+
+func protoToCamera(scam *store.Camera) *Camera {
+	return &Camera{
+		Make:         scam.GetMake(),
+		Model:        scam.GetModel(),
+		Lens:         scam.GetLensModel(),
+		FocalLength:  scam.GetFocalLengthMm(),
+		Aperture:     scam.GetAperture(),
+		ExposureTime: scam.GetExposureTimeS(),
+		Iso:          scam.GetIso(),
+	}
+}
+
+func (cam *Camera) toProto() *store.Camera {
+	scam := new(store.Camera)
+	if cam.Make != "" {
+		scam.Make = proto.String(cam.Make)
+	}
+	if cam.Model != "" {
+		scam.Model = proto.String(cam.Model)
+	}
+	if cam.Lens != "" {
+		scam.LensModel = proto.String(cam.Lens)
+	}
+	if cam.FocalLength != 0 {
+		scam.FocalLengthMm = proto.Float32(cam.FocalLength)
+	}
+	if cam.Aperture != 0 {
+		scam.Aperture = proto.Float32(cam.Aperture)
+	}
+	if cam.ExposureTime != 0 {
+		scam.ExposureTimeS = proto.Float32(cam.ExposureTime)
+	}
+	if cam.Iso != 0 {
+		scam.Iso = proto.Int32(cam.Iso)
+	}
+	return scam
+}
+
+func exifString(ex *exif.Exif, name exif.FieldName) *string {
+	tag, err := ex.Get(name)
+	if err != nil {
+		return nil
+	}
+	s, err := tag.StringVal()
+	if s = strings.TrimSpace(strings.Trim(s, "\x00")); err != nil || s == "" {
+		return nil
+	}
+	return proto.String(s)
+}
+
+func exifRational(ex *exif.Exif, name exif.FieldName) *float32 {
+	tag, err := ex.Get(name)
+	if err != nil {
+		return nil
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 || num <= 0 {
+		return nil
+	}
+	return proto.Float32(float32(num) / float32(den))
+}
+
+// The camera of a decoded EXIF, nil if it has none.
+func exifCamera(ex *exif.Exif) *store.Camera {
+	scam := &store.Camera{
+		Make:          exifString(ex, exif.Make),
+		Model:         exifString(ex, exif.Model),
+		LensModel:     exifString(ex, exif.LensModel),
+		FocalLengthMm: exifRational(ex, exif.FocalLength),
+		Aperture:      exifRational(ex, exif.FNumber),
+		ExposureTimeS: exifRational(ex, exif.ExposureTime),
+	}
+	if tag, err := ex.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil && iso > 0 {
+			scam.Iso = proto.Int32(int32(iso))
+		}
+	}
+	if proto.Equal(scam, &store.Camera{}) {
+		return nil
+	}
+	return scam
+}
+
+// Camera predicates in queries: camera: and lens: match a part of the
+// make and model or of the lens model, lens:35mm also matches the focal
+// length.  iso:, f: (the aperture), focal: (in mm) and shutter: (in
+// seconds, like 1/60) compare the exposure: iso:>1600, f:<=2.8,
+// focal:24-70, shutter:1/60.
+var cameraPredicates = []string{"camera:", "lens:", "iso:", "f:", "focal:", "shutter:"}
+
+func isCameraPredicate(lower_t string) bool {
+	lower_t = strings.TrimPrefix(lower_t, "\"")
+	for _, p := range cameraPredicates {
+		if strings.HasPrefix(lower_t, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFocalLength(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(s, "mm"), 64)
+}
+
+func parseShutter(s string) (float64, error) {
+	s = strings.TrimSuffix(s, "s")
+	if num, den, found := strings.Cut(s, "/"); found {
+		n, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return 0, err
+		}
+		d, err := strconv.ParseFloat(den, 64)
+		if err != nil || d == 0 {
+			return 0, errors.New("bad shutter speed " + s)
+		}
+		return n / d, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseNumber(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+// Values closer than this are equal, exposures are rounded in the EXIF.
+const exposureEpsilon = 0.01
+
+// A comparison like ">1600", "<=2.8", "24-70" or "35" with the values
+// parsed by parse.
+func parseComparison(s string, parse func(string) (float64, error)) (func(float64) bool, error) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		v, err := parse(strings.TrimSpace(s[len(op):]))
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case ">=":
+			return func(x float64) bool { return x >= v*(1-exposureEpsilon) }, nil
+		case "<=":
+			return func(x float64) bool { return x <= v*(1+exposureEpsilon) }, nil
+		case ">":
+			return func(x float64) bool { return x > v*(1+exposureEpsilon) }, nil
+		case "<":
+			return func(x float64) bool { return x < v*(1-exposureEpsilon) }, nil
+		}
+		return func(x float64) bool { return math.Abs(x-v) <= v*exposureEpsilon }, nil
+	}
+	if from, to, found := strings.Cut(s, "-"); found {
+		lo, err := parse(strings.TrimSpace(from))
+		if err != nil {
+			return nil, err
+		}
+		hi, err := parse(strings.TrimSpace(to))
+		if err != nil {
+			return nil, err
+		}
+		return func(x float64) bool {
+			return x >= lo*(1-exposureEpsilon) && x <= hi*(1+exposureEpsilon)
+		}, nil
+	}
+	return parseComparison("="+s, parse)
+}
+
+func CameraQuery(db *Database, s string) Query {
+	s = strings.ToLower(s)
+	filter := func(img *Image) bool {
+		cam := img.camera
+		return cam != nil && strings.Contains(strings.ToLower(cam.Make+" "+cam.Model), s)
+	}
+	return FilteredQuery(db, filter)
+}
+
+func LensQuery(db *Database, s string) Query {
+	s = strings.ToLower(s)
+	focal, err := parseFocalLength(s)
+	has_focal := err == nil && strings.HasSuffix(s, "mm")
+	filter := func(img *Image) bool {
+		cam := img.camera
+		if cam == nil {
+			return false
+		}
+		return strings.Contains(strings.ToLower(cam.Lens), s) ||
+			(has_focal && math.Round(float64(cam.FocalLength)) == math.Round(focal))
+	}
+	return FilteredQuery(db, filter)
+}
+
+// The images whose exposure value, returned by value, passes cmp.
+func ExposureQuery(db *Database, value func(*Camera) float64, cmp func(float64) bool) Query {
+	filter := func(img *Image) bool {
+		if img.camera == nil {
+			return false
+		}
+		v := value(img.camera)
+		return v != 0 && cmp(v)
+	}
+	return FilteredQuery(db, filter)
+}
+
+// The query of a camera predicate, an invalid predicate matches no image.
+func CameraPredicateQuery(db *Database, t string) Query {
+	name, arg, _ := strings.Cut(strings.TrimPrefix(t, "\""), ":")
+	arg = strings.TrimSpace(arg)
+	var value func(*Camera) float64
+	parse := parseNumber
+	switch strings.ToLower(name) {
+	case "camera":
+		return CameraQuery(db, arg)
+	case "lens":
+		return LensQuery(db, arg)
+	case "iso":
+		value = func(cam *Camera) float64 { return float64(cam.Iso) }
+	case "f":
+		value = func(cam *Camera) float64 { return float64(cam.Aperture) }
+	case "focal":
+		value = func(cam *Camera) float64 { return float64(cam.FocalLength) }
+		parse = parseFocalLength
+	case "shutter":
+		value = func(cam *Camera) float64 { return float64(cam.ExposureTime) }
+		parse = parseShutter
+	default:
+		return EmptyQuery(db)
+	}
+	cmp, err := parseComparison(strings.ToLower(arg), parse)
+	if err != nil {
+		return EmptyQuery(db)
+	}
+	return ExposureQuery(db, value, cmp)
+}
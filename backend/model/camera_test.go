@@ -0,0 +1,179 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte // Big endian.
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func rationalEntry(tag uint16, num, den uint32) tiffEntry {
+	data := binary.BigEndian.AppendUint32(nil, num)
+	return tiffEntry{tag, 5, 1, binary.BigEndian.AppendUint32(data, den)}
+}
+
+func shortEntry(tag uint16, v uint16) tiffEntry {
+	return tiffEntry{tag, 3, 1, binary.BigEndian.AppendUint16(nil, v)}
+}
+
+// Insert an EXIF APP1 segment with the entries of IFD0 and of the Exif
+// IFD after the SOI marker of a JPEG file.
+func setExif(t *testing.T, p string, ifd0 []tiffEntry, exif_ifd []tiffEntry) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifdSize := func(n int) uint32 { return uint32(2 + 12*n + 4) }
+	exif_at := 8 + ifdSize(len(ifd0)+1)
+	data_at := exif_at + ifdSize(len(exif_ifd))
+	var tiff, values bytes.Buffer
+	w := func(vs ...interface{}) {
+		for _, v := range vs {
+			binary.Write(&tiff, binary.BigEndian, v)
+		}
+	}
+	writeIfd := func(entries []tiffEntry) {
+		w(uint16(len(entries)))
+		for _, e := range entries {
+			w(e.tag, e.typ, e.count)
+			if len(e.data) <= 4 {
+				w(append(e.data, make([]byte, 4-len(e.data))...))
+			} else {
+				w(data_at + uint32(values.Len()))
+				values.Write(e.data)
+				if values.Len()%2 == 1 {
+					values.WriteByte(0)
+				}
+			}
+		}
+		w(uint32(0))
+	}
+	w([]byte("MM"), uint16(42), uint32(8))
+	exif_ptr := tiffEntry{0x8769, 4, 1, binary.BigEndian.AppendUint32(nil, exif_at)}
+	writeIfd(append(append([]tiffEntry{}, ifd0...), exif_ptr))
+	writeIfd(exif_ifd)
+	tiff.Write(values.Bytes())
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	seg := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append(append(append([]byte{}, data[:2]...), seg...), payload...)
+	out = append(out, data[2:]...)
+	if err = ioutil.WriteFile(p, out, 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeCameraJpeg(t *testing.T, p string, make_, model, lens string,
+	focal, f10, exposure_den, iso uint32) {
+	writeTestJpeg(t, p, 8, 6)
+	setExif(t, p,
+		[]tiffEntry{asciiEntry(0x010F, make_), asciiEntry(0x0110, model)},
+		[]tiffEntry{
+			rationalEntry(0x829A, 1, exposure_den),
+			rationalEntry(0x829D, f10, 10),
+			shortEntry(0x8827, uint16(iso)),
+			rationalEntry(0x920A, focal, 1),
+			asciiEntry(0xA434, lens),
+		})
+}
+
+func Test_ParseComparison(t *testing.T) {
+	for _, tc := range []struct {
+		cmp string
+		in  []float64
+		out []float64
+	}{
+		{">1600", []float64{3200}, []float64{1600, 800}},
+		{">=1600", []float64{3200, 1600}, []float64{800}},
+		{"<2.8", []float64{1.4, 2}, []float64{2.8, 4}},
+		{"<=2.8", []float64{2.8}, []float64{4}},
+		{"24-70", []float64{24, 50, 70}, []float64{18, 200}},
+		{"35", []float64{35}, []float64{50}},
+	} {
+		cmp, err := parseComparison(tc.cmp, parseNumber)
+		if err != nil {
+			t.Errorf("%q: %s", tc.cmp, err.Error())
+			continue
+		}
+		for _, v := range tc.in {
+			if !cmp(v) {
+				t.Errorf("%q does not match %f", tc.cmp, v)
+			}
+		}
+		for _, v := range tc.out {
+			if cmp(v) {
+				t.Errorf("%q matches %f", tc.cmp, v)
+			}
+		}
+	}
+	if _, err := parseComparison(">abc", parseNumber); err == nil {
+		t.Errorf("bad number accepted")
+	}
+	if v, err := parseShutter("1/60"); err != nil || v != 1.0/60 {
+		t.Errorf("bad shutter %f %v", v, err)
+	}
+}
+
+func Test_CameraQueries(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeCameraJpeg(t, path.Join(orig, "fuji.jpg"), "FUJIFILM", "X100V", "", 23, 20, 60, 3200)
+	writeCameraJpeg(t, path.Join(orig, "pixel.jpg"), "Google", "Pixel 7", "Pixel 7 back camera 6.81mm f/1.85", 7, 19, 120, 100)
+	writeCameraJpeg(t, path.Join(orig, "canon.jpg"), "Canon", "Canon EOS R6", "RF35mm F1.8 MACRO IS STM", 35, 80, 250, 800)
+	writeTestJpeg(t, path.Join(orig, "none.jpg"), 8, 6)
+
+	db := loadTestDatabase(t, orig, root)
+	cam := imageNamed(db, "fuji.jpg").Camera()
+	if cam == nil || cam.Make != "FUJIFILM" || cam.Model != "X100V" || cam.Iso != 3200 ||
+		cam.Aperture != 2 || cam.FocalLength != 23 || cam.ExposureTime != float32(1)/60 {
+		t.Fatalf("bad camera %+v", cam)
+	}
+	if cam := imageNamed(db, "none.jpg").Camera(); cam != nil {
+		t.Errorf("unexpected camera %+v", cam)
+	}
+	if itm := indexItem(t, db, "canon.jpg"); itm.GetImage().GetCamera().GetLensModel() != "RF35mm F1.8 MACRO IS STM" {
+		t.Errorf("camera not indexed: %v", itm)
+	}
+
+	for _, tc := range []struct {
+		query string
+		names string
+	}{
+		{"camera:x100v", "fuji.jpg"},
+		{"camera:pixel", "pixel.jpg"},
+		{"camera:canon", "canon.jpg"},
+		{"lens:35mm", "canon.jpg"},
+		{"lens:23mm", "fuji.jpg"},
+		{"lens:macro", "canon.jpg"},
+		{"iso:>1600", "fuji.jpg"},
+		{"iso:<=800", "canon.jpg pixel.jpg"},
+		{"f:<2.8", "fuji.jpg pixel.jpg"},
+		{"f:8", "canon.jpg"},
+		{"focal:20-40mm", "canon.jpg fuji.jpg"},
+		{"shutter:>=1/60", "fuji.jpg"},
+		{"iso:>=100 camera:canon", "canon.jpg"},
+		{"iso:lots", ""},
+	} {
+		if got := queryNames(db, tc.query); got != tc.names {
+			t.Errorf("%q: got %q, want %q", tc.query, got, tc.names)
+		}
+	}
+	UseLRParser = true
+	defer func() { UseLRParser = false }()
+	if got := queryNames(db, "camera:pixel 7, iso:<200"); got != "pixel.jpg" {
+		t.Errorf("LR query: got %q", got)
+	}
+}
@@ -0,0 +1,370 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collections are named, hand-ordered lists of images picked from any
+// album.  They are stored beside the index by image id: the ids are stable
+// across reloads, see assignIds.  The ids of the images removed from the
+// originals are kept, and skipped until the images come back.  Names are
+// unique and compared case-insensitively, only the owner of a collection
+// can change it.
+
+type Collection struct {
+	Name    string
+	Owner   string
+	Ids     []int // In the order of the collection.
+	Created time.Time
+	Updated time.Time
+}
+
+func (db *Database) CollectionsPath() string {
+	return path.Join(db.indx_root, "collections.json")
+}
+
+var collections_mu sync.Mutex // Serializes the edits of the collections.
+
+// All the collections, sorted by name.
+func (db *Database) ReadCollections() ([]Collection, error) {
+	data, err := ioutil.ReadFile(db.CollectionsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cols []Collection
+	if err = json.Unmarshal(data, &cols); err != nil {
+		return nil, errors.New(db.CollectionsPath() + ": " + err.Error())
+	}
+	return cols, nil
+}
+
+func (db *Database) writeCollections(cols []Collection) error {
+	sort.Slice(cols, func(i, j int) bool {
+		return strings.ToLower(cols[i].Name) < strings.ToLower(cols[j].Name)
+	})
+	data, err := json.MarshalIndent(cols, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(db.CollectionsPath(), data, 0644)
+}
+
+// The collection called name, nil if none.
+func (db *Database) Collection(name string) (*Collection, error) {
+	cols, err := db.ReadCollections()
+	if err != nil {
+		return nil, err
+	}
+	for i := range cols {
+		if strings.EqualFold(cols[i].Name, name) {
+			return &cols[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// The images of c that are in db, in the order of c.
+func (c *Collection) Images(db *Database) []*Image {
+	imgs := make([]*Image, 0, len(c.Ids))
+	for _, id := range c.Ids {
+		if img := db.Indexer().Image(id); img != nil {
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs
+}
+
+func checkCollectionName(name string) error {
+	if name == "" || strings.TrimSpace(name) != name || strings.ContainsAny(name, "\",/") {
+		return errors.New("Bad name: " + name)
+	}
+	return nil
+}
+
+// An edit of a collection, returns the number of images added or removed.
+type collectionEdit func(c *Collection) (int, error)
+
+// Add the ids at the end of the collection, except those already in it.
+func addToCollection(ids []int) collectionEdit {
+	return func(c *Collection) (int, error) {
+		n := 0
+		for _, id := range ids {
+			if !containsId(c.Ids, id) {
+				c.Ids = append(c.Ids, id)
+				n++
+			}
+		}
+		return n, nil
+	}
+}
+
+func removeFromCollection(ids []int) collectionEdit {
+	return func(c *Collection) (int, error) {
+		kept := make([]int, 0, len(c.Ids))
+		for _, id := range c.Ids {
+			if !containsId(ids, id) {
+				kept = append(kept, id)
+			}
+		}
+		n := len(c.Ids) - len(kept)
+		c.Ids = kept
+		return n, nil
+	}
+}
+
+// Put the ids first, in the given order, the other images of the
+// collection follow in their current order.
+func orderCollection(ids []int) collectionEdit {
+	return func(c *Collection) (int, error) {
+		ordered := make([]int, 0, len(c.Ids))
+		for _, id := range ids {
+			if !containsId(c.Ids, id) {
+				return 0, errors.New("Not in the collection: " + strconv.Itoa(id))
+			}
+			if !containsId(ordered, id) {
+				ordered = append(ordered, id)
+			}
+		}
+		for _, id := range c.Ids {
+			if !containsId(ordered, id) {
+				ordered = append(ordered, id)
+			}
+		}
+		c.Ids = ordered
+		return 0, nil
+	}
+}
+
+func renameCollection(name string) collectionEdit {
+	return func(c *Collection) (int, error) {
+		if err := checkCollectionName(name); err != nil {
+			return 0, err
+		}
+		c.Name = name
+		return 0, nil
+	}
+}
+
+func containsId(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Create the collection name for user, with the given images.
+func (db *Database) CreateCollection(user string, name string, ids []int) error {
+	if err := checkCollectionName(name); err != nil {
+		return err
+	}
+	collections_mu.Lock()
+	defer collections_mu.Unlock()
+	cols, err := db.ReadCollections()
+	if err != nil {
+		return err
+	}
+	for _, c := range cols {
+		if strings.EqualFold(c.Name, name) {
+			return errors.New("Collection exists: " + c.Name)
+		}
+	}
+	now := time.Now()
+	c := Collection{Name: name, Owner: user, Created: now, Updated: now}
+	addToCollection(ids)(&c)
+	return db.writeCollections(append(cols, c))
+}
+
+// Edit the collection name, owned by user.  Returns the number of images
+// added or removed.
+func (db *Database) EditCollection(user string, name string, edit collectionEdit) (int, error) {
+	collections_mu.Lock()
+	defer collections_mu.Unlock()
+	cols, err := db.ReadCollections()
+	if err != nil {
+		return 0, err
+	}
+	for i := range cols {
+		c := &cols[i]
+		if !strings.EqualFold(c.Name, name) {
+			continue
+		}
+		if c.Owner != user {
+			return 0, errors.New("Collection of " + c.Owner + ": " + name)
+		}
+		n, err := edit(c)
+		if err != nil {
+			return 0, err
+		}
+		for j := range cols {
+			if j != i && strings.EqualFold(cols[j].Name, c.Name) {
+				return 0, errors.New("Collection exists: " + cols[j].Name)
+			}
+		}
+		c.Updated = time.Now()
+		return n, db.writeCollections(cols)
+	}
+	return 0, errors.New("Unknown collection: " + name)
+}
+
+// Delete the collection name, owned by user.
+func (db *Database) DeleteCollection(user string, name string) error {
+	collections_mu.Lock()
+	defer collections_mu.Unlock()
+	cols, err := db.ReadCollections()
+	if err != nil {
+		return err
+	}
+	for i, c := range cols {
+		if !strings.EqualFold(c.Name, name) {
+			continue
+		}
+		if c.Owner != user {
+			return errors.New("Collection of " + c.Owner + ": " + name)
+		}
+		return db.writeCollections(append(cols[:i], cols[i+1:]...))
+	}
+	return errors.New("Unknown collection: " + name)
+}
+
+// The images of the collection called name, none if it does not exist.
+// They come by rank, to combine with the other queries.
+func CollectionQuery(db *Database, name string) Query {
+	imgs := collectionImages(db, name)
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].Rank < imgs[j].Rank })
+	return imagesQuery(imgs)
+}
+
+// The images of the collection called name in its order, for a query
+// made of the collection alone.
+func collectionOrderQuery(db *Database, name string) Query {
+	return imagesQuery(collectionImages(db, name))
+}
+
+// A query streaming imgs.
+func imagesQuery(imgs []*Image) Query {
+	q := make(chan *Image)
+	go func() {
+		defer close(q)
+		for _, img := range imgs {
+			q <- img
+		}
+	}()
+	return q
+}
+
+// The images of the collection called name in its order, none if it does
+// not exist.
+func collectionImages(db *Database, name string) []*Image {
+	c, err := db.Collection(name)
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+	}
+	if c == nil {
+		return nil
+	}
+	return c.Images(db)
+}
+
+type JsonCollection struct {
+	Name    string
+	Owner   string
+	Nimgs   int    // Number of images in the collection
+	Cov     int    // Cover image id, the first image, 0 if empty
+	CovName string // Cover image name
+}
+
+// The ids of the images in "id", repeatable, or of the results of "q".
+func requestIds(r *http.Request, db *Database) ([]int, error) {
+	imgs, err := requestImages(r, db)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(imgs))
+	for i, img := range imgs {
+		ids[i] = img.Id
+	}
+	return ids, nil
+}
+
+// GET lists the collections, or with "name" returns the images of a
+// collection in its order.  POST with the collection in "name" and the
+// "action": "create", "add" or "remove" the images in "id" or "q", "order"
+// to put the images in "id" first, "rename" to "to", or "delete".
+func HandleCollections(w http.ResponseWriter, r *http.Request, db *Database) {
+	userEmail := r.Context().Value("userEmail").(string)
+	r.ParseForm()
+	db = requestSnapshot(r, db)
+	name := r.FormValue("name")
+	if r.Method != "POST" {
+		if name != "" {
+			returnImages(w, collectionImages(db, name))
+			return
+		}
+		cols, err := db.ReadCollections()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := make([]JsonCollection, len(cols))
+		for i, c := range cols {
+			imgs := c.Images(db)
+			res[i] = JsonCollection{Name: c.Name, Owner: c.Owner, Nimgs: len(imgs)}
+			if len(imgs) > 0 {
+				res[i].Cov = imgs[0].Id
+				res[i].CovName = imgs[0].Name()
+			}
+		}
+		json.NewEncoder(w).Encode(&res)
+		return
+	}
+	var res EditResults
+	var err error
+	var ids []int
+	log.Printf("Collection from %s: %v", userEmail, r.Form)
+	switch action := r.FormValue("action"); action {
+	case "create":
+		if len(r.Form["id"]) > 0 || r.FormValue("q") != "" {
+			ids, err = requestIds(r, db)
+		}
+		if err == nil {
+			err = db.CreateCollection(userEmail, name, ids)
+		}
+		if err == nil {
+			res.Changed = len(ids)
+		}
+	case "add", "remove", "order":
+		ids, err = requestIds(r, db)
+		edits := map[string]func([]int) collectionEdit{"add": addToCollection,
+			"remove": removeFromCollection, "order": orderCollection}
+		if err == nil {
+			res.Changed, err = db.EditCollection(userEmail, name, edits[action](ids))
+		}
+	case "rename":
+		_, err = db.EditCollection(userEmail, name, renameCollection(r.FormValue("to")))
+	case "delete":
+		err = db.DeleteCollection(userEmail, name)
+	default:
+		err = errors.New("Unknown action: " + action)
+	}
+	if err == nil {
+		res.Message = "ok"
+	} else {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
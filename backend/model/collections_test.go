@@ -0,0 +1,148 @@
+package model
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_Collections(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for _, p := range []string{"noel/a.jpg", "noel/b.jpg", "lyon/c.jpg", "lyon/d.jpg"} {
+		os.MkdirAll(path.Dir(path.Join(orig, p)), 0777)
+		writeTestJpeg(t, path.Join(orig, p), 8, 6)
+		ioutil.WriteFile(strings.TrimSuffix(path.Join(orig, p), ".jpg")+".xmp",
+			[]byte(testXmp("0", "famille")), 0777)
+	}
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+	id := func(name string) string { return strconv.Itoa(imageNamed(db.Snapshot(), name).Id) }
+
+	edit := func(user string, form url.Values, want string) int {
+		var res EditResults
+		postAs(t, user, db, HandleCollections, form, &res)
+		if res.Message != want {
+			t.Errorf("%v: got %q, want %q", form, res.Message, want)
+		}
+		return res.Changed
+	}
+	get := func(form url.Values, res interface{}) {
+		req := httptest.NewRequest("GET", "/collections?"+form.Encode(), nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", "bob"))
+		rec := httptest.NewRecorder()
+		HandleCollections(rec, req, db)
+		json.Unmarshal(rec.Body.Bytes(), res)
+	}
+	names := func(name string) string {
+		var imgs []JsonImage
+		get(url.Values{"name": {name}}, &imgs)
+		var names []string
+		for _, img := range imgs {
+			names = append(names, strconv.Itoa(img.Id))
+		}
+		return strings.Join(names, " ")
+	}
+
+	best := url.Values{"name": {"best of 2023"}}
+	with := func(form url.Values, kvs ...string) url.Values {
+		res := url.Values{}
+		for k, v := range form {
+			res[k] = v
+		}
+		for i := 0; i < len(kvs); i += 2 {
+			res.Add(kvs[i], kvs[i+1])
+		}
+		return res
+	}
+	if n := edit("alice", with(best, "action", "create", "id", id("c.jpg"), "id", id("a.jpg"),
+		"id", id("c.jpg")), "ok"); n != 2 {
+		t.Errorf("%d images in the created collection, want 2", n)
+	}
+	if n := edit("alice", with(best, "action", "create", "id", id("b.jpg")),
+		"Collection exists: best of 2023"); n != 0 {
+		t.Errorf("%d images changed by a failed create", n)
+	}
+	if n := edit("alice", with(best, "action", "add", "q", "famille"), "ok"); n != 2 {
+		t.Errorf("%d images added, want 2", n)
+	}
+	edit("alice", with(best, "action", "order", "id", id("d.jpg"), "id", id("c.jpg")), "ok")
+	edit("bob", with(best, "action", "remove", "id", id("a.jpg")), "Collection of alice: best of 2023")
+	edit("alice", with(best, "action", "fly"), "Unknown action: fly")
+
+	want := strings.Join([]string{id("d.jpg"), id("c.jpg"), id("a.jpg"), id("b.jpg")}, " ")
+	if got := names("best of 2023"); got != want {
+		t.Errorf("bad order %q, want %q", got, want)
+	}
+	var cols []JsonCollection
+	get(url.Values{}, &cols)
+	if len(cols) != 1 || cols[0].Nimgs != 4 || cols[0].CovName != "d.jpg" || cols[0].Owner != "alice" {
+		t.Errorf("bad list %+v", cols)
+	}
+	if got := queryNames(db, `"collection:Best of 2023`); got != "a.jpg b.jpg c.jpg d.jpg" {
+		t.Errorf("bad query %q", got)
+	}
+
+	// The collection alone comes in its order.
+	req := httptest.NewRequest("GET", "/q?"+url.Values{"q": {`"collection:Best of 2023`}}.Encode(), nil)
+	req = req.WithContext(context.WithValue(req.Context(), "userEmail", "alice"))
+	rec := httptest.NewRecorder()
+	HandleQuery(rec, req, db)
+	var jimgs []JsonImage
+	json.Unmarshal(rec.Body.Bytes(), &jimgs)
+	var ins []string
+	for _, j := range jimgs {
+		ins = append(ins, j.In)
+	}
+	if got := strings.Join(ins, " "); got != "d.jpg c.jpg a.jpg b.jpg" {
+		t.Errorf("collection query not in the collection order %q", got)
+	}
+
+	// The zip has the images in the order of the collection.
+	rec = httptest.NewRecorder()
+	HandleDownload(rec, httptest.NewRequest("GET", "/", nil), db.Snapshot(),
+		url.Values{"collection": {"best of 2023"}, "s": {"O"}})
+	z, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, f := range z.File {
+		files = append(files, f.Name)
+	}
+	if got := strings.Join(files, " "); got != "lyon/d.jpg lyon/c.jpg noel/a.jpg noel/b.jpg" {
+		t.Errorf("bad zip %q", got)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, `"best of 2023.zip"`) {
+		t.Errorf("bad zip name %q", cd)
+	}
+
+	// The ids survive a reload, the removed images are skipped.
+	os.Remove(path.Join(orig, "noel/b.jpg"))
+	if err := db.ReloadDirectories([]string{"noel", "lyon"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryNames(db, `"collection:best of 2023`); got != "a.jpg c.jpg d.jpg" {
+		t.Errorf("bad query after reload %q", got)
+	}
+
+	edit("alice", with(best, "action", "rename", "to", "grand-mère"), "ok")
+	edit("alice", url.Values{"name": {"grand-mère"}, "action": {"remove"}, "id": {id("a.jpg")}}, "ok")
+	if got := queryNames(db, "collection:grand-mère"); got != "c.jpg d.jpg" {
+		t.Errorf("bad renamed collection %q", got)
+	}
+	edit("alice", url.Values{"name": {"grand-mère"}, "action": {"delete"}}, "ok")
+	if got := queryNames(db, "collection:grand-mère"); got != "" {
+		t.Errorf("deleted collection still found %q", got)
+	}
+}
@@ -3,8 +3,8 @@ package model
 import (
 	"mime"
   "archive/zip"
-  "fmt"
-  "io"
+  "encoding/json"
+  "errors"
   "log"
   "net/http"
   "net/url"
@@ -16,20 +16,27 @@ import (
   ioutil "io/ioutil"
 )
 
+// Zip the images of the query "q", or of the collection "collection" in
+// its order.
 func HandleDownload(w http.ResponseWriter, r *http.Request, db *Database,
                     vals url.Values) {
-  q, ok := vals["q"]
-  if !ok {
-    log.Printf("Missing q: %v\n", vals)
-    return
-  }
   s, ok := vals["s"]
   if !ok {
     log.Printf("Missing s: %v\n", vals)
     return
   }
-  imgs := queryImages(q[0], db)
-  if imgs == nil {
+  var imgs []*Image
+  zip_name := "images.zip"
+  if c, ok := vals["collection"]; ok {
+    imgs = collectionImages(db, c[0])
+    zip_name = c[0] + ".zip"
+  } else if q, ok := vals["q"]; ok {
+    imgs = queryImages(q[0], db)
+  } else {
+    log.Printf("Missing q: %v\n", vals)
+    return
+  }
+  if len(imgs) == 0 {
     log.Printf("No images for query: %v\n", vals)
     return
   } 
@@ -37,13 +44,13 @@ func HandleDownload(w http.ResponseWriter, r *http.Request, db *Database,
     imgs = imgs[:100]
   }
   header := w.Header()
-  header.Set("Content-Disposition", `attachment; filename="images.zip"`)
+  header.Set("Content-Disposition", `attachment; filename="` + zip_name + `"`)
   z := zip.NewWriter(w)
   for _, img := range imgs {
     f, err := z.Create(path.Join(img.Directory().RelPat(), img.Name()))
     var b []byte
     if err == nil {
-      if s[0] == "M" {
+      if s[0] == "M" && !img.IsVideo() {
         b, err = ioutil.ReadFile(db.MidiPath(img.Id))
       } else {
         b, err = ioutil.ReadFile(db.OrigPath(img.Id))
@@ -60,15 +67,74 @@ func HandleDownload(w http.ResponseWriter, r *http.Request, db *Database,
   z.Close()
 }
 
-func HandleReload(w http.ResponseWriter, r *http.Request, odb *Database) {
-  ndb := DatabaseToReload(odb)
-  err := ndb.Load(true, true, false)
-  if err != nil {
-    fmt.Fprintf(w, err.Error())
-  } else {
-    odb.Swap(ndb)
-    fmt.Fprintf(w, "Reloaded")
+// Start a background job reloading only the directories given with "dir"
+// parameters, relative to the originals root, or without them the whole
+// database.  Returns the status of the job.
+func HandleReload(w http.ResponseWriter, r *http.Request, odb *Database,
+                  vals url.Values) {
+  if dirs, ok := vals["dir"]; ok {
+    rel_pats := make([]string, len(dirs))
+    for i, dir := range dirs {
+      rel_pat, err := cleanRelPat(dir)
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+      }
+      rel_pats[i] = rel_pat
+    }
+    returnJobStatus(w, odb.StartReloadDirectories(rel_pats).Status())
+    return
   }
+  returnJobStatus(w, odb.StartReload().Status())
+}
+
+// A directory relative to the originals root, cleaned.  The absolute
+// paths and the ones going up with ".." are refused, they could point
+// outside of the roots.
+func cleanRelPat(dir string) (string, error) {
+  if path.IsAbs(dir) {
+    return "", errors.New("Bad directory: " + dir)
+  }
+  for _, elem := range strings.Split(dir, "/") {
+    if elem == ".." {
+      return "", errors.New("Bad directory: " + dir)
+    }
+  }
+  rel_pat := path.Clean(dir)
+  if rel_pat == "." {
+    return "", nil
+  }
+  return rel_pat, nil
+}
+
+// Start a background job creating the missing mini and midi images, all
+// of them if "force" is true, and return its status.
+func HandleMinify(w http.ResponseWriter, r *http.Request, db *Database,
+                  vals url.Values) {
+  force := vals.Get("force") == "true"
+  returnJobStatus(w, db.StartMinify(force).Status())
+}
+
+// Return the status of the job given by "id", or of all the recent jobs.
+func HandleStatus(w http.ResponseWriter, r *http.Request, db *Database,
+                  vals url.Values) {
+  if id_s := vals.Get("id"); id_s != "" {
+    id, err := strconv.Atoi(id_s)
+    st, ok := db.JobStatus(id)
+    if err != nil || !ok {
+      http.Error(w, "Unknown job: " + id_s, http.StatusNotFound)
+      return
+    }
+    returnJobStatus(w, st)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(db.JobStatuses())
+}
+
+func returnJobStatus(w http.ResponseWriter, st JobStatus) {
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(&st)
 }
 
 func HandleCommands(w http.ResponseWriter, r *http.Request, db *Database) {
@@ -83,15 +149,17 @@ func HandleCommands(w http.ResponseWriter, r *http.Request, db *Database) {
     return
   }
   switch comm[0] {
-  case "download": HandleDownload(w, r, db, vals)
-  case "reload": HandleReload(w, r, db)
+  case "download": HandleDownload(w, r, requestSnapshot(r, db), vals)
+  case "reload": HandleReload(w, r, db, vals)
+  case "minify": HandleMinify(w, r, db, vals)
+  case "status": HandleStatus(w, r, db, vals)
   default: log.Printf("Unknown command: %v\n", vals)
   }
 }
 
 // Add function to get content type
 func GetContentType(path string) string {
-	ext := filepath.Ext(path)
+	ext := strings.ToLower(filepath.Ext(path))
 	switch ext {
 	case ".html":
 		return "text/html; charset=utf-8"
@@ -105,6 +173,14 @@ func GetContentType(path string) string {
 		return "image/png"
 	case ".jpg", ".jpeg":
 		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".bmp":
+		return "image/bmp"
+	case ".tif", ".tiff":
+		return "image/tiff"
+	case ".webp":
+		return "image/webp"
 	case ".svg":
 		return "image/svg+xml"
 	case ".woff":
@@ -115,6 +191,14 @@ func GetContentType(path string) string {
 		return "font/ttf"
 	case ".ico":
 		return "image/x-icon"
+	case ".webm":
+		return "video/webm"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".mp4", ".m4v":
+		return "video/mp4"
+	case ".mov":
+		return "video/quicktime"
 	default:
 		if ct := mime.TypeByExtension(ext); ct != "" {
 			return ct
@@ -169,7 +253,6 @@ func HandleFile(w http.ResponseWriter, r *http.Request, prefix string, root stri
 	}
 	defer file.Close()
 
-	// Get file info for Content-Length
 	info, err := file.Stat()
 	if err != nil {
 		http.Error(w, "Unable to get file info", http.StatusInternalServerError)
@@ -178,16 +261,16 @@ func HandleFile(w http.ResponseWriter, r *http.Request, prefix string, root stri
 
 	// Set content type based on file extension
 	contentType := GetContentType(path)
-	w.Header().Set("Content-Type", contentType)
-	
-	// Set caching headers
 	w.Header().Set("Cache-Control", "public, max-age=31536000") // Cache for 1 year
-	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
-
-	// Use larger buffer for copying
-	buf := make([]byte, 32*1024) // 32KB buffer
-	_, err = io.CopyBuffer(w, file, buf)
-	if err != nil {
-		log.Printf("Error sending file %s: %v", path, err)
+	// Minis and midis are JPEG whatever the format of the original.  They
+	// are rebuilt at the same URL when the image is rotated, so the
+	// clients check them against their modification time.
+	if strings.HasPrefix(path, "/mini/") || strings.HasPrefix(path, "/midi/") {
+		contentType = "image/jpeg"
+		w.Header().Set("Cache-Control", "public, no-cache")
 	}
+	w.Header().Set("Content-Type", contentType)
+
+	// Handles the range requests used to stream videos.
+	http.ServeContent(w, r, path, info.ModTime(), file)
 }
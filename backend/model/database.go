@@ -7,6 +7,8 @@ import (
 	"os"
 	"path"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,7 +26,25 @@ type Database struct {
 	directories          []*Directory
 	indexer              *Indexer
 	file_times           FileTimes
+	catalog              map[string]*store.CatalogEntry
+	load_errors          int // Directories that failed to load.
 	recentActiveKeywords []KeywordCount
+	// Generation read by the requests, see Snapshot.  directories, indexer
+	// and recentActiveKeywords are only used by the loader and the writers.
+	gen atomic.Pointer[generation]
+	mu  sync.Mutex // Serializes the writers.
+	// Background jobs, and the one reporting the progress of Load and of
+	// the minification, if any.
+	jobs     Jobs
+	progress *Job
+	// The ids of the journal entries, see appendJournal.
+	journal journalIds
+	// The directories edited during a full reload, nil if none is
+	// running.  See StartReload.
+	reload_edits map[string]*store.Directory
+	// On the snapshot of a request, the user making it.  See
+	// requestSnapshot.
+	user string
 }
 
 func NewDatabase(root string) *Database {
@@ -40,7 +60,8 @@ func NewDatabase(root string) *Database {
 	return db
 }
 
-func DatabaseToReload(odb *Database) *Database {
+// A database with the same roots as odb, and nothing loaded.
+func withRoots(odb *Database) *Database {
 	db := new(Database)
 	db.indx_root = odb.indx_root
 	db.orig_root = odb.orig_root
@@ -48,6 +69,11 @@ func DatabaseToReload(odb *Database) *Database {
 	db.mini_root = odb.mini_root
 	db.mont_root = odb.mont_root
 	db.static_root = odb.static_root
+	return db
+}
+
+func DatabaseToReload(odb *Database) *Database {
+	db := withRoots(odb)
 	db.indexer = NewIndexer()
 	db.file_times = NewFileTimes()
 	return db
@@ -119,10 +145,21 @@ func (db *Database) OrigPath(image_id int) string {
 	}
 	return path.Join(db.orig_root, img.Directory().RelPat(), img.Name())
 }
+
+// Replace the content of db with the one of ndb, a database loaded with
+// DatabaseToReload.
 func (db *Database) Swap(ndb *Database) {
-	// Lets' ignore threading issues.
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.swap(ndb)
+}
+
+// Like Swap, with db.mu held.
+func (db *Database) swap(ndb *Database) {
 	db.indexer = ndb.indexer
 	db.directories = ndb.directories
+	db.recentActiveKeywords = ndb.recentActiveKeywords
+	db.publish()
 }
 
 func (db *Database) SaveDirectory(dir *Directory) (err error) {
@@ -136,6 +173,7 @@ func (db *Database) SaveDirectory(dir *Directory) (err error) {
 type loaderLoad struct {
 	rel_pat    string    // Directory relative path.
 	orgd_mtime time.Time // Mod time of orginals directory.
+	rescan     bool      // Check all the files, even if orgd did not change.
 	err        error
 }
 
@@ -145,6 +183,12 @@ type loaderResult struct {
 	rel_pat   string        // Directory relative path.
 	orgd_subs []os.FileInfo // FileInfo for sub directories of orgd.
 	err       error         // Error, if any
+	// True if the directory was taken from the catalog snapshot.
+	from_catalog bool
+	// The items removed from the directory, and the rename keys of its
+	// items given a new id, by name.  See inheritMovedIds.
+	removed  []*store.Item
+	new_keys map[string]string
 }
 
 func readIndex(idx string, sdir *store.Directory) error {
@@ -166,12 +210,12 @@ func writeIndex(bin_path string, txt_path string, sdir *store.Directory) (err er
 	if err != nil {
 		return
 	}
-	err = ioutil.WriteFile(bin_path, bin_data, 0777)
+	err = WriteFileAtomic(bin_path, bin_data, 0644)
 	if err != nil {
 		return
 	}
 	txt_data := []byte(proto.MarshalTextString(sdir))
-	err = ioutil.WriteFile(txt_path, txt_data, 0777)
+	err = WriteFileAtomic(txt_path, txt_data, 0644)
 	return
 }
 
@@ -180,36 +224,55 @@ func (db *Database) handleLoad(
 	if lod.err != nil {
 		return nil, lod.err
 	}
+	if res := db.loadFromCatalog(lod); res != nil {
+		return res, nil
+	}
 	var sdir store.Directory
-	// Ignore missing index, means new directory.
-	readIndex(db.IndexPath(lod.rel_pat), &sdir)
+	// Ignore missing index, means new directory.  A corrupted index is
+	// rebuilt from the originals.
+	err := readIndex(db.IndexPath(lod.rel_pat), &sdir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("%s: rebuilding corrupted index: %s\n", lod.rel_pat, err.Error())
+		sdir.Reset()
+	}
 	origd := db.FullOrigPath(lod.rel_pat)
 	subs, err := ioutil.ReadDir(origd)
 	if err != nil {
 		return nil, err
 	}
+	dirty, err := migrateIndex(db.originals(lod.rel_pat, update_disk), lod.rel_pat, &sdir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []*store.Item
+	var new_keys map[string]string
 	if sdir.DirectoryTimestamp == nil ||
 		ProtoToTime(*sdir.DirectoryTimestamp).Before(lod.orgd_mtime) ||
-		force_reload {
-		err = UpdateDirectory(origd, subs, force_reload, &sdir)
+		force_reload || lod.rescan {
+		removed, err = updateDirectory(origd, subs, force_reload, &sdir)
 		if err == nil {
 			orgd_ts := TimeToProto(lod.orgd_mtime)
 			sdir.DirectoryTimestamp = &orgd_ts
-			if update_disk {
-				err = writeIndex(db.IndexPath(lod.rel_pat), db.IndexTextPath(lod.rel_pat),
-					&sdir)
-				if err != nil {
-					log.Printf("%s: %s\n", lod.rel_pat, err.Error())
-					err = nil
-				}
-			}
+			dirty = true
+		}
+		if err == nil {
+			new_keys = unassignedKeys(&sdir)
+			assignIds(lod.rel_pat, &sdir)
 		}
 	}
 	if err != nil {
 		return nil, err
 	}
+	if dirty && update_disk {
+		err = writeIndex(db.IndexPath(lod.rel_pat), db.IndexTextPath(lod.rel_pat),
+			&sdir)
+		if err != nil {
+			log.Printf("%s: %s\n", lod.rel_pat, err.Error())
+		}
+	}
 	dir := ProtoToDirectory(&sdir, lod.rel_pat)
-	return &loaderResult{dir: dir, rel_pat: lod.rel_pat, orgd_subs: subs}, nil
+	return &loaderResult{dir: dir, rel_pat: lod.rel_pat, orgd_subs: subs,
+		removed: removed, new_keys: new_keys}, nil
 }
 
 // Worker function loading and checking directories.
@@ -222,7 +285,7 @@ func (db *Database) loaderWorker(update_disk bool, force_reload bool,
 			res_ch <- res
 		} else {
 			log.Printf("Worker err: %v\n", err)
-			res_ch <- &loaderResult{err: err}
+			res_ch <- &loaderResult{err: err, rel_pat: lod.rel_pat}
 		}
 	}
 }
@@ -260,6 +323,7 @@ func (a ByMostRecent) Less(i, j int) bool { return a[i].Time().Before(a[j].Time(
 
 func (db *Database) Load(update_disk, minify, force_reload bool) error {
 	LoadSynonyms(db.static_root)
+	LoadKeywordList(db.static_root)
 	N := 3
 	pat_ch := make(chan *loaderLoad, N)
 	res_ch := make(chan *loaderResult, N)
@@ -267,12 +331,18 @@ func (db *Database) Load(update_disk, minify, force_reload bool) error {
 		go db.loaderWorker(update_disk, force_reload, pat_ch, res_ch)
 	}
 	log.Printf("Loading database\n")
+	db.progress.setPhase(PhaseScan)
 	start_time := time.Now()
 	t, err := DirModTime(db.orig_root)
 	if err != nil {
 		log.Printf("%s: %s\n", db.orig_root, err.Error())
 		return err
 	}
+	if !force_reload {
+		db.catalog = db.readCatalog()
+	}
+	from_catalog := 0
+	var results []*loaderResult
 	queue := make([]*loaderLoad, 0, N)
 	db.file_times.RecordOne("", t)
 	queue = append(queue, db.newLoad(""))
@@ -290,9 +360,17 @@ func (db *Database) Load(update_disk, minify, force_reload bool) error {
 		if !has_pushed {
 			res := <-res_ch
 			left -= 1
-			if res.err == nil {
+			if res.err != nil {
+				db.load_errors += 1
+				db.progress.addError(res.rel_pat + ": " + res.err.Error())
+			} else {
+				db.progress.addDirectory(len(res.dir.Images()))
+				if res.from_catalog {
+					from_catalog += 1
+				}
 				db.file_times.Record(res.rel_pat, res.orgd_subs)
 				db.addDirectory(res.dir)
+				results = append(results, res)
 				for _, fi := range res.orgd_subs {
 					if !fi.Mode().IsRegular() {
 						jp := path.Join(res.rel_pat, fi.Name())
@@ -305,19 +383,39 @@ func (db *Database) Load(update_disk, minify, force_reload bool) error {
 	}
 	close(pat_ch)
 	close(res_ch)
-	log.Printf("Loaded %d directories in %g ms\n",
-		len(db.directories),
+	log.Printf("Loaded %d directories (%d from catalog) in %g ms\n",
+		len(db.directories), from_catalog,
 		time.Since(start_time).Seconds()*1000)
 	log.Printf("%d files\n", len(db.file_times))
+	db.catalog = nil // free that.
+	inheritMovedIds(results)
 	start_time = time.Now()
 	sort.Sort(ByMostRecent(db.directories))
 	start_time = time.Now()
+	db.progress.setPhase(PhaseIndex)
 	num_images := db.indexer.BuildIndex(db)
 	log.Printf("Indexed %d images in %g ms\n",
 		num_images,
 		time.Since(start_time).Seconds()*1000)
+	if update_disk {
+		db.saveChangedIds()
+		err = db.writeCatalog()
+		if err != nil {
+			log.Printf("%s: %s\n", db.CatalogPath(), err.Error())
+		}
+		if *collect_garbage {
+			report, err := db.CollectGarbage(true)
+			if err != nil {
+				log.Printf("Garbage collection: %s\n", err.Error())
+			} else {
+				log.Printf("Collected %d orphaned files, %d bytes\n",
+					len(report.Orphans), report.Bytes)
+			}
+		}
+	}
 	if minify {
 		start_time = time.Now()
+		db.progress.setPhase(PhaseMinify)
 		go db.resetMontageDirectory()
 		num_minified := MinifyDatabase(db, false, false)
 		log.Printf("Minifed %d images in %g ms\n",
@@ -333,9 +431,150 @@ func (db *Database) Load(update_disk, minify, force_reload bool) error {
 		time.Since(start_time).Seconds()*1000)
 
 	db.file_times = nil // free that.
+	db.publish()
 	return nil
 }
 
+// Save the directories where BuildIndex had to change ids.
+func (db *Database) saveChangedIds() {
+	for _, dir := range db.directories {
+		if dir.ids_changed {
+			err := db.SaveDirectory(dir)
+			if err != nil {
+				log.Printf("%s: %s\n", dir.RelPat(), err.Error())
+			}
+			dir.ids_changed = false
+		}
+	}
+}
+
+// True if rel_pat is one of the removed directories or below one.
+func isRemoved(rel_pat string, removed map[string]bool) bool {
+	for {
+		if removed[rel_pat] {
+			return true
+		}
+		if rel_pat == "" {
+			return false
+		}
+		rel_pat = path.Dir(rel_pat)
+		if rel_pat == "." {
+			rel_pat = ""
+		}
+	}
+}
+
+// Reload some directories from their originals, as well as the sub
+// directories that appeared in them, and patch them in the database and
+// its index.  Directories that disappeared are dropped with their sub
+// directories.  All the files of the reloaded directories are checked, so
+// files rewritten in place are picked up.
+func (db *Database) ReloadDirectories(rel_pats []string, update_disk, minify bool) error {
+	return db.reloadDirectoriesJob(nil, rel_pats, update_disk, minify)
+}
+
+// Like ReloadDirectories, reporting its progress to job.
+func (db *Database) reloadDirectoriesJob(job *Job, rel_pats []string, update_disk, minify bool) error {
+	start_time := time.Now()
+	db.mu.Lock()
+	changed, num_removed, err := db.reloadDirectories(rel_pats, update_disk)
+	num_images := len(db.indexer.images_by_id)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, dir := range changed {
+		job.addDirectory(len(dir.Images()))
+	}
+	if minify {
+		go db.resetMontageDirectory()
+		snap := db.Snapshot()
+		snap.progress = job
+		job.setPhase(PhaseMinify)
+		MinifyDirectories(snap, changed, false)
+	}
+	log.Printf("Reloaded %d directories (%d removed), %d images in %g ms\n",
+		len(changed), num_removed, num_images,
+		time.Since(start_time).Seconds()*1000)
+	return nil
+}
+
+// Does the work of ReloadDirectories, with db.mu held.  Returns the
+// reloaded directories and the number of removed ones.
+func (db *Database) reloadDirectories(rel_pats []string, update_disk bool) (
+	[]*Directory, int, error) {
+	old_dirs := make(map[string]*Directory, len(db.directories))
+	for _, dir := range db.directories {
+		old_dirs[dir.RelPat()] = dir
+	}
+	loaded := make(map[string]*Directory)
+	var results []*loaderResult
+	removed := make(map[string]bool)
+	queue := append([]string(nil), rel_pats...)
+	for len(queue) > 0 {
+		rel_pat := queue[0]
+		queue = queue[1:]
+		if _, ok := loaded[rel_pat]; ok {
+			continue
+		}
+		mod_time, err := DirModTime(db.FullOrigPath(rel_pat))
+		if os.IsNotExist(err) {
+			removed[rel_pat] = true
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		res, err := db.handleLoad(update_disk, false, &loaderLoad{rel_pat: rel_pat,
+			orgd_mtime: mod_time.Round(time.Second), rescan: true})
+		if err != nil {
+			return nil, 0, err
+		}
+		loaded[rel_pat] = res.dir
+		results = append(results, res)
+		subs := make(map[string]bool)
+		for _, fi := range res.orgd_subs {
+			if !fi.Mode().IsRegular() {
+				sub := path.Join(rel_pat, fi.Name())
+				subs[fi.Name()] = true
+				if _, ok := old_dirs[sub]; !ok {
+					queue = append(queue, sub)
+				}
+			}
+		}
+		if old, ok := old_dirs[rel_pat]; ok {
+			for _, name := range old.SubDirectories() {
+				if !subs[name] {
+					removed[path.Join(rel_pat, name)] = true
+				}
+			}
+		}
+	}
+	var dropped []*Directory
+	// The images of the removed directories can have moved too.
+	gone := new(loaderResult)
+	for _, dir := range db.directories {
+		_, reloaded := loaded[dir.RelPat()]
+		if reloaded || isRemoved(dir.RelPat(), removed) {
+			dropped = append(dropped, dir)
+		}
+		if !reloaded && isRemoved(dir.RelPat(), removed) {
+			gone.removed = append(gone.removed, dir.ToProto().Items...)
+		}
+	}
+	inheritMovedIds(append(results, gone))
+	changed := make([]*Directory, 0, len(loaded))
+	for rel_pat, dir := range loaded {
+		if !isRemoved(rel_pat, removed) {
+			changed = append(changed, dir)
+		}
+	}
+	db.replaceDirectories(dropped, changed)
+	if update_disk {
+		db.saveChangedIds()
+	}
+	return changed, len(removed), nil
+}
+
 // KeywordCount represents a keyword with its occurrence count and sample images
 type KeywordCount struct {
 	Keyword      string   `json:"keyword"`
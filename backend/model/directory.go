@@ -16,14 +16,71 @@ type Directory struct {
   rel_pat string
   index_time time.Time
   last_modified time.Time
-  order_by string
+  order_by string  // Order of the images, see album.go.
+  title string
+  description string
+  cover string  // Name of the chosen cover image.
+  manual_order []string
+  index_order_by string
+  album_file *store.Album
+  album_edits *store.Album
   images []*Image
-  // TODO: videos []Video
+  sub_directories []string
+  ids_changed bool  // Set when the indexer changed image ids.
 }
 
 func (dir *Directory) OrderBy() string { return dir.order_by }
+func (dir *Directory) Description() string { return dir.description }
 func (dir *Directory) Images() []*Image { return dir.images }
 func (dir *Directory) RelPat() string { return dir.rel_pat }
+func (dir *Directory) SubDirectories() []string { return dir.sub_directories }
+
+// The images that are not videos.
+func (dir *Directory) stills() []*Image {
+  stills := make([]*Image, 0, len(dir.images))
+  for _, img := range dir.images {
+    if !img.IsVideo() {
+      stills = append(stills, img)
+    }
+  }
+  return stills
+}
+
+// The image representing the directory: its chosen cover, else its best
+// rated image, the first one among equals, or its first video if it only
+// has videos.  Nil if it is empty.
+func (dir *Directory) Cover() *Image {
+  if dir.cover != "" {
+    for _, img := range dir.images {
+      if img.Name() == dir.cover {
+        return img
+      }
+    }
+  }
+  return bestImage(dir.images)
+}
+
+// The best rated image of imgs, the first one among equals, or the first
+// video if there are only videos.  Nil if imgs is empty.
+func bestImage(imgs []*Image) *Image {
+  var best *Image
+  for _, img := range imgs {
+    if img.IsVideo() || img.IsRejected() {
+      continue
+    }
+    if best == nil || img.rating > best.rating ||
+       (img.rating == best.rating && img.pick > best.pick) {
+      best = img
+    }
+  }
+  if best != nil {
+    return best
+  }
+  if len(imgs) > 0 {
+    return imgs[0]
+  }
+  return nil
+}
 func (dir *Directory) Time() time.Time { return dir.index_time }
 func (dir *Directory) ItemTime() time.Time { 
   if len(dir.images) == 0 {
@@ -33,18 +90,39 @@ func (dir *Directory) ItemTime() time.Time {
 }
 
 
+// A copy of dir and of its images, that can be modified without changing
+// dir.
+func (dir *Directory) copy() *Directory {
+  ndir := new(Directory)
+  *ndir = *dir
+  ndir.images = make([]*Image, len(dir.images))
+  for i, img := range dir.images {
+    nimg := new(Image)
+    *nimg = *img
+    nimg.dir = ndir
+    ndir.images[i] = nimg
+  }
+  return ndir
+}
+
 func (dir *Directory) Intern(indexer *Indexer) {
   for _, image := range dir.images {
     image.Intern(indexer)
   }
 }
 
+func (dir *Directory) Release(indexer *Indexer) {
+  for _, image := range dir.images {
+    image.Release(indexer)
+  }
+}
+
 func tryGuess(s string, p string) (tim time.Time, err error) {
   if len(s) < len(p) {
     err = errors.New("")
     return
   }
-  tim, err = time.ParseInLocation(p, s[0:len(p)], time.FixedZone("PST", -8 * 3600))
+  tim, err = time.ParseInLocation(p, s[0:len(p)], defaultLocation())
   return
 }
 
@@ -69,7 +147,7 @@ func (dir *Directory) guessTimeFromName() (tim time.Time, err error) {
     }
     // Special case for days 1:9
     if len(splits[i]) >= 11 {
-      tim, err = time.Parse("Jan _2, 2006 MST", splits[i][0:11] + " PST")
+      tim, err = time.ParseInLocation("Jan _2, 2006", splits[i][0:11], defaultLocation())
       if err == nil {
         return
       }
@@ -119,14 +197,15 @@ func ProtoToDirectory(sdir *store.Directory, rel_pat string) *Directory {
   } else {
     dir.index_time = time.Unix(0, 0)
   }
-  images := make([]*Image, 0)
+  images := make([]*Image, 0, len(sdir.Items))
   for i := 0; i < len(sdir.Items); i++ {
-    if sdir.Items[i].Video == nil {
-      images = append(images, ProtoToImage(dir, sdir.Items[i]))
-    }
+    images = append(images, ProtoToImage(dir, sdir.Items[i]))
   }
   dir.images = images 
+  dir.sub_directories = sdir.SubDirectories
+  dir.setAlbum(sdir)
   dir.Finalize()
+  dir.sortImages()
   for _, img := range dir.images {
 		if len(img.Keywords()) == 0 {
 			log.Printf("No keywords: %s/%s\n", rel_pat, img.Name())
@@ -139,17 +218,31 @@ func ProtoToDirectory(sdir *store.Directory, rel_pat string) *Directory {
 
 func (dir *Directory) ToProto() *store.Directory {
   sdir := new(store.Directory)
+  sdir.Version = proto.Int32(currentIndexVersion())
   if dir.index_time != time.Unix(0, 0) {
     sdir.DirectoryTimestamp = proto.Int64(TimeToProto(dir.index_time))
   }
   for _, img := range dir.images {
     sdir.Items = append(sdir.Items, img.ToProto())
   }
+  sdir.SubDirectories = dir.sub_directories
+  if dir.index_order_by != "" {
+    sdir.OrderBy = proto.String(dir.index_order_by)
+  }
+  if dir.album_file != nil {
+    sdir.AlbumFile = proto.Clone(dir.album_file).(*store.Album)
+  }
+  if dir.album_edits != nil {
+    sdir.Album = proto.Clone(dir.album_edits).(*store.Album)
+  }
   return sdir
 }
 
 type JsonDirectory struct {
   Id string                     // Album path
+  Ttl string                    // Display title, empty if none
+  Desc string                   // Description, empty if none
+  Order string                  // "name", "time", "manual", or empty for the index order
   Ats int64                     // Timetamp of first image in album
   Dts int64                     // Timestamp of album directory
   Nimgs int                     // Number of images in album
@@ -161,6 +254,9 @@ type JsonDirectory struct {
 
 func (dir *Directory) Json(jdir *JsonDirectory) {
   jdir.Id = dir.rel_pat
+  jdir.Ttl = dir.title
+  jdir.Desc = dir.description
+  jdir.Order = dir.order_by
   if len(dir.images) > 0 {
     jdir.Ats = dir.images[0].ItemTime().Unix()  // Use first image's item timestamp
   } else {
@@ -168,22 +264,23 @@ func (dir *Directory) Json(jdir *JsonDirectory) {
   }
   jdir.Dts = dir.last_modified.Unix()
   jdir.Nimgs = len(dir.images)
-  if len(dir.images) > 0 {
-    img0 := dir.images[0]
+  if img0 := dir.Cover(); img0 != nil {
     jdir.Cov = img0.Id
     jdir.CovName = img0.Name()
-    
-    // Populate images 1, 2, and 3 for previews (cover is already image 0)
-    previewCount := len(dir.images) - 1  // Exclude the first image (cover)
-    if previewCount > 3 {
-      previewCount = 3
+
+    // Populate up to 3 other images for previews, videos have no minis.
+    var previews []*Image
+    for _, img := range dir.stills() {
+      if img != img0 && !img.IsRejected() && len(previews) < 3 {
+        previews = append(previews, img)
+      }
     }
-    if previewCount > 0 {
-      jdir.PreviewIds = make([]int, previewCount)
-      jdir.PreviewNames = make([]string, previewCount)
-      for i := 0; i < previewCount; i++ {
-        jdir.PreviewIds[i] = dir.images[i+1].Id      // Start from index 1
-        jdir.PreviewNames[i] = dir.images[i+1].Name() // Start from index 1
+    if len(previews) > 0 {
+      jdir.PreviewIds = make([]int, len(previews))
+      jdir.PreviewNames = make([]string, len(previews))
+      for i, img := range previews {
+        jdir.PreviewIds[i] = img.Id
+        jdir.PreviewNames[i] = img.Name()
       }
     }
   }
@@ -2,6 +2,8 @@ package model
 
 import (
   "encoding/base64"
+  "html"
+  "strconv"
   "net/http"
   "strings"
   "time"
@@ -12,12 +14,20 @@ var header = "<rss version='2.0' xmlns:content='http://purl.org/rss/1.0/modules/
 var footer = "</channel></rss>\n"
 
 
+// The display title of the album, from its path if it has none.
 func(dir *Directory) Title() string {
+  if dir.title != "" {
+    return dir.title
+  }
   return "Album " + dir.RelPat()
 }
 
+// The description of the album, its number of photos if it has none.
 func(dir *Directory) Summary() string {
-  return "dir dir dir bla bla bla"
+  if dir.description != "" {
+    return dir.description
+  }
+  return strconv.Itoa(len(dir.images)) + " photos"
 }
 
 func min(a int, b int) int {
@@ -41,16 +51,25 @@ func album_url(url_root string, dir *Directory) string {
 func (dir *Directory) RSSItem(url_root string) string {
   var strs []string
   strs = append(strs, "<item>")
-  strs = append(strs, "<title>", dir.Title(), "</title>")
+  strs = append(strs, "<title>", html.EscapeString(dir.Title()), "</title>")
   dir_url := album_url(url_root, dir)
   strs = append(strs, "<link>", dir_url, "</link>")
   strs = append(strs, "<guid>", dir_url, "</guid>")
   strs = append(strs,
     "<pubDate>", dir.Time().Format(time.RFC1123), "</pubDate>")
   strs = append(strs, "<dc:creator>Toutizes</dc:creator>")
-  strs = append(strs, "<title><![CDATA[", dir.Summary(), "]]></title>")
   strs = append(strs, "<description><![CDATA[")
-  imgs := dir.Images()
+  strs = append(strs, "<p>", html.EscapeString(dir.Summary()), "</p>\n")
+  // The cover first, then the album order.
+  imgs := dir.stills()
+  if cover := dir.Cover(); cover != nil && !cover.IsVideo() {
+    imgs = []*Image{cover}
+    for _, img := range dir.stills() {
+      if img != cover {
+        imgs = append(imgs, img)
+      }
+    }
+  }
   if len(imgs) > 4 {
     imgs = imgs[:4]
   }
@@ -68,6 +87,7 @@ func (dir *Directory) RSSItem(url_root string) string {
 }
 
 func HandleFeed(w http.ResponseWriter, r *http.Request, db *Database) {
+  db = db.Snapshot()
   var max_dirs = 5;
   w.Header().Set("Content-Type", "application/atom+xml")
   w.Write([]byte(header))
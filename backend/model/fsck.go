@@ -0,0 +1,186 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// Kinds of issues reported by Fsck.
+const (
+	FsckUnreadable       = "unreadable"        // index.pbin truncated or unparsable.
+	FsckTextUnreadable   = "text-unreadable"   // index.pbtxt truncated or unparsable.
+	FsckMismatch         = "mismatch"          // index.pbin and index.pbtxt differ.
+	FsckMissingOriginal  = "missing-original"  // Index entry without original file.
+	FsckMissingDirectory = "missing-directory" // Index without originals directory.
+	FsckTempFile         = "temp-file"         // Left by a crash in WriteFileAtomic.
+)
+
+type FsckIssue struct {
+	Kind   string
+	RelPat string // Directory relative path.
+	Name   string // Item name, empty for directory issues.
+	Detail string
+}
+
+func (issue FsckIssue) String() string {
+	name := issue.RelPat
+	if issue.Name != "" {
+		name = path.Join(issue.RelPat, issue.Name)
+	}
+	if issue.Detail != "" {
+		return fmt.Sprintf("%s: %s: %s", name, issue.Kind, issue.Detail)
+	}
+	return fmt.Sprintf("%s: %s", name, issue.Kind)
+}
+
+// Read a text index.
+func readTextIndex(idx string, sdir *store.Directory) error {
+	buffer, err := ioutil.ReadFile(idx)
+	if err == nil {
+		err = proto.UnmarshalText(string(buffer), sdir)
+	}
+	return err
+}
+
+// Check the index of one directory.  Returns the issues found and the
+// best available version of the index: the binary one if readable, else
+// the text one, else nil.
+func (db *Database) fsckDirectory(rel_pat string) ([]FsckIssue, *store.Directory) {
+	var issues []FsckIssue
+	add := func(kind, name, detail string) {
+		issues = append(issues,
+			FsckIssue{Kind: kind, RelPat: rel_pat, Name: name, Detail: detail})
+	}
+	var bin_dir, txt_dir store.Directory
+	bin_err := readIndex(db.IndexPath(rel_pat), &bin_dir)
+	if bin_err != nil {
+		add(FsckUnreadable, "", bin_err.Error())
+	}
+	txt_err := readTextIndex(db.IndexTextPath(rel_pat), &txt_dir)
+	if txt_err != nil {
+		add(FsckTextUnreadable, "", txt_err.Error())
+	}
+	if bin_err == nil && txt_err == nil && !proto.Equal(&bin_dir, &txt_dir) {
+		add(FsckMismatch, "", "")
+	}
+	var sdir *store.Directory
+	if bin_err == nil {
+		sdir = &bin_dir
+	} else if txt_err == nil {
+		sdir = &txt_dir
+	}
+	origd := db.FullOrigPath(rel_pat)
+	if _, err := os.Stat(origd); err != nil {
+		add(FsckMissingDirectory, "", err.Error())
+		return issues, sdir
+	}
+	if sdir != nil {
+		for _, item := range sdir.Items {
+			_, err := os.Stat(path.Join(origd, item.GetName()))
+			if err != nil {
+				add(FsckMissingOriginal, item.GetName(), "")
+			}
+		}
+	}
+	return issues, sdir
+}
+
+// Rebuild the index of a directory from its originals, keeping what can be
+// kept from the old index.
+func (db *Database) repairDirectory(rel_pat string, sdir *store.Directory) error {
+	if sdir == nil {
+		sdir = new(store.Directory)
+	}
+	origd := db.FullOrigPath(rel_pat)
+	mod_time, err := DirModTime(origd)
+	if err != nil {
+		return err
+	}
+	subs, err := ioutil.ReadDir(origd)
+	if err != nil {
+		return err
+	}
+	_, err = migrateIndex(db.originals(rel_pat, true), rel_pat, sdir)
+	if err != nil {
+		return err
+	}
+	err = UpdateDirectory(origd, subs, false, sdir)
+	if err != nil {
+		return err
+	}
+	assignIds(rel_pat, sdir)
+	sdir.DirectoryTimestamp = proto.Int64(TimeToProto(mod_time.Round(time.Second)))
+	return writeIndex(db.IndexPath(rel_pat), db.IndexTextPath(rel_pat), sdir)
+}
+
+// Check all the indexes under the index root and report truncated or
+// unparsable indexes, mismatches between index.pbin and index.pbtxt and
+// index entries whose originals are gone, and the temporary files left by
+// a crash.  If repair is true, rebuild the indexes with issues by running
+// UpdateDirectory on their originals, and remove the temporary files.
+// Indexes without an originals directory are only reported.
+func (db *Database) Fsck(repair bool) ([]FsckIssue, error) {
+	var rel_pats []string
+	var tmp_files []FsckIssue
+	err := filepath.Walk(db.indx_root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel_pat, err := filepath.Rel(db.indx_root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		if rel_pat == "." {
+			rel_pat = ""
+		}
+		if isAtomicTempName(info.Name()) {
+			tmp_files = append(tmp_files,
+				FsckIssue{Kind: FsckTempFile, RelPat: rel_pat, Name: info.Name()})
+			return nil
+		}
+		if info.Name() != "index.pbin" && info.Name() != "index.pbtxt" {
+			return nil
+		}
+		if n := len(rel_pats); n == 0 || rel_pats[n-1] != rel_pat {
+			rel_pats = append(rel_pats, rel_pat)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rel_pats)
+	issues := tmp_files
+	if repair {
+		for _, issue := range tmp_files {
+			os.Remove(path.Join(db.indx_root, issue.RelPat, issue.Name))
+		}
+	}
+	for _, rel_pat := range rel_pats {
+		dir_issues, sdir := db.fsckDirectory(rel_pat)
+		issues = append(issues, dir_issues...)
+		if !repair || len(dir_issues) == 0 ||
+			dir_issues[len(dir_issues)-1].Kind == FsckMissingDirectory {
+			continue
+		}
+		err = db.repairDirectory(rel_pat, sdir)
+		if err != nil {
+			log.Printf("%s: cannot repair: %s\n", rel_pat, err.Error())
+		} else {
+			log.Printf("%s: repaired\n", rel_pat)
+		}
+	}
+	return issues, nil
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func fsckKinds(t *testing.T, db *Database, repair bool) map[string]string {
+	issues, err := db.Fsck(repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]string)
+	for _, issue := range issues {
+		kinds[path.Join(issue.RelPat, issue.Name)] = issue.Kind
+	}
+	return kinds
+}
+
+func Test_Fsck(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "b.jpg", "2001/c.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+
+	db := NewDatabase2(orig, root, root)
+	if err := db.Load(true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if kinds := fsckKinds(t, db, false); len(kinds) != 0 {
+		t.Fatalf("issues in a fresh database: %v", kinds)
+	}
+	if fi, err := os.Stat(db.IndexPath("")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("bad index mode %v %v", fi.Mode(), err)
+	}
+
+	data, _ := ioutil.ReadFile(db.IndexPath("2001"))
+	ioutil.WriteFile(db.IndexPath("2001"), data[:len(data)-3], 0777)
+	ioutil.WriteFile(db.IndexTextPath(""), []byte("items {"), 0777)
+	os.Remove(path.Join(orig, "b.jpg"))
+	tmp := path.Join(path.Dir(db.IndexPath("2001")), ".index.pbin.tmp123456")
+	ioutil.WriteFile(tmp, data, 0644)
+	kinds := fsckKinds(t, db, true)
+	if kinds["2001/.index.pbin.tmp123456"] != FsckTempFile {
+		t.Errorf("temporary file not reported: %v", kinds)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temporary file not removed: %v", err)
+	}
+	if kinds["2001"] != FsckUnreadable {
+		t.Errorf("truncated index not reported: %v", kinds)
+	}
+	if kinds[""] != FsckTextUnreadable {
+		t.Errorf("bad text index not reported: %v", kinds)
+	}
+	if kinds["b.jpg"] != FsckMissingOriginal {
+		t.Errorf("missing original not reported: %v", kinds)
+	}
+	if kinds := fsckKinds(t, db, false); len(kinds) != 0 {
+		t.Errorf("issues after repair: %v", kinds)
+	}
+
+	os.RemoveAll(path.Join(orig, "2001"))
+	if kinds := fsckKinds(t, db, true); kinds["2001"] != FsckMissingDirectory {
+		t.Errorf("missing directory not reported: %v", kinds)
+	}
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var collect_garbage = flag.Bool("collect_garbage", false,
+	"If true, delete orphaned indexes and derivatives after loading the database.")
+
+// Result of a garbage collection pass.
+type GcReport struct {
+	Orphans []string // Orphaned files, sorted.
+	Bytes   int64    // Total size of the orphaned files.
+	Deleted bool     // True if the orphaned files were deleted.
+}
+
+// Find the files under root that keep returns false for.  keep is called
+// with the path of the file relative to root.
+func findOrphans(root string, keep func(rel string) bool,
+	report *GcReport) error {
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if !keep(rel) {
+			report.Orphans = append(report.Orphans, p)
+			report.Bytes += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Remove the empty directories under root, but not root itself.
+func removeEmptyDirectories(root string) {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			sub := path.Join(root, fi.Name())
+			removeEmptyDirectories(sub)
+			os.Remove(sub) // Fails if not empty.
+		}
+	}
+}
+
+// Find the index directories, mini and midi files and cached montages that
+// do not correspond to any image of the loaded database.  If delete is
+// true, remove them, as well as the directories left empty.  Refuses to
+// run on a database that is not loaded or had load errors, as everything
+// would look orphaned.
+func (db *Database) CollectGarbage(delete bool) (*GcReport, error) {
+	if len(db.directories) == 0 {
+		return nil, errors.New("database not loaded")
+	}
+	if db.load_errors > 0 {
+		return nil, errors.New("database had load errors")
+	}
+	dirs := make(map[string]bool, len(db.directories))
+	images := make(map[string]bool)
+	for _, dir := range db.directories {
+		dirs[dir.RelPat()] = true
+		for _, img := range dir.Images() {
+			images[path.Join(dir.RelPat(), img.Name())] = true
+		}
+	}
+	report := new(GcReport)
+	keep_index := func(rel string) bool {
+		rel_pat, name := path.Split(rel)
+		rel_pat = strings.TrimSuffix(rel_pat, "/")
+		if rel_pat == "" && name == path.Base(db.CatalogPath()) {
+			return true
+		}
+		// Only index files are candidates, leave anything else alone.
+		return dirs[rel_pat] || (name != "index.pbin" && name != "index.pbtxt")
+	}
+	keep_image := func(rel string) bool {
+		return images[rel]
+	}
+	keep_montage := func(rel string) bool {
+		_, ids := montageSpec(strings.TrimSuffix(rel, ".jpg"))
+		if ids == nil {
+			return false
+		}
+		for _, id := range ids {
+			if db.indexer.Image(id) == nil {
+				return false
+			}
+		}
+		return true
+	}
+	roots := []string{db.indx_root, db.mini_root, db.midi_root}
+	keeps := []func(string) bool{keep_index, keep_image, keep_image}
+	for i, root := range roots {
+		err := findOrphans(root, keeps[i], report)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := findOrphans(db.mont_root, keep_montage, report)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(report.Orphans)
+	if !delete {
+		return report, nil
+	}
+	for _, p := range report.Orphans {
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("%s: %s\n", p, err.Error())
+		}
+	}
+	for _, root := range roots {
+		removeEmptyDirectories(root)
+	}
+	report.Deleted = true
+	return report, nil
+}
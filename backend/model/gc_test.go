@@ -0,0 +1,82 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func Test_CollectGarbage(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg", "2002/c.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	a := imageNamed(db, "a.jpg")
+	for _, p := range []string{"mini/a.jpg", "midi/a.jpg", "mini/2002/c.jpg",
+		"midi/2002/c.jpg", "mini/x.jpg"} {
+		os.MkdirAll(path.Dir(path.Join(root, p)), 0777)
+		ioutil.WriteFile(path.Join(root, p), []byte("12345"), 0777)
+	}
+	os.MkdirAll(db.MontagePath(), 0777)
+	good := path.Join(db.MontagePath(), "1x1-"+strconv.Itoa(a.Id)+".jpg")
+	bad := path.Join(db.MontagePath(), "1x1-"+strconv.Itoa(a.Id+1)+".jpg")
+	ioutil.WriteFile(good, nil, 0777)
+	ioutil.WriteFile(bad, nil, 0777)
+
+	// Delete an album.
+	os.RemoveAll(path.Join(orig, "2002"))
+	db = loadTestDatabase(t, orig, root)
+	report, err := db.CollectGarbage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		bad,
+		db.IndexPath("2002"),
+		db.IndexTextPath("2002"),
+		path.Join(root, "midi/2002/c.jpg"),
+		path.Join(root, "mini/2002/c.jpg"),
+		path.Join(root, "mini/x.jpg"),
+	}
+	if len(report.Orphans) != len(want) {
+		t.Fatalf("orphans %v, want %v", report.Orphans, want)
+	}
+	for _, p := range want {
+		found := false
+		for _, o := range report.Orphans {
+			found = found || o == p
+		}
+		if !found {
+			t.Errorf("missing orphan %s in %v", p, report.Orphans)
+		}
+	}
+	if _, err := os.Stat(bad); err != nil {
+		t.Error("listing deleted files")
+	}
+
+	report, err = db.CollectGarbage(true)
+	if err != nil || !report.Deleted || report.Bytes < 15 {
+		t.Fatalf("bad report %v: %v", report, err)
+	}
+	for _, p := range want {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("%s not deleted", p)
+		}
+	}
+	for _, p := range []string{good, db.IndexPath(""), db.CatalogPath(),
+		path.Join(root, "mini/a.jpg")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s deleted", p)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "mini/2002")); err == nil {
+		t.Error("empty directory not deleted")
+	}
+
+	db = NewDatabase2(orig, root, root)
+	if _, err := db.CollectGarbage(true); err == nil {
+		t.Error("collected garbage of an unloaded database")
+	}
+}
@@ -0,0 +1,158 @@
+package model
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// The directories and index of the database at one point in time.  A
+// generation, and the directories and images it points to, is never
+// modified once published: writers build a new one and publish it.
+type generation struct {
+	directories          []*Directory
+	indexer              *Indexer
+	recentActiveKeywords []KeywordCount
+}
+
+// Publish the directories and index of db to the requests.
+func (db *Database) publish() {
+	db.gen.Store(&generation{
+		directories:          db.directories,
+		indexer:              db.indexer,
+		recentActiveKeywords: db.recentActiveKeywords,
+	})
+}
+
+// A read only view of the database, consistent for as long as it is used
+// even if the database is reloaded or edited meanwhile.  Requests should
+// take a snapshot when they start and use it throughout.  Returns db itself
+// if it was not published yet, i.e. while loading or for a snapshot.
+func (db *Database) Snapshot() *Database {
+	gen := db.gen.Load()
+	if gen == nil {
+		return db
+	}
+	snap := withRoots(db)
+	snap.directories = gen.directories
+	snap.indexer = gen.indexer
+	snap.recentActiveKeywords = gen.recentActiveKeywords
+	return snap
+}
+
+// Replace the removed directories by the added ones, update the index and
+// publish the result.  The published directories, images and index are
+// left untouched: the index is patched on a copy, and if all the ranks must
+// be recomputed the directories are copied too.  Must be called with db.mu
+// held.  Returns the number of images.
+func (db *Database) replaceDirectories(removed []*Directory, added []*Directory) int {
+	is_removed := make(map[*Directory]bool, len(removed))
+	for _, dir := range removed {
+		is_removed[dir] = true
+	}
+	dirs := make([]*Directory, 0, len(db.directories)+len(added))
+	for _, dir := range db.directories {
+		if !is_removed[dir] {
+			dirs = append(dirs, dir)
+		}
+	}
+	// Insert the added directories at their place.
+	idx := db.indexer.clone()
+	for _, dir := range removed {
+		dir.Release(idx)
+	}
+	for _, dir := range added {
+		dir.Intern(idx)
+		i := sort.Search(len(dirs), func(i int) bool {
+			return dirs[i].Time().After(dir.Time())
+		})
+		dirs = append(dirs, nil)
+		copy(dirs[i+1:], dirs[i:])
+		dirs[i] = dir
+	}
+	db.directories = dirs
+	db.indexer = idx
+	num_images, ok := idx.PatchIndex(db, removed, added)
+	if !ok {
+		log.Printf("No room to rank the added directories, rebuilding index\n")
+		is_added := make(map[*Directory]bool, len(added))
+		for _, dir := range added {
+			is_added[dir] = true
+		}
+		idx = NewIndexer()
+		for i, dir := range dirs {
+			if !is_added[dir] {
+				dirs[i] = dir.copy()
+			}
+			dirs[i].Intern(idx)
+		}
+		db.indexer = idx
+		num_images = idx.BuildIndex(db)
+	}
+	db.recentActiveKeywords = db.GetRecentActiveKeywordsAt(time.Now())
+	db.publish()
+	return num_images
+}
+
+// Edit the stored form of a directory, save it and publish the edited
+// directory.  Requests see the edit once they take a new snapshot, the
+// directory and images they already have do not change.
+func (db *Database) mutateDirectory(rel_pat string,
+	edit func(sdir *store.Directory) error) error {
+	return db.recordedMutation(rel_pat, edit, nil)
+}
+
+// Like mutateDirectory, calling record once the edit is saved and before
+// it is published.  If record fails the old index is written back and
+// the edit is dropped.
+func (db *Database) recordedMutation(rel_pat string,
+	edit func(sdir *store.Directory) error,
+	record func(sdir *store.Directory) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var dir *Directory
+	for _, d := range db.directories {
+		if d.RelPat() == rel_pat {
+			dir = d
+			break
+		}
+	}
+	if dir == nil {
+		return errors.New("Unknown directory: " + rel_pat)
+	}
+	sdir := dir.ToProto()
+	err := edit(sdir)
+	if err == nil {
+		err = writeIndex(db.IndexPath(rel_pat), db.IndexTextPath(rel_pat), sdir)
+	}
+	if err == nil && record != nil {
+		if err = record(sdir); err != nil {
+			rerr := writeIndex(db.IndexPath(rel_pat), db.IndexTextPath(rel_pat), dir.ToProto())
+			if rerr != nil {
+				log.Printf("%s: %s\n", rel_pat, rerr.Error())
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if db.reload_edits != nil {
+		db.reload_edits[rel_pat] = proto.Clone(sdir).(*store.Directory)
+	}
+	db.replaceDirectories([]*Directory{dir}, []*Directory{ProtoToDirectory(sdir, rel_pat)})
+	return nil
+}
+
+// The item with the given name, nil if none.
+func findItem(sdir *store.Directory, name string) *store.Item {
+	for _, item := range sdir.Items {
+		if item.GetName() == name {
+			return item
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+func Test_MutateDirectory(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	db := loadTestDatabase(t, orig, root)
+	snap := db.Snapshot()
+	a := imageNamed(snap, "a.jpg")
+
+	err := db.mutateDirectory("", func(sdir *store.Directory) error {
+		findItem(sdir, "a.jpg").Image.Stereo = &store.Stereo{Dx: proto.Float32(1),
+			Dy: proto.Float32(2), AnaDx: proto.Float32(0), AnaDy: proto.Float32(0)}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Stereo() != nil || imageNamed(snap, "a.jpg") != a {
+		t.Error("published image modified")
+	}
+	b := db.Snapshot().Indexer().Image(a.Id)
+	if b == nil || b.Stereo() == nil || b.Stereo().Dy != 2 || b.Rank != a.Rank {
+		t.Errorf("edit not published: %v", b)
+	}
+	db = loadTestDatabase(t, orig, root)
+	if b = imageNamed(db, "a.jpg"); b.Stereo() == nil {
+		t.Error("edit not saved")
+	}
+
+	err = db.mutateDirectory("", func(sdir *store.Directory) error {
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Error("failed edit succeeded")
+	}
+	if err = db.mutateDirectory("nope", nil); err == nil {
+		t.Error("edited unknown directory")
+	}
+}
+
+// Run with -race.
+func Test_ConcurrentReload(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"2001/a.jpg", "2001/b.jpg", "2002/c.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := db.Snapshot()
+				n := len(queryImages("a.jpg", snap)) + len(queryImages("2001", snap))
+				for _, dir := range snap.Directories() {
+					for _, img := range dir.Images() {
+						n += img.Rank + len(img.Keywords())
+						if img.Stereo() != nil {
+							n += 1
+						}
+					}
+				}
+				if len(queryImages("a.jpg", snap)) != 1 {
+					t.Error("inconsistent snapshot")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		ioutil.WriteFile(path.Join(orig, "2002/d.jpg"), nil, 0777)
+		if err := db.ReloadDirectories([]string{"2002"}, true, false); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(path.Join(orig, "2002/d.jpg"))
+		if err := db.ReloadDirectories([]string{"2002"}, true, false); err != nil {
+			t.Fatal(err)
+		}
+		err := db.mutateDirectory("2001", func(sdir *store.Directory) error {
+			sdir.Items[0].Keywords = append(sdir.Items[0].Keywords, "kwd")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if len(queryImages("kwd", db.Snapshot())) != 1 {
+		t.Error("edits lost")
+	}
+}
@@ -0,0 +1,245 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+import "github.com/rwcarlsen/goexif/exif"
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// Where an image was taken.
+type Location struct {
+	Lat, Lng float64  // Decimal degrees, negative south and west.
+	Alt      *float64 `json:",omitempty"` // Meters above sea level.
+}
+
+const earthRadiusMeters = 6371000.0
+
+// Great circle distance between two points, in meters.
+func distanceMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlng := (lng2 - lng1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// The location of a decoded EXIF, nil if it has none.
+func exifLocation(ex *exif.Exif) *store.Location {
+	lat, lng, err := ex.LatLong()
+	if err != nil || math.IsNaN(lat) || math.IsNaN(lng) ||
+		math.Abs(lat) > 90 || math.Abs(lng) > 180 {
+		return nil
+	}
+	// Some cameras write zeros when they have no fix.
+	if lat == 0 && lng == 0 {
+		return nil
+	}
+	loc := &store.Location{Latitude: proto.Float64(lat), Longitude: proto.Float64(lng)}
+	if tag, err := ex.Get(exif.GPSAltitude); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+			alt := float64(num) / float64(den)
+			// Ref 1 means below sea level.
+			if ref, err := ex.Get(exif.GPSAltitudeRef); err == nil {
+				if r, err := ref.Int(0); err == nil && r == 1 {
+					alt = -alt
+				}
+			}
+			loc.Altitude = proto.Float64(alt)
+		}
+	}
+	return loc
+}
+
+func NearQuery(db *Database, lat, lng, radius_m float64) Query {
+	filter := func(img *Image) bool {
+		loc := img.location
+		return loc != nil && distanceMeters(lat, lng, loc.Lat, loc.Lng) <= radius_m
+	}
+	return FilteredQuery(db, filter)
+}
+
+// Images inside a box.  The box crosses the antimeridian if west > east.
+func BboxQuery(db *Database, south, west, north, east float64) Query {
+	filter := func(img *Image) bool {
+		loc := img.location
+		if loc == nil || loc.Lat < south || loc.Lat > north {
+			return false
+		}
+		if west <= east {
+			return loc.Lng >= west && loc.Lng <= east
+		}
+		return loc.Lng >= west || loc.Lng <= east
+	}
+	return FilteredQuery(db, filter)
+}
+
+// The geographic tokens: near:lat,lng[,radius] with the radius in km or m,
+// 1km by default, and bbox:south,west,north,east.  They contain commas so
+// they are taken out of the query before tokenizing it.
+var geo_token_re = regexp.MustCompile(`(?i)\b(?:` +
+	`near:\s*(-?[0-9.]+\s*,\s*-?[0-9.]+(?:\s*,\s*[0-9.]+\s*k?m\b)?)|` +
+	`bbox:\s*(-?[0-9.]+(?:\s*,\s*-?[0-9.]+){3}))`)
+var geo_leftover_re = regexp.MustCompile(`,(\s*,)+`)
+
+const defaultNearRadius = 1000.0
+
+func parseFloats(strs []string) ([]float64, error) {
+	vals := make([]float64, len(strs))
+	for i, s := range strs {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// Parse a distance like "5km" or "300m" to meters.
+func parseDistance(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	unit := 1.0
+	if strings.HasSuffix(s, "km") {
+		s = strings.TrimSuffix(s, "km")
+		unit = 1000
+	} else if strings.HasSuffix(s, "m") {
+		s = strings.TrimSuffix(s, "m")
+	} else {
+		return 0, errors.New("distance without unit " + s)
+	}
+	s = strings.TrimSpace(s)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, errors.New("bad distance " + s)
+	}
+	return v * unit, nil
+}
+
+func geoQuery(db *Database, kind string, args string) (Query, error) {
+	parts := strings.Split(args, ",")
+	switch kind {
+	case "near":
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, errors.New("near: needs lat,lng[,radius]")
+		}
+		ll, err := parseFloats(parts[:2])
+		if err != nil {
+			return nil, err
+		}
+		radius := defaultNearRadius
+		if len(parts) == 3 {
+			if radius, err = parseDistance(parts[2]); err != nil {
+				return nil, err
+			}
+		}
+		return NearQuery(db, ll[0], ll[1], radius), nil
+	case "bbox":
+		if len(parts) != 4 {
+			return nil, errors.New("bbox: needs south,west,north,east")
+		}
+		b, err := parseFloats(parts)
+		if err != nil {
+			return nil, err
+		}
+		return BboxQuery(db, b[0], b[1], b[2], b[3]), nil
+	}
+	return nil, errors.New("unknown geographic token " + kind)
+}
+
+// Take the geographic tokens out of s.  Returns the rest of s and the
+// queries of the tokens, an invalid token matches no image.
+func extractGeoQueries(s string, db *Database) (string, []Query) {
+	var qs []Query
+	rest := geo_token_re.ReplaceAllStringFunc(s, func(tok string) string {
+		m := geo_token_re.FindStringSubmatch(tok)
+		var q Query
+		var err error
+		if m[1] != "" {
+			q, err = geoQuery(db, "near", m[1])
+		} else {
+			q, err = geoQuery(db, "bbox", m[2])
+		}
+		if err != nil {
+			log.Printf("Query %q: %s\n", tok, err.Error())
+			q = EmptyQuery(db)
+		}
+		qs = append(qs, q)
+		return ""
+	})
+	if qs == nil {
+		return s, nil
+	}
+	rest = geo_leftover_re.ReplaceAllString(rest, ",")
+	return strings.Trim(rest, " ,"), qs
+}
+
+// GeoJSON, RFC 7946.
+type GeoJsonGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"` // Longitude, latitude[, altitude].
+}
+
+type GeoJsonProperties struct {
+	Id int `json:"id"`
+	// Path of the mini relative to the URL prefix of the API, like
+	// "mini/2001/a.jpg": it resolves against the URL of the request.
+	Mini string `json:"mini"`
+}
+
+type GeoJsonFeature struct {
+	Type       string            `json:"type"`
+	Geometry   GeoJsonGeometry   `json:"geometry"`
+	Properties GeoJsonProperties `json:"properties"`
+}
+
+type GeoJsonFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJsonFeature `json:"features"`
+}
+
+// The located images of imgs as point features.
+func geoJsonFeatures(imgs []*Image) *GeoJsonFeatureCollection {
+	res := &GeoJsonFeatureCollection{Type: "FeatureCollection", Features: []GeoJsonFeature{}}
+	for _, img := range imgs {
+		loc := img.Location()
+		if loc == nil {
+			continue
+		}
+		coords := []float64{loc.Lng, loc.Lat}
+		if loc.Alt != nil {
+			coords = append(coords, *loc.Alt)
+		}
+		res.Features = append(res.Features, GeoJsonFeature{
+			Type:     "Feature",
+			Geometry: GeoJsonGeometry{Type: "Point", Coordinates: coords},
+			Properties: GeoJsonProperties{
+				Id:   img.Id,
+				Mini: path.Join("mini", img.Directory().RelPat(), img.Name()),
+			},
+		})
+	}
+	return res
+}
+
+// The images matching the query q that have a location, as GeoJSON.
+func HandleGeoJson(w http.ResponseWriter, r *http.Request, db *Database) {
+	db = requestSnapshot(r, db)
+	q := r.FormValue("q")
+
+	userEmail := r.Context().Value("userEmail").(string)
+	log.Printf("GeoJSON query from %s: %q", userEmail, q)
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(geoJsonFeatures(queryImages(q, db)))
+}
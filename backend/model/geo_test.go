@@ -0,0 +1,182 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// Insert an EXIF APP1 segment with GPS tags after the SOI marker of a
+// JPEG file.
+func setExifGps(t *testing.T, p string, lat, lng, alt float64) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiff bytes.Buffer
+	w := func(vs ...interface{}) {
+		for _, v := range vs {
+			binary.Write(&tiff, binary.BigEndian, v)
+		}
+	}
+	entry := func(tag, typ uint16, count, value uint32) { w(tag, typ, count, value) }
+	ref := func(c byte) uint32 { return uint32(c) << 24 }
+	const gpsIfd, latAt, lngAt, altAt = 26, 104, 128, 152
+	w([]byte("MM"), uint16(42), uint32(8))
+	w(uint16(1))
+	entry(0x8825, 4, 1, gpsIfd) // GPSInfo.
+	w(uint32(0))
+	latRef, lngRef, altRef := byte('N'), byte('E'), uint32(0)
+	if lat < 0 {
+		latRef = 'S'
+	}
+	if lng < 0 {
+		lngRef = 'W'
+	}
+	if alt < 0 {
+		altRef = 1 << 24
+	}
+	w(uint16(6))
+	entry(1, 2, 2, ref(latRef))
+	entry(2, 5, 3, latAt)
+	entry(3, 2, 2, ref(lngRef))
+	entry(4, 5, 3, lngAt)
+	entry(5, 1, 1, altRef)
+	entry(6, 5, 1, altAt)
+	w(uint32(0))
+	for _, deg := range []float64{math.Abs(lat), math.Abs(lng)} {
+		d := math.Floor(deg)
+		m := math.Floor((deg - d) * 60)
+		s := ((deg-d)*60 - m) * 60
+		w(uint32(d), uint32(1), uint32(m), uint32(1), uint32(s*1000), uint32(1000))
+	}
+	w(uint32(math.Abs(alt)*10), uint32(10))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	seg := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append(append(append([]byte{}, data[:2]...), seg...), payload...)
+	out = append(out, data[2:]...)
+	if err = ioutil.WriteFile(p, out, 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_DistanceMeters(t *testing.T) {
+	// Paris to London.
+	if d := distanceMeters(48.8566, 2.3522, 51.5074, -0.1278); math.Abs(d-343500) > 1000 {
+		t.Errorf("bad distance %f", d)
+	}
+	if d := distanceMeters(10, 20, 10, 20); d != 0 {
+		t.Errorf("bad distance %f", d)
+	}
+}
+
+func Test_ExtractGeoQueries(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	for _, tc := range []struct {
+		query string
+		rest  string
+		n     int
+	}{
+		{"plage", "plage", 0},
+		{"near:48.85,2.35,5km", "", 1},
+		{"near:48.85,2.35 plage", "plage", 1},
+		{"plage, near:48.85, 2.35, 500m, 2024", "plage, 2024", 1},
+		{"bbox:48,2,49,3 near:-33.9,151.2,10km", "", 2},
+		{"nearby:1,2", "nearby:1,2", 0},
+	} {
+		rest, qs := extractGeoQueries(tc.query, db)
+		if rest != tc.rest || len(qs) != tc.n {
+			t.Errorf("%q: got %q and %d queries", tc.query, rest, len(qs))
+		}
+	}
+}
+
+func Test_GeoQueries(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "paris.jpg"), 8, 6)
+	setExifGps(t, path.Join(orig, "paris.jpg"), 48.8584, 2.2945, 35)
+	writeTestJpeg(t, path.Join(orig, "sydney.jpg"), 8, 6)
+	setExifGps(t, path.Join(orig, "sydney.jpg"), -33.8568, 151.2153, -2)
+	writeTestJpeg(t, path.Join(orig, "nowhere.jpg"), 8, 6)
+
+	db := loadTestDatabase(t, orig, root)
+	paris := imageNamed(db, "paris.jpg")
+	if loc := paris.Location(); loc == nil ||
+		math.Abs(loc.Lat-48.8584) > 1e-4 || math.Abs(loc.Lng-2.2945) > 1e-4 ||
+		loc.Alt == nil || *loc.Alt != 35 {
+		t.Fatalf("bad location %v", loc)
+	}
+	if loc := imageNamed(db, "sydney.jpg").Location(); loc == nil || loc.Lat > 0 || *loc.Alt != -2 {
+		t.Errorf("bad location %v", loc)
+	}
+	if loc := imageNamed(db, "nowhere.jpg").Location(); loc != nil {
+		t.Errorf("unexpected location %v", loc)
+	}
+	if itm := indexItem(t, db, "paris.jpg"); itm.GetImage().GetLocation() == nil {
+		t.Errorf("location not indexed: %v", itm)
+	}
+
+	for _, tc := range []struct {
+		query string
+		names string
+	}{
+		{"near:48.85,2.35,5km", "paris.jpg"},
+		{"near:48.85,2.35,500m", ""},
+		{"near:48.8584,2.2945", "paris.jpg"},
+		{"bbox:-40,150,-30,152", "sydney.jpg"},
+		// Crossing the antimeridian.
+		{"bbox:-90,170,90,-170", ""},
+		{"bbox:-90,150,90,3", "paris.jpg sydney.jpg"},
+		// A radius needs a unit.
+		{"near:48.85,2.35,5", ""},
+	} {
+		if got := queryNames(db, tc.query); got != tc.names {
+			t.Errorf("%q: got %q, want %q", tc.query, got, tc.names)
+		}
+	}
+}
+
+func Test_HandleGeoJson(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "paris.jpg"), 8, 6)
+	setExifGps(t, path.Join(orig, "paris.jpg"), 48.8584, 2.2945, 35)
+	writeTestJpeg(t, path.Join(orig, "nowhere.jpg"), 8, 6)
+
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+	req := httptest.NewRequest("GET", "/geojson?q=bbox:-90,-180,90,180", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "userEmail", "test@example.com"))
+	rec := httptest.NewRecorder()
+	HandleGeoJson(rec, req, db)
+
+	var res GeoJsonFeatureCollection
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != "FeatureCollection" || len(res.Features) != 1 {
+		t.Fatalf("bad collection %s", rec.Body.String())
+	}
+	f := res.Features[0]
+	paris := imageNamed(db, "paris.jpg")
+	if f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) != 3 ||
+		math.Abs(f.Geometry.Coordinates[0]-2.2945) > 1e-4 ||
+		f.Properties.Id != paris.Id ||
+		f.Properties.Mini != path.Join("mini", paris.Directory().RelPat(), "paris.jpg") {
+		t.Errorf("bad feature %+v", f)
+	}
+}
@@ -0,0 +1,120 @@
+package model
+
+import (
+	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestJpeg(t *testing.T, p string, w, h int) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, w, h)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTestDatabase(t *testing.T, orig, root string) *Database {
+	db := NewDatabase2(orig, root, root)
+	if err := db.Load(true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func imageNamed(db *Database, name string) *Image {
+	for _, dir := range db.Directories() {
+		for _, img := range dir.Images() {
+			if img.Name() == name {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+func Test_StableIds(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	writeTestJpeg(t, path.Join(orig, "b.jpg"), 6, 8)
+
+	db := loadTestDatabase(t, orig, root)
+	a := imageNamed(db, "a.jpg")
+	id := a.Id
+	legacy := legacyImageId(fnv.New32a(), "", "a.jpg", a.FileTime())
+	if id != legacy {
+		t.Errorf("new image id %d, want %d", id, legacy)
+	}
+
+	// Edit the file, and make sure the directory is reloaded.
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path.Join(orig, "a.jpg"), future, future)
+	os.Chtimes(orig, future, future)
+	db = loadTestDatabase(t, orig, root)
+	a = imageNamed(db, "a.jpg")
+	if a.Id != id {
+		t.Errorf("id changed after edit: %d, was %d", a.Id, id)
+	}
+	new_legacy := legacyImageId(fnv.New32a(), "", "a.jpg", a.FileTime())
+	if new_legacy == id || db.Indexer().Image(new_legacy) != a {
+		t.Errorf("legacy id %d does not resolve to the image", new_legacy)
+	}
+
+	// Rename the file.
+	os.Rename(path.Join(orig, "a.jpg"), path.Join(orig, "c.jpg"))
+	future = future.Add(time.Hour)
+	os.Chtimes(orig, future, future)
+	db = loadTestDatabase(t, orig, root)
+	if c := imageNamed(db, "c.jpg"); c == nil || c.Id != id {
+		t.Errorf("id changed after rename: %v, was %d", c, id)
+	}
+	if db.Indexer().Image(id) != imageNamed(db, "c.jpg") {
+		t.Errorf("id %d does not resolve to the renamed image", id)
+	}
+}
+
+func Test_MovedIds(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	os.MkdirAll(path.Join(orig, "x"), 0777)
+	os.MkdirAll(path.Join(orig, "y"), 0777)
+	writeTestJpeg(t, path.Join(orig, "x", "a.jpg"), 8, 6)
+	writeTestJpeg(t, path.Join(orig, "x", "b.jpg"), 6, 8)
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+	id := imageNamed(db, "a.jpg").Id
+
+	// Moved to another album, both reloaded.
+	os.Rename(path.Join(orig, "x", "a.jpg"), path.Join(orig, "y", "a.jpg"))
+	if err := db.ReloadDirectories([]string{"x", "y"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if a := imageNamed(db.Snapshot(), "a.jpg"); a == nil || a.Id != id || a.Directory().RelPat() != "y" {
+		t.Errorf("id changed after a move: %v, was %d", a, id)
+	}
+
+	// Renamed album.
+	os.Rename(path.Join(orig, "y"), path.Join(orig, "z"))
+	if err := db.ReloadDirectories([]string{""}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if a := imageNamed(db.Snapshot(), "a.jpg"); a == nil || a.Id != id || a.Directory().RelPat() != "z" {
+		t.Errorf("id changed after renaming the album: %v, was %d", a, id)
+	}
+
+	// The ids are saved.
+	if a := imageNamed(loadTestDatabase(t, orig, root), "a.jpg"); a == nil || a.Id != id {
+		t.Errorf("id changed after a restart: %v, was %d", a, id)
+	}
+}
@@ -19,12 +19,23 @@ type Image struct {
   name string
   keywords []string
   sub_keywords []string
+  hierarchical_keywords []string
+  title string
+  description string
+  rating int32
+  pick int32
+  keyword_overrides *store.KeywordOverrides  // nil if none.
   file_time time.Time
   item_time time.Time
   height int32
   width int32
   rotate_degrees int32
+  orientation int32  // EXIF Orientation, 0 if unknown.
+  location *Location  // nil if unknown.
+  camera *Camera  // nil if unknown.
   stereo *Stereo
+  video bool
+  duration time.Duration  // For videos.
   Id int
   Rank int											// Used for queries.
 }
@@ -33,10 +44,29 @@ func (img *Image) Directory() *Directory { return img.dir }
 func (img *Image) Name() string { return img.name }
 func (img *Image) Keywords() []string { return img.keywords }
 func (img *Image) SubKeywords() []string { return img.sub_keywords }
+func (img *Image) HierarchicalKeywords() []string { return img.hierarchical_keywords }
+func (img *Image) Title() string { return img.title }
+func (img *Image) Description() string { return img.description }
+func (img *Image) Rating() int32 { return img.rating }
+func (img *Image) Pick() int32 { return img.pick }
 func (img *Image) FileTime() time.Time { return img.file_time }
 func (img *Image) ItemTime() time.Time { return img.item_time }
 func (img *Image) RotateDegrees() int32 { return img.rotate_degrees }
+func (img *Image) Orientation() int32 { return img.orientation }
+func (img *Image) Location() *Location { return img.location }
+func (img *Image) Camera() *Camera { return img.camera }
 func (img *Image) Stereo() *Stereo { return img.stereo }
+func (img *Image) IsVideo() bool { return img.video }
+func (img *Image) Duration() time.Duration { return img.duration }
+
+func (img *Image) displayOrientation() orientation {
+  return makeOrientation(img.orientation, img.rotate_degrees)
+}
+
+// Height and width once oriented for display.
+func (img *Image) DisplaySize() (int32, int32) {
+  return img.displayOrientation().size(img.height, img.width)
+}
 
 func (img *Image) FixItemTime(tim time.Time) { img.item_time = tim }
 
@@ -50,6 +80,17 @@ func (img *Image) Intern(indexer *Indexer) {
   }
 }
 
+// Undo Intern, for an image leaving the index.
+func (img *Image) Release(indexer *Indexer) {
+  indexer.Release(img.name)
+  for _, kwd := range img.keywords {
+    indexer.Release(kwd)
+  }
+  for _, kwd := range img.sub_keywords {
+    indexer.Release(kwd)
+  }
+}
+
 func addSubKeywords(img *Image) {
   added := make(map[string]bool, len(img.keywords) + 3)
   for _, kwd := range img.Keywords() {
@@ -70,13 +111,14 @@ func ProtoToImage(dir *Directory, sitem *store.Item) *Image {
   img := new(Image)
   img.name = *sitem.Name
   img.dir = dir
+  img.Id = int(sitem.GetId())
   if sitem.FileTimestamp != nil {
     img.file_time = ProtoToTime(*sitem.FileTimestamp)
   } else {
     img.file_time = time.Unix(0, 0)
   }
   if sitem.ItemTimestamp != nil {
-    img.item_time = ProtoToTime(*sitem.ItemTimestamp)
+    img.item_time = ProtoToTime(*sitem.ItemTimestamp).In(itemLocation(sitem.UtcOffset))
   } else {
     img.item_time = time.Unix(0, 0)
   }
@@ -95,6 +137,12 @@ func ProtoToImage(dir *Directory, sitem *store.Item) *Image {
   if has_subs {
     addSubKeywords(img)
   }
+  img.hierarchical_keywords = sitem.HierarchicalKeywords
+  img.title = sitem.GetTitle()
+  img.description = sitem.GetDescription()
+  img.rating = sitem.GetRating()
+  img.pick = sitem.GetPick()
+  img.keyword_overrides = sitem.KeywordOverrides
   if simg := sitem.Image; simg != nil {
     if simg.Height != nil {
       img.height = *simg.Height
@@ -105,6 +153,14 @@ func ProtoToImage(dir *Directory, sitem *store.Item) *Image {
     if simg.RotateDegrees != nil {
       img.rotate_degrees = *simg.RotateDegrees
     }
+    img.orientation = simg.GetOrientation()
+    if sloc := simg.Location; sloc != nil {
+      img.location = &Location{Lat: sloc.GetLatitude(), Lng: sloc.GetLongitude(),
+                               Alt: sloc.Altitude}
+    }
+    if scam := simg.Camera; scam != nil {
+      img.camera = protoToCamera(scam)
+    }
     if sstereo := simg.Stereo; sstereo != nil {
       stereo := new(Stereo)
       stereo.Dx = *sstereo.Dx
@@ -114,25 +170,69 @@ func ProtoToImage(dir *Directory, sitem *store.Item) *Image {
       img.stereo = stereo
     }
   }
+  if svid := sitem.Video; svid != nil {
+    img.video = true
+    img.height = svid.GetHeight()
+    img.width = svid.GetWidth()
+    img.duration = time.Duration(svid.GetDurationMs()) * time.Millisecond
+  }
   return img
 }
 
 func (img *Image) ToProto() *store.Item {
   sitem := new(store.Item)
   sitem.Name = proto.String(img.name)
+  if img.Id != 0 {
+    sitem.Id = proto.Int64(int64(img.Id))
+  }
   if img.file_time != time.Unix(0, 0) {
     sitem.FileTimestamp = proto.Int64(TimeToProto(img.file_time))
   }
   if img.item_time != time.Unix(0, 0) {
-    sitem.ItemTimestamp = proto.Int64(TimeToProto(img.item_time))
+    sitem.ItemTimestamp = proto.Int64(ItemTimeToProto(img.item_time))
+    _, offset := img.item_time.Zone()
+    sitem.UtcOffset = proto.Int32(int32(offset))
   }
   sitem.Keywords = img.keywords
+  sitem.HierarchicalKeywords = img.hierarchical_keywords
+  if img.title != "" {
+    sitem.Title = proto.String(img.title)
+  }
+  if img.description != "" {
+    sitem.Description = proto.String(img.description)
+  }
+  if img.rating != 0 {
+    sitem.Rating = proto.Int32(img.rating)
+  }
+  if img.pick != 0 {
+    sitem.Pick = proto.Int32(img.pick)
+  }
+  sitem.KeywordOverrides = img.keyword_overrides
+  if img.video {
+    sitem.Video = new(store.Video)
+    sitem.Video.Height = proto.Int32(img.height)
+    sitem.Video.Width = proto.Int32(img.width)
+    sitem.Video.DurationMs = proto.Int64(img.duration.Milliseconds())
+    return sitem
+  }
   sitem.Image = new(store.Image)
   sitem.Image.Height = proto.Int32(img.height)
   sitem.Image.Width = proto.Int32(img.width)
   if img.rotate_degrees != 0 {
     sitem.Image.RotateDegrees = proto.Int32(img.rotate_degrees)
   }
+  if img.orientation != 0 {
+    sitem.Image.Orientation = proto.Int32(img.orientation)
+  }
+  if img.location != nil {
+    sitem.Image.Location = new(store.Location)
+    sitem.Image.Location.Latitude = proto.Float64(img.location.Lat)
+    sitem.Image.Location.Longitude = proto.Float64(img.location.Lng)
+    sitem.Image.Location.Altitude = img.location.Alt
+  }
+  if img.camera != nil {
+    sitem.Image.Camera = img.camera.toProto()
+  }
   if img.stereo != nil {
     sitem.Image.Stereo = new(store.Stereo)
     sitem.Image.Stereo.Dx = proto.Float32(img.stereo.Dx)
@@ -148,11 +248,20 @@ type JsonImage struct {
   Ad string                     // Album directory
   In string                     // Image filename in the album dir
   Its int64                     // Image taken timestamp
+  Tzo int                       // UTC offset of Its in seconds, for the local time
   Fts int64                     // Image file timestamp
-  H int32                       // Height
-  W int32                       // Width
+  H int32                       // Display height
+  W int32                       // Display width
   Kwd []string                  // Keywords
+  Ttl string                    // Title
+  Cap string                    // Caption
+  Rt int32                      // Rating, 1 to 5, 0 if unrated, -1 if rejected
+  Pk int32                      // Pick flag, 1 if picked, -1 if rejected
   Stereo *Stereo                // Stereo info
+  Loc *Location                 // Where the image was taken
+  Cam *Camera                   // Camera and exposure
+  Mt string                     // Media type: "image" or "video"
+  Dur int64                     // Video duration in ms
 }
 
 func (img *Image) Json(jimg *JsonImage) {
@@ -160,11 +269,23 @@ func (img *Image) Json(jimg *JsonImage) {
   jimg.Ad = img.dir.RelPat()
   jimg.In = img.name
   jimg.Its = img.item_time.Unix()
+  _, jimg.Tzo = img.item_time.Zone()
   jimg.Fts = img.file_time.Unix()
-  jimg.H = img.height
-  jimg.W = img.width
+  jimg.H, jimg.W = img.DisplaySize()
   jimg.Kwd = img.keywords
+  jimg.Ttl = img.title
+  jimg.Cap = img.description
+  jimg.Rt = img.rating
+  jimg.Pk = img.pick
   jimg.Stereo = img.stereo
+  jimg.Loc = img.location
+  jimg.Cam = img.camera
+  if img.video {
+    jimg.Mt = "video"
+    jimg.Dur = img.duration.Milliseconds()
+  } else {
+    jimg.Mt = "image"
+  }
 }
 
 func (img *Image) String() string {
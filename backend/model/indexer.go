@@ -7,6 +7,7 @@ import (
   "sort"
   "strconv"
   "strings"
+  "time"
 )
 
 type keywordCounts struct {
@@ -18,15 +19,51 @@ type Indexer struct {
   keyword_counts map[string]*keywordCounts
   images_by_keyword map[string][]*Image
   images_by_subkeyword map[string][]*Image
+  images_by_text map[string][]*Image  // Full-text index, see text.go.
   images_by_id map[int]*Image
+  // Images by their id from before ids were stable, for old links.
+  aliases map[int]*Image
+  taxonomy *Taxonomy
 }
 
 func NewIndexer() *Indexer {
   idx := new(Indexer)
   idx.keyword_counts = make(map[string]*keywordCounts)
+  idx.taxonomy = NewTaxonomy()
   return idx
 }
 
+// A copy of idx that can be modified without changing idx.  The image
+// lists are shared, modifications must replace them.
+func (idx *Indexer) clone() *Indexer {
+  nidx := new(Indexer)
+  nidx.keyword_counts = make(map[string]*keywordCounts, len(idx.keyword_counts))
+  for kwd, kwcnt := range idx.keyword_counts {
+    ncnt := *kwcnt
+    nidx.keyword_counts[kwd] = &ncnt
+  }
+  copyMap := func(m map[string][]*Image) map[string][]*Image {
+    nm := make(map[string][]*Image, len(m))
+    for kwd, imgs := range m {
+      nm[kwd] = imgs
+    }
+    return nm
+  }
+  nidx.images_by_keyword = copyMap(idx.images_by_keyword)
+  nidx.images_by_subkeyword = copyMap(idx.images_by_subkeyword)
+  nidx.images_by_text = copyMap(idx.images_by_text)
+  nidx.images_by_id = make(map[int]*Image, len(idx.images_by_id))
+  for id, img := range idx.images_by_id {
+    nidx.images_by_id[id] = img
+  }
+  nidx.aliases = make(map[int]*Image, len(idx.aliases))
+  for id, img := range idx.aliases {
+    nidx.aliases[id] = img
+  }
+  nidx.taxonomy = idx.taxonomy.clone()
+  return nidx
+}
+
 func (idx *Indexer) Intern(s string) string {
   if kwcnt, ok := idx.keyword_counts[s]; ok {
     kwcnt.count += 1
@@ -41,6 +78,16 @@ func (idx *Indexer) Intern(s string) string {
   return is
 }
 
+// Undo one Intern of s, dropping s once no image uses it.
+func (idx *Indexer) Release(s string) {
+  if kwcnt, ok := idx.keyword_counts[s]; ok {
+    kwcnt.count -= 1
+    if kwcnt.count <= 0 {
+      delete(idx.keyword_counts, s)
+    }
+  }
+}
+
 func (idx *Indexer) Images(kwd string) []*Image {
   return idx.ImagesWithSubkeywords(kwd, true)
 }
@@ -87,8 +134,26 @@ func (idx *Indexer) ImagesWithSubkeywords(kwd string, includeSubkeywords bool) [
   return merged
 }
 
+// The images of kwd and of its descendants in the keyword hierarchy,
+// sorted by rank.
+func (idx *Indexer) ImagesUnder(kwd string) []*Image {
+  keys := idx.taxonomy.subtreeKeys(kwd)
+  if keys == nil {
+    return idx.Images(kwd)
+  }
+  sets := [][]*Image{idx.Images(kwd)}
+  for _, key := range keys {
+    sets = append(sets, idx.Images(key))
+  }
+  return unionByRank(sets)
+}
+
 func (idx *Indexer) Image(image_id int) *Image {
   img, ok := idx.images_by_id[image_id]
+  if ok {
+    return img
+  }
+  img, ok = idx.aliases[image_id]
   if ok {
     return img
   } else {
@@ -126,6 +191,14 @@ func (idx *Indexer) MatchingKeywordsWithSubkeywords(pat string, includeSubkeywor
 		}
 	}
 	
+	// Add the matching keywords of the hierarchy, their images are the ones
+	// of their descendants.
+	for kwd := range idx.taxonomy.nodes {
+		if strings.Contains(kwd, pat) {
+			keywordSet[kwd] = true
+		}
+	}
+
 	// Convert to slice
 	a := make([]string, 0, len(keywordSet))
 	for kwd := range keywordSet {
@@ -154,17 +227,57 @@ func (idx *Indexer) addImageBySubkeyword(img *Image, kwd string) {
   }
 }
 
-func imageHash(h hash.Hash32, dir *Directory, img *Image) int {
+// The image id used before ids were stored in the index.  It changes
+// whenever the file is edited.
+func legacyImageId(h hash.Hash32, rel_pat string, name string, file_time time.Time) int {
 	h.Reset()
-	h.Write([]byte(dir.RelPat()))
-	h.Write([]byte(img.Name()))
-	bytes, err := img.FileTime().MarshalBinary()
+	h.Write([]byte(rel_pat))
+	h.Write([]byte(name))
+	bytes, err := file_time.MarshalBinary()
 	if err == nil {
 		h.Write(bytes)
 	}
 	return int(h.Sum32())
 }
 
+// Give a new id to an image without id or whose id is already used.
+func (idx *Indexer) reassignId(h hash.Hash32, img *Image) {
+  id := legacyImageId(h, img.Directory().RelPat(), img.Name(), img.FileTime())
+  for id == 0 || idx.images_by_id[id] != nil {
+    id += 1
+  }
+  log.Printf("%s/%s: new id %d (was %d)\n", img.Directory().RelPat(), img.Name(),
+    id, img.Id)
+  img.Id = id
+  img.Directory().ids_changed = true
+}
+
+// Calls f with the keys under which img is indexed, in
+// images_by_keyword if sub is false, else in images_by_subkeyword.
+func imageKeys(img *Image, drop_cache map[string]string,
+               f func(kwd string, sub bool)) {
+  f(DropAccents(img.Name(), drop_cache), false)
+  for _, kwd := range img.Keywords() {
+    f(kwd, false)
+    dropped := DropAccents(kwd, drop_cache)
+    if dropped != kwd {
+      f(dropped, false)
+    }
+  }
+  for _, kwd := range img.SubKeywords() {
+    f(kwd, true)
+    dropped := DropAccents(kwd, drop_cache)
+    if dropped != kwd {
+      f(dropped, true)
+    }
+  }
+}
+
+// Ranks of the first images of consecutive directories are rankStride
+// apart, so a reloaded directory can get new ranks without changing the
+// ranks of the other images.
+const rankStride = 1 << 20
+
 func (idx *Indexer) BuildIndex(db *Database) int {
   drop_cache := make(map[string]string, len(idx.keyword_counts))
 
@@ -180,36 +293,234 @@ func (idx *Indexer) BuildIndex(db *Database) int {
 		}
   }
 	hasher := fnv.New32a()
+  idx.images_by_text = make(map[string][]*Image)
+  idx.images_by_id = make(map[int]*Image)
+  idx.taxonomy = keywordList().clone()
   num_images := 0
+  rank := 0
+  add := func(img *Image) func(kwd string, sub bool) {
+    return func(kwd string, sub bool) {
+      if sub {
+        idx.addImageBySubkeyword(img, kwd)
+      } else {
+        idx.addImageByKeyword(img, kwd)
+      }
+    }
+  }
   for _, dir := range db.Directories() {
-    for _, img := range dir.Images() {
-      img.Id = imageHash(hasher, dir, img)
-			img.Rank = num_images
+    for i, img := range dir.Images() {
+      if img.Id == 0 || idx.images_by_id[img.Id] != nil {
+        idx.reassignId(hasher, img)
+      }
+      idx.images_by_id[img.Id] = img
+			img.Rank = rank + i
       num_images += 1
-      idx.addImageByKeyword(img, DropAccents(img.Name(), drop_cache))
-      for _, kwd := range img.Keywords() {
-        idx.addImageByKeyword(img, kwd)
-				dropped := DropAccents(kwd, drop_cache)
-				if dropped != kwd {
-					idx.addImageByKeyword(img, DropAccents(kwd, drop_cache))
-				}
+      imageKeys(img, drop_cache, add(img))
+      imageTextKeys(img, drop_cache, func(key string) {
+        idx.images_by_text[key] = append(idx.images_by_text[key], img)
+      })
+      idx.addHierarchy(img)
+    }
+    rank += (len(dir.Images()) / rankStride + 1) * rankStride
+  }
+  idx.aliases = make(map[int]*Image)
+  for _, dir := range db.Directories() {
+    for _, img := range dir.Images() {
+      idx.addAlias(hasher, img)
+    }
+  }
+  return num_images
+}
+
+// Add the hierarchical keywords of img to the keyword hierarchy.  The
+// keywords of removed images stay in it, without images.
+func (idx *Indexer) addHierarchy(img *Image) {
+  for _, hkwd := range img.HierarchicalKeywords() {
+    idx.taxonomy.AddPath(strings.Split(hkwd, "|"))
+  }
+}
+
+// Make the legacy id of img an alias for it, if that id is not used.
+func (idx *Indexer) addAlias(h hash.Hash32, img *Image) {
+  legacy := legacyImageId(h, img.Directory().RelPat(), img.Name(), img.FileTime())
+  if legacy != img.Id && idx.images_by_id[legacy] == nil {
+    idx.aliases[legacy] = img
+  }
+}
+
+// Give ranks to the images of the added directories, keeping the ranks
+// of the other images.  Returns false if some added directory does not fit
+// between its neighbors.
+func rankDirectories(dirs []*Directory, added map[*Directory]bool) bool {
+  next := 0  // Lowest rank available.
+  for i, dir := range dirs {
+    n := len(dir.Images())
+    if !added[dir] {
+      if n > 0 {
+        if dir.Images()[0].Rank < next {
+          return false
+        }
+        next = dir.Images()[n - 1].Rank + 1
       }
-      for _, kwd := range img.SubKeywords() {
-        idx.addImageBySubkeyword(img, kwd)
-				dropped := DropAccents(kwd, drop_cache)
-				if dropped != kwd {
-					idx.addImageBySubkeyword(img, DropAccents(kwd, drop_cache))
-				}
+      continue
+    }
+    // First rank used after dir, -1 if none.
+    limit := -1
+    for _, ndir := range dirs[i + 1:] {
+      if !added[ndir] && len(ndir.Images()) > 0 {
+        limit = ndir.Images()[0].Rank
+        break
+      }
+    }
+    base := next
+    if limit < 0 {
+      base = (next + rankStride - 1) / rankStride * rankStride
+    } else if limit - next < n {
+      return false
+    } else {
+      // Leave room on both sides for later reloads.
+      base = next + (limit - next - n) / 2
+    }
+    for j, img := range dir.Images() {
+      img.Rank = base + j
+    }
+    next = base + n
+  }
+  return true
+}
+
+// Merge two lists of images sorted by rank into a new list.
+func mergeByRank(a []*Image, b []*Image) []*Image {
+  merged := make([]*Image, 0, len(a) + len(b))
+  for len(a) > 0 && len(b) > 0 {
+    if b[0].Rank < a[0].Rank {
+      merged = append(merged, b[0])
+      b = b[1:]
+    } else {
+      merged = append(merged, a[0])
+      a = a[1:]
+    }
+  }
+  merged = append(merged, a...)
+  return append(merged, b...)
+}
+
+// Patch the index after the removed directories were replaced by the
+// added ones in db.Directories().  The added directories must be
+// interned.  Only the lists of the keywords of the removed and added
+// images are replaced, and the other images keep their ranks.  Returns
+// the number of images in the index, and false without changing the index
+// if the added directories cannot be ranked without changing the other
+// ranks, in which case the index must be rebuilt.
+func (idx *Indexer) PatchIndex(db *Database, removed []*Directory,
+                               added []*Directory) (int, bool) {
+  is_added := make(map[*Directory]bool, len(added))
+  for _, dir := range added {
+    is_added[dir] = true
+  }
+  if !rankDirectories(db.Directories(), is_added) {
+    return 0, false
+  }
+  drop_cache := make(map[string]string)
+	hasher := fnv.New32a()
+  gone := make(map[*Image]bool)
+  keys := make(map[string]bool)  // Keys to patch in images_by_keyword.
+  sub_keys := make(map[string]bool)  // Keys to patch in images_by_subkeyword.
+  text_keys := make(map[string]bool)  // Keys to patch in images_by_text.
+  for _, dir := range removed {
+    for _, img := range dir.Images() {
+      gone[img] = true
+      if idx.images_by_id[img.Id] == img {
+        delete(idx.images_by_id, img.Id)
       }
+      legacy := legacyImageId(hasher, dir.RelPat(), img.Name(), img.FileTime())
+      if idx.aliases[legacy] == img {
+        delete(idx.aliases, legacy)
+      }
+      imageKeys(img, drop_cache, func(kwd string, sub bool) {
+        if sub {
+          sub_keys[kwd] = true
+        } else {
+          keys[kwd] = true
+        }
+      })
+      imageTextKeys(img, drop_cache, func(key string) { text_keys[key] = true })
     }
   }
-  idx.images_by_id = make(map[int]*Image, num_images)
+  new_images := make(map[string][]*Image)
+  new_sub_images := make(map[string][]*Image)
+  new_text_images := make(map[string][]*Image)
   for _, dir := range db.Directories() {
+    if !is_added[dir] {
+      continue
+    }
     for _, img := range dir.Images() {
+      if img.Id == 0 || idx.images_by_id[img.Id] != nil {
+        idx.reassignId(hasher, img)
+      }
       idx.images_by_id[img.Id] = img
+      idx.addHierarchy(img)
+      imageKeys(img, drop_cache, func(kwd string, sub bool) {
+        if sub {
+          sub_keys[kwd] = true
+          new_sub_images[kwd] = append(new_sub_images[kwd], img)
+        } else {
+          keys[kwd] = true
+          new_images[kwd] = append(new_images[kwd], img)
+        }
+      })
+      imageTextKeys(img, drop_cache, func(key string) {
+        text_keys[key] = true
+        new_text_images[key] = append(new_text_images[key], img)
+      })
     }
   }
-  return num_images
+  for _, dir := range added {
+    for _, img := range dir.Images() {
+      idx.addAlias(hasher, img)
+    }
+  }
+  patch := func(imgs []*Image, added []*Image) []*Image {
+    kept := make([]*Image, 0, len(imgs))
+    for _, img := range imgs {
+      if !gone[img] {
+        kept = append(kept, img)
+      }
+    }
+    return mergeByRank(kept, added)
+  }
+  for kwd := range keys {
+    idx.images_by_keyword[kwd] = patch(idx.images_by_keyword[kwd], new_images[kwd])
+  }
+  for kwd := range sub_keys {
+    idx.images_by_subkeyword[kwd] =
+      patch(idx.images_by_subkeyword[kwd], new_sub_images[kwd])
+  }
+  for key := range text_keys {
+    if imgs := patch(idx.images_by_text[key], new_text_images[key]); len(imgs) > 0 {
+      idx.images_by_text[key] = imgs
+    } else {
+      delete(idx.images_by_text, key)
+    }
+  }
+  // Like BuildIndex, keep a key in both maps as long as it has images.
+  for _, m := range []map[string]bool{keys, sub_keys} {
+    for kwd := range m {
+      if len(idx.images_by_keyword[kwd]) == 0 &&
+        len(idx.images_by_subkeyword[kwd]) == 0 {
+        delete(idx.images_by_keyword, kwd)
+        delete(idx.images_by_subkeyword, kwd)
+      } else {
+        if _, ok := idx.images_by_keyword[kwd]; !ok {
+          idx.images_by_keyword[kwd] = []*Image{}
+        }
+        if _, ok := idx.images_by_subkeyword[kwd]; !ok {
+          idx.images_by_subkeyword[kwd] = []*Image{}
+        }
+      }
+    }
+  }
+  return len(idx.images_by_id), true
 }
 
 func (idx *Indexer) String() string {
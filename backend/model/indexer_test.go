@@ -0,0 +1,174 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Check that the lists of idx are sorted by rank and hold the same images
+// as the ones of a freshly built index.
+func checkIndex(t *testing.T, db *Database) {
+	fresh := NewIndexer()
+	for _, dir := range db.Directories() {
+		dir.Intern(fresh)
+	}
+	ranks := make(map[*Image]int)
+	for _, dir := range db.Directories() {
+		for _, img := range dir.Images() {
+			ranks[img] = img.Rank
+		}
+	}
+	fresh.BuildIndex(db)
+	defer func() {
+		for img, rank := range ranks {
+			img.Rank = rank
+		}
+	}()
+	idx := db.Indexer()
+	for _, m := range []struct{ got, want map[string][]*Image }{
+		{idx.images_by_keyword, fresh.images_by_keyword},
+		{idx.images_by_subkeyword, fresh.images_by_subkeyword},
+		{idx.images_by_text, fresh.images_by_text},
+	} {
+		for kwd, want := range m.want {
+			got := m.got[kwd]
+			if len(got) != len(want) {
+				t.Errorf("%s: %d images, want %d", kwd, len(got), len(want))
+				continue
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Errorf("%s: image %d is %s, want %s", kwd, i, got[i].Name(),
+						want[i].Name())
+				}
+				if i > 0 && ranks[got[i-1]] >= ranks[got[i]] {
+					t.Errorf("%s: images not sorted by rank", kwd)
+				}
+			}
+		}
+		for kwd := range m.got {
+			if _, ok := m.want[kwd]; !ok && len(m.got[kwd]) > 0 {
+				t.Errorf("%s: unexpected key", kwd)
+			}
+		}
+	}
+	if len(idx.keyword_counts) != len(fresh.keyword_counts) {
+		t.Errorf("%d keyword counts, want %d", len(idx.keyword_counts), len(fresh.keyword_counts))
+	}
+	for kwd, want := range fresh.keyword_counts {
+		if got := idx.keyword_counts[kwd]; got == nil || got.count != want.count {
+			t.Errorf("%s: bad keyword count %+v, want %d", kwd, got, want.count)
+		}
+	}
+	if len(idx.images_by_id) != len(fresh.images_by_id) {
+		t.Errorf("%d ids, want %d", len(idx.images_by_id), len(fresh.images_by_id))
+	}
+	for id, img := range fresh.images_by_id {
+		if idx.images_by_id[id] != img {
+			t.Errorf("bad image for id %d", id)
+		}
+	}
+}
+
+func Test_PatchIndex(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{
+		"2001/a.jpg", "2001/b.jpg", "2002/c.jpg", "2002/d.jpg", "2003/e.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for i, d := range []string{"2001", "2002", "2003"} {
+		tm := time.Now().Add(time.Duration(i-10) * time.Hour)
+		os.Chtimes(path.Join(orig, d), tm, tm)
+	}
+	db := loadTestDatabase(t, orig, root)
+	e := imageNamed(db, "e.jpg")
+	e_rank := e.Rank
+	c_rank := imageNamed(db, "c.jpg").Rank
+
+	// Change an album in the middle without changing its time.
+	tm, _ := DirModTime(path.Join(orig, "2001"))
+	ioutil.WriteFile(path.Join(orig, "2001/f.jpg"), nil, 0777)
+	os.Chtimes(path.Join(orig, "2001"), tm, tm)
+	if err := db.ReloadDirectories([]string{"2001"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, db)
+	if imageNamed(db, "c.jpg").Rank != c_rank || imageNamed(db, "e.jpg") != e ||
+		e.Rank != e_rank {
+		t.Error("ranks of unchanged images changed")
+	}
+
+	// Changed album moving to the end, and a removed one.
+	ioutil.WriteFile(path.Join(orig, "2002/g.jpg"), nil, 0777)
+	os.RemoveAll(path.Join(orig, "2003"))
+	if err := db.ReloadDirectories([]string{"", "2002"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, db)
+	if imageNamed(db, "e.jpg") != nil || db.Indexer().Image(e.Id) != nil {
+		t.Error("removed image still indexed")
+	}
+	dirs := db.Directories()
+	for i := 1; i < len(dirs); i++ {
+		if dirs[i].Time().Before(dirs[i-1].Time()) {
+			t.Errorf("directories not sorted: %v", dirs)
+		}
+	}
+	if dirs[0].RelPat() != "2001" {
+		t.Errorf("first directory %s, want 2001", dirs[0].RelPat())
+	}
+}
+
+// Reloading a directory leaves the keyword counts of a fresh load.
+func Test_PatchIndexCounts(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	os.MkdirAll(path.Join(orig, "2001"), 0777)
+	for _, name := range []string{"a", "b"} {
+		writeTestJpeg(t, path.Join(orig, "2001", name+".jpg"), 8, 6)
+		ioutil.WriteFile(path.Join(orig, "2001", name+".xmp"),
+			[]byte(testXmp("0", "famille")), 0777)
+	}
+	db := loadTestDatabase(t, orig, root)
+	for i := 0; i < 2; i++ {
+		if err := db.ReloadDirectories([]string{"2001"}, true, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkIndex(t, db)
+	fresh := loadTestDatabase(t, orig, root)
+	for _, kwd := range []string{"famille", "a.jpg"} {
+		got, want := db.Indexer().keyword_counts[kwd], fresh.Indexer().keyword_counts[kwd]
+		if got == nil || want == nil || got.count != want.count {
+			t.Errorf("%s: count %+v, want %+v", kwd, got, want)
+		}
+	}
+}
+
+func Test_RankDirectories(t *testing.T) {
+	mk := func(ranks ...int) *Directory {
+		dir := new(Directory)
+		for _, r := range ranks {
+			dir.images = append(dir.images, &Image{Rank: r})
+		}
+		return dir
+	}
+	a, b, c := mk(0, 1), mk(0, 0, 0), mk(10)
+	if !rankDirectories([]*Directory{a, b, c}, map[*Directory]bool{b: true}) {
+		t.Fatal("no room found")
+	}
+	if b.images[0].Rank <= 1 || b.images[2].Rank >= 10 {
+		t.Errorf("bad ranks %d..%d", b.images[0].Rank, b.images[2].Rank)
+	}
+	d := mk(0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	if rankDirectories([]*Directory{a, d, c}, map[*Directory]bool{d: true}) {
+		t.Error("ranked a directory without room")
+	}
+	if !rankDirectories([]*Directory{a, c, d}, map[*Directory]bool{d: true}) ||
+		d.images[0].Rank != rankStride {
+		t.Errorf("bad rank at the end: %d", d.images[0].Rank)
+	}
+}
@@ -0,0 +1,334 @@
+package model
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+import "toutizes.com/go-photwo/backend/store"
+
+// Kinds of background jobs.
+const (
+	JobReload            = "reload"
+	JobReloadDirectories = "reload-directories"
+	JobMinify            = "minify"
+)
+
+// Phases of a job.
+const (
+	PhaseScan   = "scan"   // Loading the directories.
+	PhaseIndex  = "index"  // Building the index.
+	PhaseMinify = "minify" // Creating the mini and midi images.
+	PhaseDone   = "done"
+)
+
+// Number of finished jobs kept for the status command.
+const keptJobs = 20
+
+// A background reload or minify job.  Its methods can be called on a nil
+// job, for a Load or a minification not run as a job.
+type Job struct {
+	mu          sync.Mutex
+	id          int
+	kind        string
+	phase       string
+	started     time.Time
+	phase_start time.Time
+	finished    time.Time
+	directories int // Directories loaded.
+	est_dirs    int // Estimated number of directories to load, 0 if unknown.
+	images      int // Images loaded.
+	minified    int // Images minified.
+	to_minify   int // Images to minify.
+	errors      []string
+	done        chan struct{} // Closed when the job is finished.
+}
+
+// The state of a job, as returned by the status command.
+type JobStatus struct {
+	Id          int
+	Kind        string
+	Phase       string
+	Started     time.Time
+	Finished    time.Time `json:",omitempty"`
+	Directories int
+	Images      int
+	Minified    int
+	ToMinify    int
+	Errors      []string
+	// Estimated seconds left in the current phase, -1 if unknown.
+	EtaSeconds float64
+}
+
+func (job *Job) setPhase(phase string) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.phase = phase
+	job.phase_start = time.Now()
+}
+
+func (job *Job) addDirectory(images int) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.directories += 1
+	job.images += images
+}
+
+func (job *Job) setToMinify(n int) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.to_minify = n
+}
+
+func (job *Job) addMinified() {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.minified += 1
+}
+
+func (job *Job) addError(err string) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.errors = append(job.errors, err)
+}
+
+// Seconds left in a phase where done out of total were processed since
+// start, -1 if unknown.
+func eta(start time.Time, done int, total int) float64 {
+	if done == 0 || total <= done {
+		return -1
+	}
+	return time.Since(start).Seconds() / float64(done) * float64(total-done)
+}
+
+func (job *Job) Status() JobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	st := JobStatus{Id: job.id, Kind: job.kind, Phase: job.phase,
+		Started: job.started, Finished: job.finished,
+		Directories: job.directories, Images: job.images,
+		Minified: job.minified, ToMinify: job.to_minify,
+		Errors: append([]string(nil), job.errors...), EtaSeconds: -1}
+	switch job.phase {
+	case PhaseScan:
+		st.EtaSeconds = eta(job.phase_start, job.directories, job.est_dirs)
+	case PhaseMinify:
+		st.EtaSeconds = eta(job.phase_start, job.minified, job.to_minify)
+	}
+	return st
+}
+
+func (job *Job) isDone() bool {
+	select {
+	case <-job.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait until the job is finished.
+func (job *Job) Wait() {
+	<-job.done
+}
+
+// The background jobs of a database.
+type Jobs struct {
+	mu      sync.Mutex
+	next_id int
+	jobs    []*Job // Running and recently finished jobs, oldest first.
+}
+
+func (jobs *Jobs) find(id int) *Job {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	for _, job := range jobs.jobs {
+		if job.id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (jobs *Jobs) statuses() []JobStatus {
+	jobs.mu.Lock()
+	all := append([]*Job(nil), jobs.jobs...)
+	jobs.mu.Unlock()
+	sts := make([]JobStatus, len(all))
+	for i, job := range all {
+		sts[i] = job.Status()
+	}
+	return sts
+}
+
+// Start a job running run, unless a running job of one of the join kinds
+// exists, in which case that job is returned.
+func (jobs *Jobs) start(kind string, join []string, est_dirs int,
+	run func(job *Job) error) *Job {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	for _, job := range jobs.jobs {
+		if job.isDone() {
+			continue
+		}
+		for _, k := range join {
+			if job.kind == k {
+				log.Printf("Joining %s job %d\n", job.kind, job.id)
+				return job
+			}
+		}
+	}
+	// Forget the oldest finished jobs.
+	finished := 0
+	for _, job := range jobs.jobs {
+		if job.isDone() {
+			finished += 1
+		}
+	}
+	kept := jobs.jobs[:0]
+	for _, job := range jobs.jobs {
+		if job.isDone() && finished >= keptJobs {
+			finished -= 1
+		} else {
+			kept = append(kept, job)
+		}
+	}
+	jobs.jobs = kept
+	jobs.next_id += 1
+	now := time.Now()
+	job := &Job{id: jobs.next_id, kind: kind, phase: PhaseScan,
+		started: now, phase_start: now, est_dirs: est_dirs,
+		done: make(chan struct{})}
+	jobs.jobs = append(jobs.jobs, job)
+	go func() {
+		log.Printf("Starting %s job %d\n", kind, job.id)
+		err := run(job)
+		if err != nil {
+			job.addError(err.Error())
+		}
+		job.mu.Lock()
+		job.phase = PhaseDone
+		job.finished = time.Now()
+		job.mu.Unlock()
+		close(job.done)
+		log.Printf("Finished %s job %d in %g s\n", kind, job.id,
+			time.Since(now).Seconds())
+	}()
+	return job
+}
+
+// Reload the whole database in the background, or join the reload job
+// already running.  The database is swapped before creating the missing
+// mini and midi images.  The edits made during the load go on, they are
+// applied again to the loaded database before the swap.
+func (db *Database) StartReload() *Job {
+	est_dirs := len(db.Snapshot().Directories())
+	return db.jobs.start(JobReload, []string{JobReload}, est_dirs,
+		func(job *Job) error {
+			ndb := DatabaseToReload(db)
+			ndb.progress = job
+			db.startReloadEdits()
+			err := db.swapReloaded(ndb, ndb.Load(true, false, false))
+			if err != nil {
+				return err
+			}
+			snap := db.Snapshot()
+			snap.progress = job
+			job.setPhase(PhaseMinify)
+			go db.resetMontageDirectory()
+			MinifyDatabase(snap, false, false)
+			return nil
+		})
+}
+
+// Keep the directories edited from now on, for swapReloaded.
+func (db *Database) startReloadEdits() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reload_edits = make(map[string]*store.Directory)
+}
+
+// Swap ndb, loaded with error load_err, into db.  The directories edited
+// during the load are saved again, the load may have written back the
+// indexes it read before the edits, and reloaded in ndb before the swap.
+func (db *Database) swapReloaded(ndb *Database, load_err error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	edits := db.reload_edits
+	db.reload_edits = nil
+	if load_err != nil {
+		return load_err
+	}
+	rel_pats := make([]string, 0, len(edits))
+	for rel_pat, sdir := range edits {
+		err := writeIndex(db.IndexPath(rel_pat), db.IndexTextPath(rel_pat), sdir)
+		if err != nil {
+			return err
+		}
+		rel_pats = append(rel_pats, rel_pat)
+	}
+	if len(rel_pats) > 0 {
+		sort.Strings(rel_pats)
+		if _, _, err := ndb.reloadDirectories(rel_pats, true); err != nil {
+			return err
+		}
+	}
+	db.swap(ndb)
+	return nil
+}
+
+// Reload the directories rel_pats in the background, and create their
+// missing mini and midi images.  The paths must be checked with
+// cleanRelPat.
+func (db *Database) StartReloadDirectories(rel_pats []string) *Job {
+	return db.jobs.start(JobReloadDirectories, nil, len(rel_pats),
+		func(job *Job) error {
+			return db.reloadDirectoriesJob(job, rel_pats, true, true)
+		})
+}
+
+// Create the missing mini and midi images in the background, or join the
+// reload or minify job already running.
+func (db *Database) StartMinify(force bool) *Job {
+	return db.jobs.start(JobMinify, []string{JobReload, JobMinify}, 0,
+		func(job *Job) error {
+			snap := db.Snapshot()
+			snap.progress = job
+			job.setPhase(PhaseMinify)
+			MinifyDirectories(snap, snap.Directories(), force)
+			return nil
+		})
+}
+
+// The status of the job with the given id, false if unknown.
+func (db *Database) JobStatus(id int) (JobStatus, bool) {
+	job := db.jobs.find(id)
+	if job == nil {
+		return JobStatus{}, false
+	}
+	return job.Status(), true
+}
+
+// The status of the running and recently finished jobs, most recent first.
+func (db *Database) JobStatuses() []JobStatus {
+	sts := db.jobs.statuses()
+	sort.Slice(sts, func(i, j int) bool { return sts[i].Id > sts[j].Id })
+	return sts
+}
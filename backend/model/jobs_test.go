@@ -0,0 +1,134 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// The edits made while a full reload loads do not wait for it, and are
+// kept even if the load writes back the indexes it read before them.
+func Test_EditsDuringReload(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	db.startReloadEdits()
+	ndb := DatabaseToReload(db)
+	err := ndb.Load(true, false, false)
+	title := "Noël"
+	if err := db.EditAlbum(Change{User: "alice"}, "2001", &albumEdit{title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	// The load writing back the index it read.
+	writeIndex(db.IndexPath("2001"), db.IndexTextPath("2001"), albumNamed(ndb, "2001").ToProto())
+	if err := db.swapReloaded(ndb, err); err != nil {
+		t.Fatal(err)
+	}
+	if dir := albumNamed(db.Snapshot(), "2001"); dir == nil || dir.Title() != title {
+		t.Error("edit lost by the reload")
+	}
+	reloaded := NewDatabase2(orig, root, root)
+	if err := reloaded.Load(false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if dir := albumNamed(reloaded, "2001"); dir == nil || dir.Title() != title {
+		t.Error("edit not saved")
+	}
+	if db.reload_edits != nil {
+		t.Error("edits still kept after the reload")
+	}
+}
+
+func Test_ReloadJob(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	ioutil.WriteFile(path.Join(orig, "2001/c.jpg"), nil, 0777)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path.Join(orig, "2001"), future, future)
+
+	job := db.StartReload()
+	if db.StartReload() != job || db.StartMinify(false) != job {
+		t.Error("second request did not join the running reload")
+	}
+	// An edit during the reload is not lost by the swap.
+	title := "Noël"
+	if err := db.EditAlbum(Change{User: "alice"}, "2001", &albumEdit{title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	job.Wait()
+	if dir := albumNamed(db, "2001"); dir == nil || dir.Title() != title {
+		t.Error("edit lost by the reload")
+	}
+	st, ok := db.JobStatus(job.id)
+	if !ok || st.Phase != PhaseDone || st.Finished.IsZero() || st.Kind != JobReload {
+		t.Fatalf("bad status %+v", st)
+	}
+	if st.Directories != 2 || st.Images != 3 || st.ToMinify != 3 || st.Minified != 3 {
+		t.Errorf("bad counts %+v", st)
+	}
+	// The empty files cannot be minified.
+	if len(st.Errors) != 3 {
+		t.Errorf("errors %v", st.Errors)
+	}
+	if imageNamed(db.Snapshot(), "c.jpg") == nil {
+		t.Error("database not swapped")
+	}
+
+	job2 := db.StartMinify(true)
+	if job2 == job {
+		t.Error("joined a finished job")
+	}
+	job2.Wait()
+	sts := db.JobStatuses()
+	if len(sts) != 2 || sts[0].Id != job2.id || sts[0].Kind != JobMinify ||
+		sts[0].Minified != 3 {
+		t.Errorf("bad statuses %+v", sts)
+	}
+	if _, ok := db.JobStatus(42); ok {
+		t.Error("status of unknown job")
+	}
+}
+
+func Test_ReloadDirectoriesJob(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	ioutil.WriteFile(path.Join(orig, "2001/c.jpg"), nil, 0777)
+
+	rec := httptest.NewRecorder()
+	HandleReload(rec, httptest.NewRequest("GET", "/", nil), db, url.Values{"dir": {"2001/"}})
+	var st JobStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil || st.Kind != JobReloadDirectories {
+		t.Fatalf("bad status %s: %v", rec.Body.String(), err)
+	}
+	db.jobs.find(st.Id).Wait()
+	if st, _ = db.JobStatus(st.Id); st.Directories != 1 || st.Images != 2 || st.ToMinify != 2 {
+		t.Errorf("bad counts %+v", st)
+	}
+	if imageNamed(db.Snapshot(), "c.jpg") == nil {
+		t.Error("directory not reloaded")
+	}
+
+	for _, dir := range []string{"../x", "2001/../../x", "/etc"} {
+		rec := httptest.NewRecorder()
+		HandleReload(rec, httptest.NewRequest("GET", "/", nil), db, url.Values{"dir": {dir}})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q accepted", dir)
+		}
+	}
+	for dir, want := range map[string]string{"": "", ".": "", "2001/./x/": "2001/x"} {
+		if got, err := cleanRelPat(dir); err != nil || got != want {
+			t.Errorf("%q: got %q %v, want %q", dir, got, err, want)
+		}
+	}
+}
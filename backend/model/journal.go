@@ -0,0 +1,407 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// The metadata edits made through the API are recorded in an append-only
+// journal, one JSON entry per line and per changed field of an image, or
+// per edit of the metadata of an album.  An entry can be undone as long
+// as the field still has the value it set.  Undos are recorded like the
+// other edits.
+
+// Who makes an edit, and how.
+type Change struct {
+	User      string
+	Undo      int64 // The journal entry undone by the edit, 0 if none.
+	Originals bool  // The keywords are written to the originals.
+}
+
+type JournalEntry struct {
+	Id        int64 // Unique and increasing.
+	Time      time.Time
+	User      string
+	ImageId   int
+	Field     string // One of journalFields.
+	Old       json.RawMessage
+	New       json.RawMessage
+	Undo      int64 `json:",omitempty"`
+	Originals bool  `json:",omitempty"`
+	// The album of the "album" entries, which have no image.
+	Album string `json:",omitempty"`
+}
+
+// The value of the keywords field.
+type KeywordsValue struct {
+	Keywords []string
+	Added    []string `json:",omitempty"`
+	Removed  []string `json:",omitempty"`
+	Replaced bool     `json:",omitempty"`
+}
+
+var journalFields = []string{"keywords", "rotate", "stereo"}
+
+// The value of a journaled field of item.
+func itemValue(field string, item *store.Item) interface{} {
+	switch field {
+	case "keywords":
+		ov := item.KeywordOverrides
+		return &KeywordsValue{append([]string{}, item.Keywords...), ov.GetAdded(),
+			ov.GetRemoved(), ov.GetReplaced()}
+	case "rotate":
+		return item.GetImage().GetRotateDegrees()
+	case "stereo":
+		if s := item.GetImage().GetStereo(); s != nil {
+			return &Stereo{s.GetDx(), s.GetDy(), s.GetAnaDx(), s.GetAnaDy()}
+		}
+	}
+	return nil
+}
+
+func itemJson(field string, item *store.Item) json.RawMessage {
+	data, _ := json.Marshal(itemValue(field, item))
+	return data
+}
+
+// Set a journaled field of item from its JSON value.
+func setItemValue(field string, item *store.Item, data json.RawMessage) error {
+	switch field {
+	case "keywords":
+		var val KeywordsValue
+		if err := json.Unmarshal(data, &val); err != nil {
+			return err
+		}
+		item.Keywords = val.Keywords
+		item.KeywordOverrides = nil
+		if len(val.Added) > 0 || len(val.Removed) > 0 || val.Replaced {
+			item.KeywordOverrides = &store.KeywordOverrides{Added: val.Added,
+				Removed: val.Removed, Replaced: proto.Bool(val.Replaced)}
+		}
+	case "rotate":
+		var val int32
+		if err := json.Unmarshal(data, &val); err != nil {
+			return err
+		}
+		item.Image.RotateDegrees = proto.Int32(val)
+	case "stereo":
+		var val *Stereo
+		if err := json.Unmarshal(data, &val); err != nil {
+			return err
+		}
+		item.Image.Stereo = nil
+		if val != nil {
+			item.Image.Stereo = &store.Stereo{Dx: proto.Float32(val.Dx),
+				Dy: proto.Float32(val.Dy), AnaDx: proto.Float32(val.AnaDx),
+				AnaDy: proto.Float32(val.AnaDy)}
+		}
+	default:
+		return errors.New("Unknown field: " + field)
+	}
+	return nil
+}
+
+// The journal entries of the fields changed between before and after.
+func diffItems(c Change, before map[string]*store.Item, after *store.Directory) []JournalEntry {
+	var entries []JournalEntry
+	now := time.Now()
+	for _, item := range after.Items {
+		old := before[item.GetName()]
+		if old == nil {
+			continue
+		}
+		for _, field := range journalFields {
+			old_val, new_val := itemJson(field, old), itemJson(field, item)
+			if !bytes.Equal(old_val, new_val) {
+				entries = append(entries, JournalEntry{Time: now, User: c.User,
+					ImageId: int(item.GetId()), Field: field, Old: old_val, New: new_val,
+					Undo: c.Undo, Originals: c.Originals && field == "keywords"})
+			}
+		}
+	}
+	return entries
+}
+
+// Like mutateDirectory, recording the edits of the items in the journal.
+// The edits are published once journaled, an edit that cannot be
+// journaled is dropped.
+func (db *Database) mutateItems(c Change, rel_pat string,
+	edit func(sdir *store.Directory) error) error {
+	var before map[string]*store.Item
+	return db.recordedMutation(rel_pat, func(sdir *store.Directory) error {
+		before = make(map[string]*store.Item, len(sdir.Items))
+		for _, item := range sdir.Items {
+			before[item.GetName()] = proto.Clone(item).(*store.Item)
+		}
+		return edit(sdir)
+	}, func(sdir *store.Directory) error {
+		return db.appendJournal(diffItems(c, before, sdir))
+	})
+}
+
+func (db *Database) JournalPath() string {
+	return path.Join(db.indx_root, "journal.jsonl")
+}
+
+// The ids of the journal of a database.
+type journalIds struct {
+	mu      sync.Mutex // Serializes the writes of the journal.
+	last_id int64
+	seeded  bool // The ids of the journal file were read into last_id.
+}
+
+func (db *Database) appendJournal(entries []JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ids := &db.journal
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	if !ids.seeded {
+		// The clock can go back across restarts, the ids must not.
+		_, err := db.ReadJournal(func(e *JournalEntry) bool {
+			if e.Id > ids.last_id {
+				ids.last_id = e.Id
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		ids.seeded = true
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range entries {
+		id := entries[i].Time.UnixNano()
+		if id <= ids.last_id {
+			id = ids.last_id + 1
+		}
+		ids.last_id = id
+		entries[i].Id = id
+		enc.Encode(&entries[i])
+	}
+	f, err := os.OpenFile(db.JournalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// The journal entries passing filter, oldest first.
+func (db *Database) ReadJournal(filter func(e *JournalEntry) bool) ([]JournalEntry, error) {
+	f, err := os.Open(db.JournalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("%s: %s\n", db.JournalPath(), err.Error())
+			continue
+		}
+		if filter(&e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Undo the journal entries passing filter, the latest first.  The undos
+// and the entries already undone are ignored, and the entries whose field
+// changed since are skipped.  Returns the number of entries undone and
+// skipped.
+func (db *Database) Undo(user string, filter func(e *JournalEntry) bool) (int, int, error) {
+	undone := make(map[int64]bool)
+	entries, err := db.ReadJournal(func(e *JournalEntry) bool {
+		if e.Undo != 0 {
+			undone[e.Undo] = true
+			return false
+		}
+		return filter(e)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	num_undone, num_skipped := 0, 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := &entries[i]
+		if undone[e.Id] {
+			continue
+		}
+		ok, err := db.undoEntry(Change{User: user, Undo: e.Id}, e)
+		if err != nil {
+			return num_undone, num_skipped, err
+		}
+		if ok {
+			num_undone++
+		} else {
+			num_skipped++
+		}
+	}
+	return num_undone, num_skipped, nil
+}
+
+// Set the field of e back to its old value.  Returns false if the field
+// or its image changed since.
+func (db *Database) undoEntry(c Change, e *JournalEntry) (bool, error) {
+	if e.Field == "album" {
+		return db.undoAlbumEntry(c, e)
+	}
+	img := db.Snapshot().Indexer().Image(e.ImageId)
+	if img == nil || !bytes.Equal(itemJson(e.Field, img.ToProto()), e.New) {
+		return false, nil
+	}
+	if e.Originals {
+		var old_val, new_val KeywordsValue
+		json.Unmarshal(e.Old, &old_val)
+		json.Unmarshal(e.New, &new_val)
+		_, err := db.WriteKeywords(c, []int{img.Id},
+			dropKeywords(old_val.Keywords, new_val.Keywords),
+			dropKeywords(new_val.Keywords, old_val.Keywords))
+		return err == nil, err
+	}
+	err := db.mutateItems(c, img.Directory().RelPat(), func(sdir *store.Directory) error {
+		item := findItem(sdir, img.Name())
+		if item == nil {
+			return errors.New("Unknown image: " + img.Name())
+		}
+		if item.Image == nil && e.Field != "keywords" {
+			return errors.New("Not an image: " + img.Name())
+		}
+		return setItemValue(e.Field, item, e.Old)
+	})
+	if err == nil && e.Field == "rotate" {
+		// Rebuild the minis and midis with the old rotation.
+		err = doScaleImg(db, db.Snapshot().Indexer().Image(img.Id))
+	}
+	return err == nil, err
+}
+
+// A time given as a date or in RFC 3339, zero if s is empty.
+func parseJournalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, defaultLocation()); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// The journal entries of the image "id", of the album "album" or of the
+// user "user", between "since" and "until" if given, the latest first.
+func journalFilter(r *http.Request) (func(e *JournalEntry) bool, error) {
+	since, err := parseJournalTime(r.FormValue("since"))
+	if err != nil {
+		return nil, errors.New("Bad since: " + r.FormValue("since"))
+	}
+	until, err := parseJournalTime(r.FormValue("until"))
+	if err != nil {
+		return nil, errors.New("Bad until: " + r.FormValue("until"))
+	}
+	id, has_id, err := parseInt(r, "id", nil)
+	if err != nil {
+		return nil, err
+	}
+	user := r.FormValue("user")
+	_, has_album := r.Form["album"]
+	album := r.FormValue("album")
+	if !has_id && !has_album && user == "" {
+		return nil, errors.New("Pass an image id, an album or a user")
+	}
+	return func(e *JournalEntry) bool {
+		return (!has_id || e.ImageId == id) && (!has_album || e.Field == "album" && e.Album == album) &&
+			(user == "" || e.User == user) &&
+			!e.Time.Before(since) && (until.IsZero() || e.Time.Before(until))
+	}, nil
+}
+
+func HandleHistory(w http.ResponseWriter, r *http.Request, db *Database) {
+	userEmail := r.Context().Value("userEmail").(string)
+	r.ParseForm()
+	log.Printf("History from %s: %v", userEmail, r.Form)
+	filter, err := journalFilter(r)
+	var entries []JournalEntry
+	if err == nil {
+		entries, err = db.ReadJournal(filter)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id > entries[j].Id })
+	if entries == nil {
+		entries = []JournalEntry{}
+	}
+	json.NewEncoder(w).Encode(&entries)
+}
+
+// POST with the journal entries to undo in "entry", repeatable, or with
+// a user and the time range of the edits to undo, see journalFilter.
+// Undo is global: any user can undo the changes of any other user, to
+// revert the mistakes of someone else.
+func HandleUndo(w http.ResponseWriter, r *http.Request, db *Database) {
+	var res EditResults
+	userEmail := r.Context().Value("userEmail").(string)
+	err := r.ParseForm()
+	if err == nil && r.Method != "POST" {
+		err = errors.New("Use POST to undo")
+	}
+	var filter func(e *JournalEntry) bool
+	if err == nil && len(r.Form["entry"]) > 0 {
+		ids := make(map[int64]bool)
+		for _, s := range r.Form["entry"] {
+			id, e := strconv.ParseInt(s, 10, 64)
+			if e != nil {
+				err = errors.New("Bad entry: " + s)
+			}
+			ids[id] = true
+		}
+		filter = func(e *JournalEntry) bool { return ids[e.Id] }
+	} else if err == nil {
+		if r.FormValue("user") == "" || r.FormValue("since") == "" {
+			err = errors.New("Pass entries, or a user and a time range")
+		} else {
+			filter, err = journalFilter(r)
+		}
+	}
+	skipped := 0
+	if err == nil {
+		log.Printf("Undo from %s: %v", userEmail, r.Form)
+		res.Changed, skipped, err = db.Undo(userEmail, filter)
+	}
+	if err == nil {
+		res.Message = "ok"
+		if skipped > 0 {
+			res.Message = fmt.Sprintf("ok, %d changed since and skipped", skipped)
+		}
+	} else {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
@@ -0,0 +1,198 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Call a handler as user with a POSTed form, and decode its JSON answer
+// into res.
+func postAs(t *testing.T, user string, db *Database,
+	h func(http.ResponseWriter, *http.Request, *Database), form url.Values, res interface{}) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), "userEmail", user))
+	rec := httptest.NewRecorder()
+	h(rec, req, db)
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Fatalf("%v: %s: %s", form, err.Error(), rec.Body.String())
+	}
+}
+
+func Test_Journal(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		writeTestJpeg(t, path.Join(orig, name), 8, 6)
+	}
+	embedIptc(t, path.Join(orig, "b.jpg"), map[byte]string{25: "lyon"})
+	db := loadTestDatabase(t, orig, root)
+	MinifyDatabase(db, false, false)
+	db.publish()
+	a_id := strconv.Itoa(imageNamed(db, "a.jpg").Id)
+	b_id := strconv.Itoa(imageNamed(db, "b.jpg").Id)
+	start := time.Now()
+
+	var res EditResults
+	edit := func(user string, h func(http.ResponseWriter, *http.Request, *Database),
+		form url.Values, want string) {
+		res = EditResults{}
+		postAs(t, user, db, h, form, &res)
+		if res.Message != want {
+			t.Errorf("%v: got %q, want %q", form, res.Message, want)
+		}
+	}
+	set := func(user string, form url.Values) {
+		var res StringResults
+		postAs(t, user, db, HandleSet, form, &res)
+		if res.Message != "ok" {
+			t.Errorf("%v: %s", form, res.Message)
+		}
+	}
+	history := func(form url.Values) []JournalEntry {
+		var entries []JournalEntry
+		req := httptest.NewRequest("GET", "/history?"+form.Encode(), nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", "bob"))
+		rec := httptest.NewRecorder()
+		HandleHistory(rec, req, db)
+		json.Unmarshal(rec.Body.Bytes(), &entries)
+		return entries
+	}
+	keywords := func(name string) []string {
+		return imageNamed(db.Snapshot(), name).Keywords()
+	}
+
+	edit("alice", HandleKeywords, url.Values{"id": {a_id}, "add": {"plage"}}, "ok")
+	set("bob", url.Values{"id": {a_id}, "rotate": {"90"}})
+	edit("alice", HandleWriteKeywords, url.Values{"id": {b_id}, "add": {"mer"},
+		"remove": {"lyon"}}, "ok")
+
+	entries := history(url.Values{"id": {a_id}})
+	if len(entries) != 2 || entries[0].Field != "rotate" || entries[0].User != "bob" ||
+		string(entries[0].Old) != "0" || string(entries[0].New) != "90" ||
+		entries[1].Field != "keywords" || entries[1].User != "alice" {
+		t.Fatalf("bad history %+v", entries)
+	}
+	var val KeywordsValue
+	json.Unmarshal(entries[1].New, &val)
+	if !reflect.DeepEqual(val.Keywords, []string{"plage"}) ||
+		!reflect.DeepEqual(val.Added, []string{"plage"}) {
+		t.Errorf("bad new value %s", entries[1].New)
+	}
+	if entries := history(url.Values{"user": {"alice"}}); len(entries) != 2 ||
+		entries[0].ImageId != imageNamed(db, "b.jpg").Id || !entries[0].Originals {
+		t.Errorf("bad user history %+v", entries)
+	}
+	if entries := history(url.Values{"user": {"alice"}, "until": {"2001-01-01"}}); len(entries) != 0 {
+		t.Errorf("bad range %+v", entries)
+	}
+
+	// A specific change, once.
+	rotate_entry := strconv.FormatInt(history(url.Values{"user": {"bob"}})[0].Id, 10)
+	edit("carol", HandleUndo, url.Values{"entry": {rotate_entry}}, "ok")
+	if res.Changed != 1 || imageNamed(db.Snapshot(), "a.jpg").RotateDegrees() != 0 {
+		t.Errorf("rotation not undone: %+v", res)
+	}
+	edit("carol", HandleUndo, url.Values{"entry": {rotate_entry}}, "ok")
+	if res.Changed != 0 {
+		t.Errorf("undone twice: %+v", res)
+	}
+	if entries := history(url.Values{"user": {"carol"}}); len(entries) != 1 ||
+		strconv.FormatInt(entries[0].Undo, 10) != rotate_entry {
+		t.Errorf("undo not journaled %+v", entries)
+	}
+
+	// Everything alice did, except what changed since.
+	edit("bob", HandleKeywords, url.Values{"id": {a_id}, "add": {"ski"}}, "ok")
+	edit("bob", HandleUndo, url.Values{"user": {"alice"},
+		"since": {start.Format(time.RFC3339)}}, "ok, 1 changed since and skipped")
+	if res.Changed != 1 || !reflect.DeepEqual(keywords("b.jpg"), []string{"lyon"}) ||
+		!reflect.DeepEqual(keywords("a.jpg"), []string{"plage", "ski"}) {
+		t.Errorf("bad undo %+v %v %v", res, keywords("a.jpg"), keywords("b.jpg"))
+	}
+	if _, _, kwds, _, _, _ := GetImageInfo2(path.Join(orig, "b.jpg")); !reflect.DeepEqual(kwds, []string{"lyon"}) {
+		t.Errorf("original not restored: %v", kwds)
+	}
+
+	edit("bob", HandleUndo, url.Values{"user": {"alice"}}, "Pass entries, or a user and a time range")
+}
+
+// The ids keep increasing after a restart with the clock back, and an
+// edit that cannot be journaled is not published.
+func Test_JournalFailures(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+	a_id := strconv.Itoa(imageNamed(db, "a.jpg").Id)
+	keywords := func(form url.Values) string {
+		var res EditResults
+		postAs(t, "alice", db, HandleKeywords, form, &res)
+		return res.Message
+	}
+
+	future := time.Now().Add(time.Hour).UnixNano()
+	data, _ := json.Marshal(&JournalEntry{Id: future, User: "bob", Field: "keywords"})
+	os.WriteFile(db.JournalPath(), append(data, '\n'), 0644)
+	if msg := keywords(url.Values{"id": {a_id}, "add": {"plage"}}); msg != "ok" {
+		t.Fatal(msg)
+	}
+	entries, _ := db.ReadJournal(func(e *JournalEntry) bool { return e.User == "alice" })
+	if len(entries) != 1 || entries[0].Id <= future {
+		t.Errorf("bad journal %+v", entries)
+	}
+
+	os.Remove(db.JournalPath())
+	os.Mkdir(db.JournalPath(), 0777)
+	if msg := keywords(url.Values{"id": {a_id}, "add": {"mer"}}); msg == "ok" {
+		t.Error("edit not journaled accepted")
+	}
+	if kwds := imageNamed(db.Snapshot(), "a.jpg").Keywords(); !reflect.DeepEqual(kwds, []string{"plage"}) {
+		t.Errorf("edit not journaled published %v", kwds)
+	}
+	if itm := indexItem(t, db, "a.jpg"); !reflect.DeepEqual(itm.Keywords, []string{"plage"}) {
+		t.Errorf("edit not journaled saved %v", itm.Keywords)
+	}
+}
+
+// Each database numbers the entries of its own journal.
+func Test_JournalIdsPerDatabase(t *testing.T) {
+	future := time.Now().Add(time.Hour).UnixNano()
+	var dbs []*Database
+	for i := 0; i < 2; i++ {
+		orig, root := makeOrigTree(t, nil)
+		defer os.RemoveAll(orig)
+		defer os.RemoveAll(root)
+		writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+		db := loadTestDatabase(t, orig, root)
+		db.publish()
+		if i == 0 {
+			data, _ := json.Marshal(&JournalEntry{Id: future, User: "bob", Field: "keywords"})
+			os.WriteFile(db.JournalPath(), append(data, '\n'), 0644)
+		}
+		var res EditResults
+		postAs(t, "alice", db, HandleKeywords,
+			url.Values{"id": {strconv.Itoa(imageNamed(db, "a.jpg").Id)}, "add": {"plage"}}, &res)
+		if res.Message != "ok" {
+			t.Fatal(res.Message)
+		}
+		dbs = append(dbs, db)
+	}
+	entries, _ := dbs[1].ReadJournal(func(e *JournalEntry) bool { return true })
+	if len(entries) != 1 || entries[0].Id >= future {
+		t.Errorf("ids leaked from another database %+v", entries)
+	}
+}
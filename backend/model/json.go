@@ -9,6 +9,9 @@ import (
   "log"
 )
 
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
 type ImageResults struct {
   Images []JsonImage
 }
@@ -93,6 +96,7 @@ func returnDirectories(w http.ResponseWriter, imgs []*Image) {
 }
 
 func HandleQuery(w http.ResponseWriter, r *http.Request, db *Database) {
+  db = requestSnapshot(r, db)
   q := r.FormValue("q")
   kind := r.FormValue("kind")
   
@@ -105,6 +109,11 @@ func HandleQuery(w http.ResponseWriter, r *http.Request, db *Database) {
   case kind == "album":
     returnDirectories(w, imgs)
   default:
+    // The best rated images first, unless the index order is requested or
+    // the query lists albums.
+    if r.FormValue("order") != "index" && !keepsQueryOrder(q) {
+      sortByRating(imgs)
+    }
     returnImages(w, imgs)
   }
 }
@@ -117,7 +126,7 @@ func parseInt(r *http.Request, s string, err error) (int, bool, error) {
   if !ok {
     return 0, false, nil
   }
-  i, e := strconv.ParseInt(vals[0], 10, 32)
+  i, e := strconv.ParseInt(vals[0], 10, 64)
   return int(i), true, e
 }
 
@@ -135,10 +144,12 @@ func parseFloat(r *http.Request, s string, err error) (float32, bool, error) {
 
 func HandleSet(w http.ResponseWriter, r *http.Request, db *Database) {
   var res StringResults
+  userEmail := r.Context().Value("userEmail").(string)
   err := r.ParseForm()
   id, has_id, err := parseInt(r, "id", err)
   dx, has_dx, err := parseFloat(r, "dx", err)
   dy, has_dy, err := parseFloat(r, "dy", err)
+  rotate, has_rotate, err := parseInt(r, "rotate", err)
   var image *Image
   if err == nil {
     if !has_id {
@@ -146,28 +157,49 @@ func HandleSet(w http.ResponseWriter, r *http.Request, db *Database) {
     }
   }
   if err == nil {
-    image = db.Indexer().Image(id)
+    image = db.Snapshot().Indexer().Image(id)
     if image == nil {
       err = errors.New(fmt.Sprintf("Unknown image id: %d", id))
     }
   }
-  if err == nil {
-    if has_dx && has_dy {
-      // add and update the stereo info.
-      if image.stereo == nil {
-        image.stereo = new(Stereo)
-      }
-      image.stereo.Dx = dx
-      image.stereo.Dy = dy
-    } else if !has_dx && !has_dy {
-      // delete the stereo info.
-      image.stereo = nil
-    } else {
-      err = errors.New("Pass both dx and dy or none of them")
-    }
+  if err == nil && has_dx != has_dy {
+    err = errors.New("Pass both dx and dy or none of them")
+  }
+  if err == nil && has_rotate && rotate % 90 != 0 {
+    err = errors.New(fmt.Sprintf("Rotation not a multiple of 90: %d", rotate))
   }
   if err == nil {
-    err = db.SaveDirectory(image.Directory())
+    // Published images are never modified, edit a copy of the directory.
+    err = db.mutateItems(Change{User: userEmail}, image.Directory().RelPat(),
+      func(sdir *store.Directory) error {
+        item := findItem(sdir, image.Name())
+        if item == nil || item.Image == nil {
+          return errors.New("Unknown image: " + image.Name())
+        }
+        if has_dx {
+          // add and update the stereo info.
+          stereo := item.Image.Stereo
+          if stereo == nil {
+            stereo = &store.Stereo{AnaDx: proto.Float32(0), AnaDy: proto.Float32(0)}
+            item.Image.Stereo = stereo
+          }
+          stereo.Dx = proto.Float32(dx)
+          stereo.Dy = proto.Float32(dy)
+        } else if !has_rotate {
+          // delete the stereo info.
+          item.Image.Stereo = nil
+        }
+        if has_rotate {
+          // The manual rotation, applied after the EXIF orientation.
+          item.Image.RotateDegrees = proto.Int32(int32((rotate % 360 + 360) % 360))
+        }
+        return nil
+      })
+  }
+  if err == nil && has_rotate {
+    // Rebuild the minis and midis with the new rotation.
+    image = db.Snapshot().Indexer().Image(image.Id)
+    err = doScaleImg(db, image)
   }
   if err == nil {
     res.Message = "ok"
@@ -179,6 +211,7 @@ func HandleSet(w http.ResponseWriter, r *http.Request, db *Database) {
 }
 
 func HandleRecentKeywords(w http.ResponseWriter, r *http.Request, db *Database) {
+  db = db.Snapshot()
   // Get user email from context
   userEmail := r.Context().Value("userEmail").(string)
   log.Printf("Recent keywords request from %s", userEmail)
@@ -209,7 +242,25 @@ func HandleRecentKeywords(w http.ResponseWriter, r *http.Request, db *Database)
   enc.Encode(&result)
 }
 
+type KeywordTreeResults struct {
+  Keywords []*JsonKeywordNode
+}
+
+// The keyword hierarchy with image counts, or the subtrees of the keyword
+// passed as "k".
+func HandleKeywordTree(w http.ResponseWriter, r *http.Request, db *Database) {
+  db = db.Snapshot()
+  kwd := r.FormValue("k")
+  userEmail := r.Context().Value("userEmail").(string)
+  log.Printf("Keyword tree request from %s: %q", userEmail, kwd)
+
+  enc := json.NewEncoder(w)
+  result := KeywordTreeResults{Keywords: db.Indexer().KeywordTree(kwd)}
+  enc.Encode(&result)
+}
+
 func HandleRecentKeywordGroups(w http.ResponseWriter, r *http.Request, db *Database) {
+  db = db.Snapshot()
   // Get user email from context
   userEmail := r.Context().Value("userEmail").(string)
   log.Printf("Recent keyword groups request from %s", userEmail)
@@ -273,6 +324,7 @@ type AllUserQueriesResult struct {
 
 // HandleUserQueries handles requests for user query history from logs
 func HandleUserQueries(w http.ResponseWriter, r *http.Request, db *Database, logDir string) {
+  db = db.Snapshot()
   if logDir == "" {
     http.Error(w, "Log directory not configured", http.StatusInternalServerError)
     return
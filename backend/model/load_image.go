@@ -5,9 +5,12 @@ import (
 	"bytes"
 	"golang.org/x/text/encoding/charmap"
 	"image"
+	_ "image/gif"
 	_ "image/jpeg"
+	_ "image/png"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -18,6 +21,10 @@ import (
 	"github.com/rwcarlsen/goexif/exif"
 	// For parsing JPEG segments
 	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+	// Decoders for the other formats accepted by the loader
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 	// For parsing IPTC data
 	iptc "github.com/dsoprea/go-iptc"
 )
@@ -156,7 +163,9 @@ var macAccentsCleaner = strings.NewReplacer(
 	// "\xFF", "ˇ"
 )
 
-func tagTime(ex *exif.Exif, ts exif.FieldName) (t time.Time, err error) {
+// Parse the EXIF time ts with its sub-seconds and its offset.  Without
+// offset the time is in the default zone and utc_offset is nil.
+func tagTime(ex *exif.Exif, ts, subsec, offset exif.FieldName) (t time.Time, utc_offset *int32, err error) {
 	t = time.Unix(0, 0)
 	tg, err := ex.Get(ts)
 	if err != nil {
@@ -166,10 +175,50 @@ func tagTime(ex *exif.Exif, ts exif.FieldName) (t time.Time, err error) {
 	if err != nil {
 		return
 	}
-	t, err = time.Parse("2006:01:02 15:04:05", str_val)
+	loc := defaultLocation()
+	if tg, oerr := ex.Get(offset); oerr == nil {
+		if str_off, oerr := tg.StringVal(); oerr == nil {
+			if o, ok := parseExifOffset(str_off); ok {
+				utc_offset = proto.Int32(o)
+				loc = itemLocation(utc_offset)
+			}
+		}
+	}
+	t, err = time.ParseInLocation("2006:01:02 15:04:05", strings.Trim(str_val, "\x00"), loc)
+	if err != nil {
+		return
+	}
+	if tg, serr := ex.Get(subsec); serr == nil {
+		if str_sub, serr := tg.StringVal(); serr == nil {
+			str_sub = strings.TrimSpace(strings.Trim(str_sub, "\x00"))
+			if frac, serr := strconv.ParseFloat("0."+str_sub, 64); serr == nil {
+				t = t.Add(time.Duration(frac * float64(time.Second)).Round(time.Millisecond))
+			}
+		}
+	}
 	return
 }
 
+// The capture time of an EXIF, from the first time field it has.
+func exifTime(ex *exif.Exif) (t time.Time, utc_offset *int32, field exif.FieldName, err error) {
+	for _, f := range exifTimeFields {
+		t, utc_offset, err = tagTime(ex, f.time, f.subsec, f.offset)
+		if err == nil {
+			return t, utc_offset, f.time, nil
+		}
+	}
+	return
+}
+
+func readExif(file string) (*exif.Exif, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return exif.Decode(bufio.NewReader(f))
+}
+
 func LoadImageFile(file string, image *store.Item) error {
 	fi, err := os.Open(file)
 	if err != nil {
@@ -179,51 +228,93 @@ func LoadImageFile(file string, image *store.Item) error {
 	defer fi.Close()
 	found_time := false
 	var image_time time.Time
+	var utc_offset *int32
+	var orientation int32
+	var location *store.Location
+	var camera *store.Camera
+	var rating *int32
 	ex, err := exif.Decode(bufio.NewReader(fi))
 	if err == nil {
-		dto, err := tagTime(ex, exif.DateTimeOriginal)
+		orientation = exifOrientationTag(ex)
+		location = exifLocation(ex)
+		camera = exifCamera(ex)
+		rating = exifRatingTag(ex)
+		t, offset, field, err := exifTime(ex)
 		if err == nil {
-			image_time = dto
-			found_time = true
-		}
-		if !found_time {
-			dtd, err := tagTime(ex, exif.DateTimeDigitized)
-			if err == nil {
-				log.Printf("Using DateTimeDigitized for: %s (%s)\n", file, dtd)
-				image_time = dtd
-				found_time = true
-			}
-		}
-		if !found_time {
-			dt, err := tagTime(ex, exif.DateTime)
-			if err == nil {
-				log.Printf("Using DateTime for: %s (%s)\n", file, dt)
-				image_time = dt
-				found_time = true
+			if field != exif.DateTimeOriginal {
+				log.Printf("Using %s for: %s (%s)\n", field, file, t)
 			}
+			image_time = t
+			utc_offset = offset
+			found_time = true
 		}
 	}
 	if !found_time {
 		log.Printf("Using file time for: %s\n", file)
 		image_time = ProtoToTime(*image.FileTimestamp)
 	}
-	its := TimeToProto(image_time)
-	image.ItemTimestamp = &its
-	height, width, kwds, err := GetImageInfo2(file)
+	image.ItemTimestamp = proto.Int64(ItemTimeToProto(image_time))
+	if utc_offset == nil {
+		utc_offset = defaultOffset(image_time)
+	}
+	image.UtcOffset = utc_offset
+	info, err := readImageInfo(file)
 	if err == nil {
-		if kwds != nil && len(kwds) > 0 {
-			image.Keywords = kwds
-		}
 		image.Image = new(store.Image)
-		image.Image.Height = proto.Int32(int32(height))
-		image.Image.Width = proto.Int32(int32(width))
+		image.Image.Height = proto.Int32(int32(info.height))
+		image.Image.Width = proto.Int32(int32(info.width))
+		if orientation != 0 {
+			image.Image.Orientation = proto.Int32(orientation)
+		}
+		image.Image.Location = location
+		image.Image.Camera = camera
 	} else {
 		log.Printf("Info got error %s: %s", file, err.Error())
 	}
+	info.rating = rating
+	info.metadata(file).setItem(image)
 	return nil
 }
 
-func GetImageInfo2(filepath string) (height int, width int, keywords []string, err error) {
+// What is read from an image file.
+type imageInfo struct {
+	height   int
+	width    int
+	keywords    []string // From IPTC.
+	title       string   // IPTC Object Name.
+	description string   // IPTC Caption-Abstract.
+	rating   *int32   // From the EXIF rating tag.
+	xmp      []byte   // Embedded XMP packet, nil if none.
+}
+
+// The metadata of an image, see xmp.go for the precedence of the sources.
+func (info *imageInfo) metadata(file string) *imageMetadata {
+	meta := &imageMetadata{keywords: info.keywords, title: info.title,
+		description: info.description, rating: info.rating}
+	if info.xmp != nil {
+		embedded, err := parseXmp(info.xmp)
+		if err != nil {
+			log.Printf("%s: embedded xmp: %s\n", file, err.Error())
+		}
+		meta.override(embedded)
+	}
+	sidecar, err := readSidecar(file)
+	if err != nil {
+		log.Printf("%s: sidecar xmp: %s\n", file, err.Error())
+	}
+	meta.override(sidecar)
+	return meta
+}
+
+func GetImageInfo2(filepath string) (height int, width int, keywords []string,
+	title string, caption string, err error) {
+	info, err := readImageInfo(filepath)
+	meta := info.metadata(filepath)
+	return info.height, info.width, meta.keywords, meta.title, meta.description, err
+}
+
+func readImageInfo(filepath string) (info *imageInfo, err error) {
+	info = new(imageInfo)
 	data, err := os.ReadFile(filepath)
 	if err != nil {
 		return
@@ -232,15 +323,19 @@ func GetImageInfo2(filepath string) (height int, width int, keywords []string, e
 	reader := bytes.NewReader(data)
 
 	// Decode image configuration using the reader based on the byte slice
-	config, _, err := image.DecodeConfig(reader)
+	config, format, err := image.DecodeConfig(reader)
 	if err != nil {
 		log.Printf("Error decoding image config: %s\n", err.Error())
 		return
 	}
 
-	// Named return values
-	height = config.Height
-	width = config.Width
+	info.height = config.Height
+	info.width = config.Width
+
+	// Only JPEG files have IPTC keywords and embedded XMP.
+	if format != "jpeg" {
+		return
+	}
 
 	parser := jpegstructure.NewJpegMediaParser()
 	intfc, err := parser.ParseBytes(data)
@@ -250,8 +345,19 @@ func GetImageInfo2(filepath string) (height int, width int, keywords []string, e
 	}
 
 	sl := intfc.(*jpegstructure.SegmentList)
+	for _, segment := range sl.Segments() {
+		if segment.IsXmp() {
+			info.xmp = segment.Data[len(xmpSegmentHeader):]
+			break
+		}
+	}
+
 	_, segment, err := sl.FindIptc()
-	if err != nil {
+	if err == jpegstructure.ErrNoIptc {
+		// A JPEG without keywords.
+		err = nil
+		return
+	} else if err != nil {
 		log.Printf("Finding iptc: %s\n", err.Error())
 		return
 	}
@@ -264,34 +370,35 @@ func GetImageInfo2(filepath string) (height int, width int, keywords []string, e
 
 	kwdBytes := tags[iptc.StreamTagKey{RecordNumber: 2, DatasetNumber: 25}]
 
-	keywords = make([]string, 0, len(kwdBytes))
+	info.keywords = make([]string, 0, len(kwdBytes))
 	for _, bytes := range kwdBytes {
-		var decodedString string
-		if utf8.Valid(bytes) {
-      // fmt.Printf("valid utf8: %v\n", bytes)
-      // for _, b := range bytes {
-      //   fmt.Printf(" %x %d %c\n", b, b, b)
-      // }
-			decodedString = string(bytes)
-      // fmt.Printf("decoded utf8: %s\n", decodedString)
-		} else {
-			// Assume Latin-1
-			decoder := charmap.ISO8859_1.NewDecoder()
-			decodedBytes, err := decoder.Bytes(bytes)
-      // fmt.Printf("decoded latin1: %v",decodedBytes)
-			if err != nil {
-				// Should be rare for ISO-8859-1, but handle just in case
-				log.Printf("%s: Failed to decode supposed ISO-8859-1 keyword bytes: %v", filepath, err)
-				// Pray! (As we did before)
-				decodedString = string(bytes)
-			} else {
-				decodedString = string(decodedBytes) // Now contains valid Go UTF-8 string
-			}
-		}
-		for _, kwd := range strings.Split(decodedString, ";") {
-			keywords = append(keywords, kwd)
+		for _, kwd := range strings.Split(decodeIptcString(filepath, bytes), ";") {
+			info.keywords = append(info.keywords, kwd)
 		}
 	}
+	// Object Name and Caption-Abstract.
+	if vals := tags[iptc.StreamTagKey{RecordNumber: 2, DatasetNumber: 5}]; len(vals) > 0 {
+		info.title = strings.TrimSpace(decodeIptcString(filepath, vals[0]))
+	}
+	if vals := tags[iptc.StreamTagKey{RecordNumber: 2, DatasetNumber: 120}]; len(vals) > 0 {
+		info.description = strings.TrimSpace(decodeIptcString(filepath, vals[0]))
+	}
 
 	return
 }
+
+// Decode an IPTC string, in UTF-8 or in Latin-1.
+func decodeIptcString(filepath string, bytes []byte) string {
+	if utf8.Valid(bytes) {
+		return string(bytes)
+	}
+	decoder := charmap.ISO8859_1.NewDecoder()
+	decodedBytes, err := decoder.Bytes(bytes)
+	if err != nil {
+		// Should be rare for ISO-8859-1, but handle just in case
+		log.Printf("%s: Failed to decode supposed ISO-8859-1 bytes: %v", filepath, err)
+		// Pray! (As we did before)
+		return string(bytes)
+	}
+	return string(decodedBytes) // Now contains valid Go UTF-8 string
+}
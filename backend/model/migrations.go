@@ -0,0 +1,318 @@
+package model
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "github.com/rwcarlsen/goexif/exif"
+import "toutizes.com/go-photwo/backend/store"
+
+// A migration brings a directory index from version-1 to version.
+type indexMigration struct {
+	version int32
+	doc     string
+	migrate func(origs *originals, rel_pat string, sdir *store.Directory) error
+}
+
+// The originals of a directory being migrated.  The migrations that need
+// the metadata of the images share one read of each original, so that
+// an old index is migrated in a single pass over the files.
+type originals struct {
+	origd   string
+	derived []string // Directories of the minis and midis, nil if read only.
+	reads   map[string]*originalRead
+}
+
+// What the migrations read from an original.
+type originalRead struct {
+	ex   *exif.Exif // nil if the file has no EXIF.
+	info *imageInfo
+	meta *imageMetadata
+}
+
+func newOriginals(origd string) *originals {
+	return &originals{origd: origd, reads: make(map[string]*originalRead)}
+}
+
+// The originals of the directory rel_pat of db, with its minis and midis
+// if update_disk is true.
+func (db *Database) originals(rel_pat string, update_disk bool) *originals {
+	origs := newOriginals(db.FullOrigPath(rel_pat))
+	if update_disk {
+		origs.derived = []string{path.Join(db.mini_root, rel_pat), path.Join(db.midi_root, rel_pat)}
+	}
+	return origs
+}
+
+func (origs *originals) path(itm *store.Item) string {
+	return path.Join(origs.origd, itm.GetName())
+}
+
+// The metadata of the original of itm, read on the first call only.
+func (origs *originals) read(itm *store.Item) *originalRead {
+	if rd := origs.reads[itm.GetName()]; rd != nil {
+		return rd
+	}
+	file := origs.path(itm)
+	rd := new(originalRead)
+	rd.ex, _ = readExif(file)
+	rd.info, _ = readImageInfo(file)
+	if rd.ex != nil {
+		rd.info.rating = exifRatingTag(rd.ex)
+	}
+	rd.meta = rd.info.metadata(file)
+	origs.reads[itm.GetName()] = rd
+	return rd
+}
+
+// All the index migrations, in version order.  To change the index format
+// append a migration here, Load then runs it on older indexes and saves
+// them back when updating the disk.  Indexes without version are at
+// version 0.
+var indexMigrations = []indexMigration{
+	{1, "drop newlines and empty keywords", migrateCleanKeywords},
+	{2, "assign stable image ids", migrateAssignIds},
+	{3, "read the video headers", migrateVideoHeaders},
+	{4, "load the PNG, GIF, TIFF, BMP and WebP images", migrateImageFormats},
+	{5, "read the XMP metadata", migrateXmp},
+	{6, "read the EXIF orientation", migrateOrientation},
+	{7, "read the GPS coordinates", migrateLocation},
+	{8, "read the camera and exposure", migrateCamera},
+	{9, "read the UTC offsets of the capture times", migrateUtcOffsets},
+	{10, "read the EXIF ratings and the pick flags", migrateRatings},
+	{11, "read the IPTC titles and captions", migrateIptcCaptions},
+	{12, "read the album.txt metadata", migrateAlbumFile},
+	{13, "read the dimensions of the images stored without", migrateDimensions},
+	{14, "rebuild the sideways minis and midis of the rotated images", migrateRotatedDerivatives},
+}
+
+// Version of the indexes written by this code.
+func currentIndexVersion() int32 {
+	return indexMigrations[len(indexMigrations)-1].version
+}
+
+// Run the migrations needed to bring sdir to the current version.  Returns
+// true if sdir was migrated.
+func migrateIndex(origs *originals, rel_pat string, sdir *store.Directory) (bool, error) {
+	if sdir.GetVersion() >= currentIndexVersion() {
+		return false, nil
+	}
+	for _, m := range indexMigrations {
+		if m.version <= sdir.GetVersion() {
+			continue
+		}
+		if len(sdir.Items) > 0 {
+			log.Printf("%s: migrating index to version %d: %s\n", rel_pat, m.version,
+				m.doc)
+		}
+		err := m.migrate(origs, rel_pat, sdir)
+		if err != nil {
+			return false, err
+		}
+		sdir.Version = proto.Int32(m.version)
+	}
+	return true, nil
+}
+
+// Old indexes could contain keywords with newlines, or empty ones.
+func migrateCleanKeywords(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		kwds := make([]string, 0, len(itm.Keywords))
+		for _, kwd := range itm.Keywords {
+			kwd = strings.Replace(kwd, "\n", "", -1)
+			if len(kwd) > 0 {
+				kwds = append(kwds, kwd)
+			}
+		}
+		itm.Keywords = kwds
+	}
+	return nil
+}
+
+func migrateAssignIds(origs *originals, rel_pat string, sdir *store.Directory) error {
+	assignIds(rel_pat, sdir)
+	return nil
+}
+
+// Videos used to be stored without duration, dimensions or time.
+func migrateVideoHeaders(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Video != nil && itm.Video.DurationMs == nil {
+			err := LoadVideoFile(origs.path(itm), itm)
+			if err != nil {
+				log.Printf("%s: %s\n", origs.path(itm), err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Older loaders skipped some of the image formats, and failed to read the
+// dimensions of the images without IPTC keywords.
+func migrateImageFormats(origs *originals, rel_pat string, sdir *store.Directory) error {
+	migrateDimensions(origs, rel_pat, sdir)
+	// Rescan the directory for the newly accepted files.
+	sdir.DirectoryTimestamp = nil
+	return nil
+}
+
+// The images stored with zero dimensions cannot be scaled.  Reloading
+// them used to keep the old dimensions, read them again.
+func migrateDimensions(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Video != nil || !isImageName(itm.GetName()) ||
+			(itm.Image.GetHeight() > 0 && itm.Image.GetWidth() > 0) {
+			continue
+		}
+		info := origs.read(itm).info
+		if info.height == 0 || info.width == 0 {
+			continue
+		}
+		if itm.Image == nil {
+			itm.Image = new(store.Image)
+		}
+		itm.Image.Height = proto.Int32(int32(info.height))
+		itm.Image.Width = proto.Int32(int32(info.width))
+	}
+	return nil
+}
+
+// Reload the images whose keywords may be in XMP: the ones without
+// keywords, and the ones with a sidecar.
+func migrateXmp(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Video != nil {
+			continue
+		}
+		if len(itm.Keywords) > 0 && !hasSidecar(origs.path(itm)) {
+			continue
+		}
+		origs.read(itm).meta.setItem(itm)
+	}
+	return nil
+}
+
+// The minis and midis of the images found rotated are dropped by
+// migrateRotatedDerivatives.
+func migrateOrientation(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Image == nil || itm.Image.Orientation != nil {
+			continue
+		}
+		if ex := origs.read(itm).ex; ex != nil {
+			if o := exifOrientationTag(ex); o != 0 {
+				itm.Image.Orientation = proto.Int32(o)
+			}
+		}
+	}
+	return nil
+}
+
+// The minis and midis of the rotated images were built before their
+// orientation was read, or by a minifier that ignored it.  Their file
+// times are newer than the originals so they were kept, date them back
+// for the minifier to replace them.  They are served until then.
+func migrateRotatedDerivatives(origs *originals, rel_pat string, sdir *store.Directory) error {
+	stale := time.Unix(0, 0)
+	for _, itm := range sdir.Items {
+		if o := itm.GetImage().GetOrientation(); o == 0 || o == 1 {
+			continue
+		}
+		for _, d := range origs.derived {
+			err := os.Chtimes(path.Join(d, itm.GetName()), stale, stale)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("%s\n", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func migrateLocation(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Image == nil || itm.Image.Location != nil {
+			continue
+		}
+		if ex := origs.read(itm).ex; ex != nil {
+			itm.Image.Location = exifLocation(ex)
+		}
+	}
+	return nil
+}
+
+func migrateCamera(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Image == nil || itm.Image.Camera != nil {
+			continue
+		}
+		if ex := origs.read(itm).ex; ex != nil {
+			itm.Image.Camera = exifCamera(ex)
+		}
+	}
+	return nil
+}
+
+// The EXIF times used to be stored as UTC times.  Reread them with their
+// offsets, the other times are instants and get the offset of the default
+// zone.
+func migrateUtcOffsets(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.UtcOffset != nil || itm.ItemTimestamp == nil {
+			continue
+		}
+		if itm.Video == nil {
+			if ex := origs.read(itm).ex; ex != nil {
+				if t, offset, _, err := exifTime(ex); err == nil {
+					itm.ItemTimestamp = proto.Int64(ItemTimeToProto(t))
+					itm.UtcOffset = offset
+				}
+			}
+		}
+		if itm.UtcOffset == nil {
+			itm.UtcOffset = defaultOffset(ProtoToTime(itm.GetItemTimestamp()))
+		}
+	}
+	return nil
+}
+
+func migrateRatings(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Video != nil || itm.Rating != nil || itm.Pick != nil {
+			continue
+		}
+		meta := origs.read(itm).meta
+		if meta.rating != nil {
+			itm.Rating = proto.Int32(*meta.rating)
+		}
+		if meta.pick != nil {
+			itm.Pick = proto.Int32(*meta.pick)
+		}
+	}
+	return nil
+}
+
+func migrateIptcCaptions(origs *originals, rel_pat string, sdir *store.Directory) error {
+	for _, itm := range sdir.Items {
+		if itm.Image == nil || (itm.Title != nil && itm.Description != nil) {
+			continue
+		}
+		meta := origs.read(itm).meta
+		if itm.Title == nil && meta.title != "" {
+			itm.Title = proto.String(meta.title)
+		}
+		if itm.Description == nil && meta.description != "" {
+			itm.Description = proto.String(meta.description)
+		}
+	}
+	return nil
+}
+
+func migrateAlbumFile(origs *originals, rel_pat string, sdir *store.Directory) error {
+	updateAlbumFile(origs.origd, sdir)
+	return nil
+}
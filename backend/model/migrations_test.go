@@ -0,0 +1,170 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+func Test_MigrateIndex(t *testing.T) {
+	sdir := &store.Directory{
+		Items: []*store.Item{{
+			Name:          proto.String("a.jpg"),
+			FileTimestamp: proto.Int64(1000),
+			Keywords:      []string{"foo\nbar", "", "\n", "baz"},
+		}},
+	}
+	migrated, err := migrateIndex(newOriginals(""), "2001", sdir)
+	if err != nil || !migrated {
+		t.Fatalf("migrated %v: %v", migrated, err)
+	}
+	if sdir.GetVersion() != currentIndexVersion() {
+		t.Errorf("version %d, want %d", sdir.GetVersion(), currentIndexVersion())
+	}
+	kwds := sdir.Items[0].Keywords
+	if len(kwds) != 2 || kwds[0] != "foobar" || kwds[1] != "baz" {
+		t.Errorf("bad keywords: %q", kwds)
+	}
+	if sdir.Items[0].GetId() == 0 {
+		t.Error("no id assigned")
+	}
+	migrated, _ = migrateIndex(newOriginals(""), "2001", sdir)
+	if migrated {
+		t.Error("migrated a current index")
+	}
+}
+
+// An old index of an unchanged directory is migrated and saved back.
+func Test_MigrateOnLoad(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+
+	db := loadTestDatabase(t, orig, root)
+	var sdir store.Directory
+	if err := readIndex(db.IndexPath(""), &sdir); err != nil {
+		t.Fatal(err)
+	}
+	sdir.Version = nil
+	sdir.Items[0].Id = nil
+	sdir.Items[0].Keywords = []string{"foo\n"}
+	data, _ := proto.Marshal(&sdir)
+	ioutil.WriteFile(db.IndexPath(""), data, 0777)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(db.IndexPath(""), future, future)
+
+	db = loadTestDatabase(t, orig, root)
+	sdir.Reset()
+	if err := readIndex(db.IndexPath(""), &sdir); err != nil {
+		t.Fatal(err)
+	}
+	if sdir.GetVersion() != currentIndexVersion() || sdir.Items[0].GetId() == 0 {
+		t.Errorf("index not migrated: %v", sdir.String())
+	}
+	img := imageNamed(db, "a.jpg")
+	if img == nil || len(img.Keywords()) != 1 || img.Keywords()[0] != "foo" {
+		t.Errorf("bad migrated image: %v", img)
+	}
+}
+
+// The metadata migrations of an old index share one read of each original.
+func Test_MigrateMetadata(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	ioutil.WriteFile(path.Join(orig, "a.xmp"), []byte(testXmp("4", "plage")), 0777)
+	itm := &store.Item{Name: proto.String("a.jpg"), FileTimestamp: proto.Int64(1000),
+		ItemTimestamp: proto.Int64(1000), Image: &store.Image{Height: proto.Int32(6), Width: proto.Int32(8)}}
+	sdir := &store.Directory{Version: proto.Int32(4), Items: []*store.Item{itm}}
+	if _, err := migrateIndex(newOriginals(orig), "", sdir); err != nil {
+		t.Fatal(err)
+	}
+	if len(itm.Keywords) != 1 || itm.Keywords[0] != "plage" || itm.GetRating() != 4 ||
+		itm.UtcOffset == nil {
+		t.Errorf("bad migrated item: %v", itm)
+	}
+
+	origs := newOriginals(orig)
+	if rd := origs.read(itm); rd.meta.rating == nil || origs.read(itm) != rd {
+		t.Errorf("original read twice or badly: %+v", rd)
+	}
+}
+
+// The images stored with zero dimensions are read again.
+func Test_MigrateDimensions(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	itm := &store.Item{Name: proto.String("a.jpg"), FileTimestamp: proto.Int64(1000),
+		Image: &store.Image{Height: proto.Int32(0), Width: proto.Int32(0)}}
+	sdir := &store.Directory{Version: proto.Int32(12), Items: []*store.Item{itm}}
+	if _, err := migrateIndex(newOriginals(orig), "", sdir); err != nil {
+		t.Fatal(err)
+	}
+	if itm.Image.GetHeight() != 6 || itm.Image.GetWidth() != 8 {
+		t.Errorf("bad dimensions %dx%d", itm.Image.GetWidth(), itm.Image.GetHeight())
+	}
+}
+
+// The minis and midis of the rotated images are built again.
+func Test_MigrateRotatedDerivatives(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	origs := newOriginals(orig)
+	origs.derived = []string{root}
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		ioutil.WriteFile(path.Join(root, name), nil, 0644)
+	}
+	sdir := &store.Directory{Version: proto.Int32(13), Items: []*store.Item{
+		{Name: proto.String("a.jpg"), Image: &store.Image{Orientation: proto.Int32(6)}},
+		{Name: proto.String("b.jpg"), Image: &store.Image{Orientation: proto.Int32(1)}},
+	}}
+	if _, err := migrateIndex(origs, "", sdir); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path.Join(root, "a.jpg")); err != nil || fi.ModTime().After(time.Unix(0, 0)) {
+		t.Error("sideways mini not dated back")
+	}
+	if fi, err := os.Stat(path.Join(root, "b.jpg")); err != nil || !fi.ModTime().After(time.Unix(0, 0)) {
+		t.Error("upright mini dated back")
+	}
+}
+
+// A load that does not update the disk leaves the minis alone.
+func Test_MigrateRotatedDerivativesReadOnly(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	db := loadTestDatabase(t, orig, root)
+	sdir := new(store.Directory)
+	if err := readIndex(db.IndexPath(""), sdir); err != nil {
+		t.Fatal(err)
+	}
+	sdir.Version = proto.Int32(13)
+	sdir.Items[0].Image.Orientation = proto.Int32(6)
+	if err := writeIndex(db.IndexPath(""), db.IndexTextPath(""), sdir); err != nil {
+		t.Fatal(err)
+	}
+	mini := path.Join(root, "mini", "a.jpg")
+	os.MkdirAll(path.Dir(mini), 0777)
+	ioutil.WriteFile(mini, nil, 0644)
+	mtime := time.Now().Add(-time.Hour).Round(time.Second)
+	os.Chtimes(mini, mtime, mtime)
+
+	db = NewDatabase2(orig, root, root)
+	if err := db.Load(false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(mini); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("mini changed by a read only load: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"flag"
+	"fmt"
 	"github.com/nfnt/resize"
 	"image"
 	"image/draw"
@@ -95,56 +96,74 @@ func scaleImage(src image.Image, maxDim uint, centerCrop bool) image.Image {
 	return resize.Resize(newW, newH, croppedImg, resize.Lanczos3)
 }
 
-func doScaleImg(db *Database, img *Image) int {
-	orig := origPath(db, img)
+// Decode an original in any of the formats registered with the image
+// package.
+func decodeImage(orig string) (image.Image, error) {
 	f, err := os.Open(orig)
 	if err != nil {
-		log.Printf("%v: cannot open", orig)
-		return 0
+		return nil, err
+	}
+	defer f.Close()
+	data, format, err := image.Decode(f)
+	if err == image.ErrFormat {
+		return nil, fmt.Errorf("%s: unsupported image format", orig)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: cannot decode %s: %v", orig, format, err)
 	}
-	data, err := jpeg.Decode(f)
+	return data, nil
+}
+
+func writeJpeg(file string, data image.Image) error {
+	o, err := os.Create(file)
 	if err != nil {
-		log.Printf("%v: cannot decode jpg", orig)
-		return 0
+		return err
 	}
+	options := &jpeg.Options{Quality: 90} // Quality ranges from 1 to 100
+	if err = jpeg.Encode(o, data, options); err != nil {
+		o.Close()
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return o.Close()
+}
+
+// Write the JPEG midi and mini of an image, oriented for display.
+func doScaleImg(db *Database, img *Image) error {
+	orig := origPath(db, img)
 	if img.width == 0 || img.height == 0 {
-		log.Printf("%v: zero dimension, cannot scale", orig)
-		return 0
+		return fmt.Errorf("%s: zero dimension, cannot scale", orig)
 	}
-	midiData := scaleImage(data, 2048, false)
-	midiO, err := os.Create(midiPath(db, img))
+	data, err := decodeImage(orig)
 	if err != nil {
-		log.Printf("%v: cannot create", midiPath(db, img))
-		return 0
+		return err
 	}
-	options := &jpeg.Options{Quality: 90} // Quality ranges from 1 to 100
-	jpeg.Encode(midiO, midiData, options)
-	miniData := scaleImage(midiData, 360, true)
-	miniO, err := os.Create(miniPath(db, img))
-	if err != nil {
-		log.Printf("%v: cannot create", miniPath(db, img))
-		return 0
+	midiData := img.displayOrientation().apply(scaleImage(data, 2048, false))
+	if err = writeJpeg(midiPath(db, img), midiData); err != nil {
+		return err
 	}
-	jpeg.Encode(miniO, miniData, options)
-	return 1
+	miniData := scaleImage(midiData, 360, true)
+	return writeJpeg(miniPath(db, img), miniData)
 }
 
-func feedImages(db *Database, force bool, img_ch chan<- *Image) int {
-	fed := 0
-	for _, dir := range db.Directories() {
+func feedImages(db *Database, dirs []*Directory, force bool,
+	img_ch chan<- *Image) int {
+	var imgs []*Image
+	for _, dir := range dirs {
 		rel_pat := dir.RelPat()
 		mini_dir := db.FullMiniPath(rel_pat)
 		mini_times := indexTimes(mini_dir)
 		midi_dir := db.FullMidiPath(rel_pat)
 		midi_times := indexTimes(midi_dir)
-		for _, img := range dir.Images() {
+		for _, img := range dir.stills() {
 			if force || mustScale(img, mini_times) || mustScale(img, midi_times) {
-				fed += 1
-				img_ch <- img
+				imgs = append(imgs, img)
 			}
 		}
 	}
-	return fed
+	db.progress.setToMinify(len(imgs))
+	for _, img := range imgs {
+		img_ch <- img
+	}
+	return len(imgs)
 }
 
 // rm -rf /tmp/mini/2005-01*
@@ -170,7 +189,11 @@ func minifyWorker2(db *Database, img_ch <-chan *Image, wg *sync.WaitGroup, id in
 	start_time := time.Now()
 	for img := range img_ch {
 		i += 1
-		doScaleImg(db, img)
+		if err := doScaleImg(db, img); err != nil {
+			log.Printf("%s\n", err.Error())
+			db.progress.addError(err.Error())
+		}
+		db.progress.addMinified()
 		if (i % N) == 0 {
 			log.Printf("%d: Resized %d in %d ms\n", id, N,
 				time.Since(start_time).Nanoseconds()/1000000)
@@ -180,14 +203,18 @@ func minifyWorker2(db *Database, img_ch <-chan *Image, wg *sync.WaitGroup, id in
 }
 
 func MinifyDatabase(db *Database, force_minis bool, force_midis bool) int {
-	force := force_minis || force_midis
+	return MinifyDirectories(db, db.Directories(), force_minis || force_midis)
+}
+
+// Create the missing or outdated mini and midi images of some directories.
+func MinifyDirectories(db *Database, dirs []*Directory, force bool) int {
 	img_ch := make(chan *Image)
 	var wg sync.WaitGroup
 	for i := 0; i < *minifier_threads; i++ {
 		wg.Add(1)
 		go minifyWorker2(db, img_ch, &wg, i)
 	}
-	resized := feedImages(db, force, img_ch)
+	resized := feedImages(db, dirs, force, img_ch)
 	close(img_ch)
 	wg.Wait()
 	return resized
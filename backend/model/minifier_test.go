@@ -0,0 +1,87 @@
+package model
+
+import (
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+import (
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func writeTestImage(t *testing.T, p string, w, h int) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	switch strings.ToLower(path.Ext(p)) {
+	case ".png":
+		err = png.Encode(f, img)
+	case ".gif":
+		err = gif.Encode(f, img, nil)
+	case ".bmp":
+		err = bmp.Encode(f, img)
+	case ".tif":
+		err = tiff.Encode(f, img, nil)
+	default:
+		err = jpeg.Encode(f, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_MinifyFormats(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	names := []string{"a.png", "b.GIF", "c.bmp", "d.TIF", "e.JPEG"}
+	for _, name := range names {
+		writeTestImage(t, path.Join(orig, name), 40, 30)
+	}
+
+	db := loadTestDatabase(t, orig, root)
+	for _, name := range names {
+		img := imageNamed(db, name)
+		if img == nil || img.width != 40 || img.height != 30 {
+			t.Errorf("%s: bad image %v", name, img)
+		}
+	}
+	if n := MinifyDatabase(db, false, false); n != len(names) {
+		t.Errorf("minified %d images", n)
+	}
+	for _, name := range names {
+		img := imageNamed(db, name)
+		for _, p := range []string{midiPath(db, img), miniPath(db, img)} {
+			f, err := os.Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = jpeg.DecodeConfig(f); err != nil {
+				t.Errorf("%s: not a jpeg: %v", p, err)
+			}
+			f.Close()
+		}
+	}
+}
+
+func Test_DecodeUnsupported(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(path.Join(orig, "a.webp"), []byte("not an image"), 0777)
+	if _, err := decodeImage(path.Join(orig, "a.webp")); err == nil ||
+		!strings.Contains(err.Error(), "unsupported image format") {
+		t.Errorf("bad error %v", err)
+	}
+}
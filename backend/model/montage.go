@@ -43,6 +43,7 @@ func servePath(w http.ResponseWriter, path string) bool {
 }
 
 func HandleMontage2(w http.ResponseWriter, r *http.Request, db *Database) {
+	db = db.Snapshot()
 	log.Printf("Montage: %s\n", r.URL.Path)
 	splits := strings.Split(r.URL.Path, "/")
 	if len(splits) == 0 {
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"image"
+	"image/draw"
+)
+
+import "github.com/rwcarlsen/goexif/exif"
+
+// How to display an image: flip it horizontally if flip, then rotate it
+// clockwise by rot degrees.
+type orientation struct {
+	flip bool
+	rot  int32 // 0, 90, 180 or 270.
+}
+
+// The orientation for the values of the EXIF Orientation tag.
+var exifOrientations = map[int32]orientation{
+	1: {false, 0},
+	2: {true, 0},
+	3: {false, 180},
+	4: {true, 180},
+	5: {true, 270},
+	6: {false, 90},
+	7: {true, 90},
+	8: {false, 270},
+}
+
+// The orientation of an image from its EXIF Orientation and its manual
+// rotation, applied after the EXIF one.
+func makeOrientation(exif_orientation int32, rotate_degrees int32) orientation {
+	o := exifOrientations[exif_orientation]
+	o.rot = ((o.rot+rotate_degrees)%360 + 360) % 360
+	return o
+}
+
+// The display dimensions of an image of the given dimensions.
+func (o orientation) size(height, width int32) (int32, int32) {
+	if o.rot == 90 || o.rot == 270 {
+		return width, height
+	}
+	return height, width
+}
+
+// Return src flipped and rotated for display.
+func (o orientation) apply(src image.Image) image.Image {
+	if !o.flip && o.rot == 0 {
+		return src
+	}
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o.rot == 90 || o.rot == 270 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx := x
+			if o.flip {
+				fx = w - 1 - x
+			}
+			var dx, dy int
+			switch o.rot {
+			case 0:
+				dx, dy = fx, y
+			case 90:
+				dx, dy = h-1-y, fx
+			case 180:
+				dx, dy = w-1-fx, h-1-y
+			case 270:
+				dx, dy = y, w-1-fx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4],
+				rgba.Pix[rgba.PixOffset(x, y):rgba.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// The EXIF Orientation of a decoded EXIF, 0 if it has none.
+func exifOrientationTag(ex *exif.Exif) int32 {
+	tag, err := ex.Get(exif.Orientation)
+	if err != nil {
+		return 0
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 0
+	}
+	return int32(o)
+}
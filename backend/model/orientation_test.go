@@ -0,0 +1,148 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+// Insert an EXIF APP1 segment with only an Orientation tag after the SOI
+// marker of a JPEG file.
+func setExifOrientation(t *testing.T, p string, o uint16) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, // Header, IFD at 8.
+		0, 1, // One entry.
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(o >> 8), byte(o), 0, 0, // Orientation.
+		0, 0, 0, 0} // No next IFD.
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append(append(append([]byte{}, data[:2]...), seg...), payload...)
+	out = append(out, data[2:]...)
+	if err = ioutil.WriteFile(p, out, 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_OrientationApply(t *testing.T) {
+	// A 3x2 image with a marked top-left and top-middle pixel.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.RGBA{0, 255, 0, 255})
+	// Where the two pixels land for each EXIF orientation.
+	want := map[int32][2]image.Point{
+		1: {{0, 0}, {1, 0}},
+		2: {{2, 0}, {1, 0}},
+		3: {{2, 1}, {1, 1}},
+		4: {{0, 1}, {1, 1}},
+		5: {{0, 0}, {0, 1}},
+		6: {{1, 0}, {1, 1}},
+		7: {{1, 2}, {1, 1}},
+		8: {{0, 2}, {0, 1}},
+	}
+	for o, pts := range want {
+		dst := makeOrientation(o, 0).apply(src)
+		h, w := makeOrientation(o, 0).size(2, 3)
+		if dst.Bounds().Dx() != int(w) || dst.Bounds().Dy() != int(h) {
+			t.Errorf("%d: bad size %v", o, dst.Bounds())
+		}
+		if r, _, _, _ := dst.At(pts[0].X, pts[0].Y).RGBA(); r == 0 {
+			t.Errorf("%d: red pixel not at %v", o, pts[0])
+		}
+		if _, g, _, _ := dst.At(pts[1].X, pts[1].Y).RGBA(); g == 0 {
+			t.Errorf("%d: green pixel not at %v", o, pts[1])
+		}
+	}
+	if o := makeOrientation(6, 90); o.rot != 180 || o.flip {
+		t.Errorf("bad manual rotation %v", o)
+	}
+}
+
+func jpegSize(t *testing.T, p string) (int, int) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Height, config.Width
+}
+
+func Test_ExifOrientation(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	setExifOrientation(t, path.Join(orig, "a.jpg"), 6)
+
+	db := loadTestDatabase(t, orig, root)
+	a := imageNamed(db, "a.jpg")
+	if a.Orientation() != 6 {
+		t.Fatalf("bad orientation %d", a.Orientation())
+	}
+	var jimg JsonImage
+	a.Json(&jimg)
+	if jimg.H != 8 || jimg.W != 6 {
+		t.Errorf("bad display size %dx%d", jimg.W, jimg.H)
+	}
+	MinifyDatabase(db, false, false)
+	if h, w := jpegSize(t, midiPath(db, a)); h != 8 || w != 6 {
+		t.Errorf("midi not rotated: %dx%d", w, h)
+	}
+
+	// A manual rotation rebuilds the derivatives.
+	db.publish()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/set?rotate=90&id="+strconv.Itoa(a.Id), nil)
+	req = req.WithContext(context.WithValue(req.Context(), "userEmail", "test@example.com"))
+	HandleSet(rec, req, db)
+	var res StringResults
+	json.NewDecoder(rec.Body).Decode(&res)
+	if res.Message != "ok" {
+		t.Fatalf("set failed: %s", res.Message)
+	}
+	a = imageNamed(db.Snapshot(), "a.jpg")
+	if a.RotateDegrees() != 90 {
+		t.Errorf("bad rotation %d", a.RotateDegrees())
+	}
+	if h, w := jpegSize(t, midiPath(db, a)); h != 6 || w != 8 {
+		t.Errorf("midi not rebuilt: %dx%d", w, h)
+	}
+}
+
+// The minis and midis are rebuilt at the same URL after a rotation, the
+// clients must not keep them.
+func Test_DerivativesCaching(t *testing.T) {
+	root, err := ioutil.TempDir("", "caching")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"mini/a.jpg", "maxi/a.jpg"} {
+		os.MkdirAll(path.Dir(path.Join(root, p)), 0777)
+		ioutil.WriteFile(path.Join(root, p), []byte("jpeg"), 0644)
+	}
+	for p, want := range map[string]string{
+		"/db/mini/a.jpg": "public, no-cache",
+		"/db/maxi/a.jpg": "public, max-age=31536000",
+	} {
+		rec := httptest.NewRecorder()
+		HandleFile(rec, httptest.NewRequest("GET", p, nil), "/db", root)
+		if got := rec.Header().Get("Cache-Control"); got != want {
+			t.Errorf("%s: got %q, want %q", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// Keywords edited through the API are stored as overrides in the index,
+// next to the keywords read from the originals.  mergeImage applies them
+// again each time the originals are read, so a rescan never loses them.
+
+// Apply the overrides ov to the keywords of an original.  Keywords are
+// compared case-insensitively.
+func applyOverrides(kwds []string, ov *store.KeywordOverrides) []string {
+	if ov == nil {
+		return kwds
+	}
+	if ov.GetReplaced() {
+		kwds = nil
+	}
+	return editKeywords(kwds, ov.Added, ov.Removed)
+}
+
+// An edit of the keywords of some images.
+type keywordEdit struct {
+	add, remove []string
+	replace     []string
+	has_replace bool // Replace the keywords with replace, which can be empty.
+}
+
+func (e *keywordEdit) check() error {
+	if len(e.add) == 0 && len(e.remove) == 0 && !e.has_replace {
+		return errors.New("Nothing to edit")
+	}
+	return checkKeywords(append(append(append([]string{}, e.add...), e.remove...),
+		e.replace...))
+}
+
+// Keywords cannot have the IPTC separator, nor the hierarchy separator.
+func checkKeywords(kwds []string) error {
+	for _, kwd := range kwds {
+		if kwd == "" || strings.TrimSpace(kwd) != kwd || strings.ContainsAny(kwd, ";|") {
+			return errors.New("Bad keyword: " + strconv.Quote(kwd))
+		}
+	}
+	return nil
+}
+
+// Drop the keywords of s in a.
+func dropKeywords(a []string, s []string) []string {
+	var kept []string
+	for _, x := range a {
+		if !containsFold(s, x) {
+			kept = append(kept, x)
+		}
+	}
+	return kept
+}
+
+// Apply the edit to the overrides and the keywords of item.  Returns true
+// if its keywords changed.
+func (e *keywordEdit) apply(item *store.Item) bool {
+	ov := item.KeywordOverrides
+	if ov == nil {
+		ov = new(store.KeywordOverrides)
+	}
+	kwds := item.Keywords
+	if e.has_replace {
+		ov.Replaced = proto.Bool(true)
+		ov.Added = editKeywords(nil, e.replace, nil)
+		ov.Removed = nil
+		kwds = nil
+	}
+	ov.Added = editKeywords(ov.Added, e.add, e.remove)
+	ov.Removed = editKeywords(dropKeywords(ov.Removed, e.add), e.remove, nil)
+	if ov.GetReplaced() {
+		// The removed keywords do not matter any more.
+		ov.Removed = nil
+	}
+	if len(ov.Added) == 0 && len(ov.Removed) == 0 && !ov.GetReplaced() {
+		ov = nil
+	}
+	item.KeywordOverrides = ov
+	edited := editKeywords(kwds, e.add, e.remove)
+	if e.has_replace {
+		edited = applyOverrides(nil, ov)
+	}
+	if stringsEqual(edited, item.Keywords) {
+		return false
+	}
+	item.Keywords = edited
+	return true
+}
+
+// Edit the keywords of some images.  The directories are edited one after
+// the other, each of them is published when edited.  Returns the number
+// of images whose keywords changed.
+func (db *Database) EditKeywords(c Change, imgs []*Image, e *keywordEdit) (int, error) {
+	if err := e.check(); err != nil {
+		return 0, err
+	}
+	by_dir := make(map[string][]string)
+	var rel_pats []string
+	for _, img := range imgs {
+		rel_pat := img.Directory().RelPat()
+		if by_dir[rel_pat] == nil {
+			rel_pats = append(rel_pats, rel_pat)
+		}
+		by_dir[rel_pat] = append(by_dir[rel_pat], img.Name())
+	}
+	num_changed := 0
+	for _, rel_pat := range rel_pats {
+		// Published images are never modified, edit a copy of the directory.
+		err := db.mutateItems(c, rel_pat, func(sdir *store.Directory) error {
+			for _, name := range by_dir[rel_pat] {
+				item := findItem(sdir, name)
+				if item == nil {
+					return errors.New("Unknown image: " + name)
+				}
+				if e.apply(item) {
+					num_changed++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return num_changed, err
+		}
+	}
+	return num_changed, nil
+}
+
+type EditResults struct {
+	Message string
+	Changed int // Number of images changed.
+}
+
+// The images of the ids in "id", then the results of the query "q", each
+// image once.
+func requestImages(r *http.Request, db *Database) ([]*Image, error) {
+	var imgs []*Image
+	seen := make(map[int]bool)
+	for _, s := range r.Form["id"] {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, errors.New("Bad image id: " + s)
+		}
+		img := db.Indexer().Image(id)
+		if img == nil {
+			return nil, errors.New(fmt.Sprintf("Unknown image id: %d", id))
+		}
+		if !seen[img.Id] {
+			seen[img.Id] = true
+			imgs = append(imgs, img)
+		}
+	}
+	if q := r.FormValue("q"); q != "" {
+		for _, img := range queryImages(q, db) {
+			if !seen[img.Id] {
+				seen[img.Id] = true
+				imgs = append(imgs, img)
+			}
+		}
+	}
+	if len(imgs) == 0 {
+		return nil, errors.New("No images, pass id or q")
+	}
+	return imgs, nil
+}
+
+// POST with the images in "id" or "q", and the keywords to add in "add",
+// to remove in "remove" or to use instead of the current ones in
+// "replace", all repeatable.  An empty "replace" removes all the keywords.
+func HandleKeywords(w http.ResponseWriter, r *http.Request, db *Database) {
+	var res EditResults
+	userEmail := r.Context().Value("userEmail").(string)
+	err := r.ParseForm()
+	if err == nil && r.Method != "POST" {
+		err = errors.New("Use POST to edit keywords")
+	}
+	var imgs []*Image
+	if err == nil {
+		imgs, err = requestImages(r, requestSnapshot(r, db))
+	}
+	if err == nil {
+		e := &keywordEdit{add: r.Form["add"], remove: r.Form["remove"]}
+		if replace, ok := r.Form["replace"]; ok {
+			e.has_replace = true
+			for _, kwd := range replace {
+				if kwd != "" {
+					e.replace = append(e.replace, kwd)
+				}
+			}
+		}
+		log.Printf("Keywords from %s: %d images +%q -%q =%q", userEmail, len(imgs),
+			e.add, e.remove, e.replace)
+		res.Changed, err = db.EditKeywords(Change{User: userEmail}, imgs, e)
+	}
+	if err == nil {
+		res.Message = "ok"
+	} else {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
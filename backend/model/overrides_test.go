@@ -0,0 +1,135 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+func Test_KeywordEditApply(t *testing.T) {
+	item := &store.Item{Keywords: []string{"lyon", "paris"}}
+	if !(&keywordEdit{add: []string{"noël"}, remove: []string{"Paris"}}).apply(item) ||
+		!reflect.DeepEqual(item.Keywords, []string{"lyon", "noël"}) {
+		t.Errorf("bad keywords %v", item.Keywords)
+	}
+	want := &store.KeywordOverrides{Added: []string{"noël"}, Removed: []string{"Paris"}}
+	if !proto.Equal(item.KeywordOverrides, want) {
+		t.Errorf("bad overrides %v", item.KeywordOverrides)
+	}
+	// The originals read again.
+	if got := applyOverrides([]string{"paris", "lyon", "mer"}, item.KeywordOverrides); !reflect.DeepEqual(got, []string{"lyon", "mer", "noël"}) {
+		t.Errorf("bad applied keywords %v", got)
+	}
+	if (&keywordEdit{add: []string{"Lyon"}}).apply(item) {
+		t.Error("existing keyword added")
+	}
+	(&keywordEdit{add: []string{"paris"}, remove: []string{"noël"}}).apply(item)
+	if ov := item.KeywordOverrides; !reflect.DeepEqual(ov.Removed, []string{"noël"}) ||
+		!containsFold(ov.Added, "paris") || containsFold(ov.Added, "noël") {
+		t.Errorf("bad overrides %v", ov)
+	}
+
+	(&keywordEdit{has_replace: true, replace: []string{"plage"}}).apply(item)
+	if !reflect.DeepEqual(item.Keywords, []string{"plage"}) ||
+		!reflect.DeepEqual(applyOverrides([]string{"lyon"}, item.KeywordOverrides), []string{"plage"}) {
+		t.Errorf("bad replaced keywords %v %v", item.Keywords, item.KeywordOverrides)
+	}
+	(&keywordEdit{has_replace: true}).apply(item)
+	if len(item.Keywords) != 0 || len(applyOverrides([]string{"lyon"}, item.KeywordOverrides)) != 0 {
+		t.Errorf("keywords not cleared %v %v", item.Keywords, item.KeywordOverrides)
+	}
+}
+
+func Test_HandleKeywords(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestJpeg(t, path.Join(orig, name), 8, 6)
+	}
+	embedIptc(t, path.Join(orig, "a.jpg"), map[byte]string{25: "lyon"})
+	ioutil.WriteFile(path.Join(orig, "b.xmp"), []byte(testXmp("0", "lyon", "mer")), 0777)
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+
+	edit := func(form url.Values) string {
+		req := httptest.NewRequest("POST", "/keywords", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", "test@example.com"))
+		rec := httptest.NewRecorder()
+		HandleKeywords(rec, req, db)
+		var res EditResults
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return res.Message + " " + strconv.Itoa(res.Changed)
+	}
+	id := func(name string) string { return strconv.Itoa(imageNamed(db, name).Id) }
+
+	for _, c := range []struct {
+		form     url.Values
+		msg, mer string
+		plage    string
+		lyon     string
+	}{
+		{url.Values{"q": {"lyon"}, "add": {"plage"}}, "ok 2", "b.jpg", "a.jpg b.jpg", "a.jpg b.jpg"},
+		{url.Values{"id": {id("b.jpg"), id("c.jpg")}, "remove": {"mer"}, "add": {"plage"}},
+			"ok 2", "", "a.jpg b.jpg c.jpg", "a.jpg b.jpg"},
+		{url.Values{"id": {id("a.jpg")}, "replace": {"mer"}}, "ok 1", "a.jpg", "b.jpg c.jpg", "b.jpg"},
+		{url.Values{"id": {id("c.jpg")}, "replace": {""}}, "ok 1", "a.jpg", "b.jpg", "b.jpg"},
+		{url.Values{"id": {"12"}, "add": {"plage"}}, "Unknown image id: 12 0", "a.jpg", "b.jpg", "b.jpg"},
+		{url.Values{"id": {id("c.jpg")}, "add": {" x"}}, "Bad keyword: \" x\" 0", "a.jpg", "b.jpg", "b.jpg"},
+		{url.Values{"id": {id("c.jpg")}}, "Nothing to edit 0", "a.jpg", "b.jpg", "b.jpg"},
+	} {
+		if msg := edit(c.form); msg != c.msg {
+			t.Errorf("%v: bad message %q", c.form, msg)
+		}
+		for q, want := range map[string]string{"mer": c.mer, "plage": c.plage, "lyon": c.lyon} {
+			if got := queryNames(db, q); got != want {
+				t.Errorf("%v: %q got %q, want %q", c.form, q, got, want)
+			}
+		}
+	}
+
+	// The overrides survive a rescan of changed originals.
+	for _, name := range []string{"a.jpg", "b.xmp"} {
+		tm := time.Now().Add(time.Hour)
+		os.Chtimes(path.Join(orig, name), tm, tm)
+	}
+	ioutil.WriteFile(path.Join(orig, "b.xmp"), []byte(testXmp("0", "lyon", "mer", "ski")), 0777)
+	tm := time.Now().Add(time.Hour)
+	os.Chtimes(path.Join(orig, "b.jpg"), tm, tm)
+	if err := db.ReloadDirectories([]string{""}, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := imageNamed(db, "b.jpg").Keywords(); !reflect.DeepEqual(got, []string{"lyon", "ski", "plage"}) {
+		t.Errorf("bad keywords after a rescan %v", got)
+	}
+	if got := imageNamed(db, "a.jpg").Keywords(); !reflect.DeepEqual(got, []string{"mer"}) {
+		t.Errorf("bad replaced keywords after a rescan %v", got)
+	}
+	if itm := indexItem(t, db, "c.jpg"); len(itm.Keywords) != 0 || !itm.KeywordOverrides.GetReplaced() {
+		t.Errorf("bad index %v", itm)
+	}
+
+	// An image given twice is edited and journaled once.
+	if msg := edit(url.Values{"id": {id("a.jpg"), id("a.jpg")}, "q": {"mer"}, "add": {"sable"}}); msg != "ok 1" {
+		t.Errorf("bad message %q", msg)
+	}
+	entries, _ := db.ReadJournal(func(e *JournalEntry) bool {
+		return strings.Contains(string(e.New), "sable")
+	})
+	if len(entries) != 1 {
+		t.Errorf("bad journal %+v", entries)
+	}
+}
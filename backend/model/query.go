@@ -17,7 +17,7 @@ func KeywordQuery(db *Database, kwd string) Query {
 
 	go func(q chan *Image, idx *Indexer) {
 		defer close(q)
-		for _, img := range idx.Images(kwd) {
+		for _, img := range idx.ImagesUnder(kwd) {
 			q <- img
 		}
 	}(q, db.Indexer())
@@ -68,8 +68,8 @@ func DirectoriesQuery(db *Database) Query {
 	go func(q chan *Image, db *Database) {
 		defer close(q)
 		for _, dir := range db.Directories() {
-			if len(dir.Images()) > 0 {
-				q <- dir.Images()[0]
+			if img := dir.Cover(); img != nil {
+				q <- img
 			}
 		}
 	}(q, db)
@@ -90,6 +90,14 @@ func DirectoryByNameQuery(db *Database, name string) Query {
 				return
 			}
 		}
+		// No album with this path, try the display titles.
+		for _, dir := range db.Directories() {
+			if dir.title != "" && strings.EqualFold(dir.title, name) {
+				for _, img := range dir.Images() {
+					q <- img
+				}
+			}
+		}
 	}(q, db, name)
 
 	return q
@@ -102,7 +110,8 @@ func DirectoryBySubnameQuery(db *Database, name string) Query {
 		var sub_name = strings.ToLower(name)
 		defer close(q)
 		for _, dir := range db.Directories() {
-			if strings.Contains(strings.ToLower(dir.RelPat()), sub_name) {
+			if strings.Contains(strings.ToLower(dir.RelPat()), sub_name) ||
+				strings.Contains(strings.ToLower(dir.title), sub_name) {
 				for _, img := range dir.Images() {
 					q <- img
 				}
@@ -263,38 +272,48 @@ func TimeRangeQuery(db *Database, start time.Time, end time.Time) Query {
 	return FilteredQuery(db, filter)
 }
 
+// Images taken between the local times start, included, and end, given as
+// UTC times.
+func LocalTimeRangeQuery(db *Database, start time.Time, end time.Time) Query {
+	filter := func(img *Image) bool {
+		local := wallClock(img.ItemTime())
+		return !local.Before(start) && local.Before(end)
+	}
+	return FilteredQuery(db, filter)
+}
+
 func YearQuery(db *Database, year string) Query {
-	tim, err := time.Parse("2006 MST", year+" PST")
+	tim, err := time.Parse("2006", year)
 	if err == nil {
-		return TimeRangeQuery(db, tim, tim.AddDate(1, 0, 0))
+		return LocalTimeRangeQuery(db, tim, tim.AddDate(1, 0, 0))
 	} else {
 		return nil
 	}
 }
 
 func YearRangeQuery(db *Database, year_range string) Query {
-	tim_from, err := time.Parse("2006 MST", year_range[0:4]+" PST")
-	tim_to, err := time.Parse("2006 MST", year_range[6:10]+" PST")
+	tim_from, err := time.Parse("2006", year_range[0:4])
+	tim_to, err := time.Parse("2006", year_range[6:10])
 	if err == nil {
-		return TimeRangeQuery(db, tim_from, tim_to.AddDate(1, 0, 0))
+		return LocalTimeRangeQuery(db, tim_from, tim_to.AddDate(1, 0, 0))
 	} else {
 		return nil
 	}
 }
 
 func MonthQuery(db *Database, year_month string) Query {
-	tim, err := time.Parse("2006-01 MST", year_month+" PST")
+	tim, err := time.Parse("2006-01", year_month)
 	if err == nil {
-		return TimeRangeQuery(db, tim, tim.AddDate(0, 1, 0))
+		return LocalTimeRangeQuery(db, tim, tim.AddDate(0, 1, 0))
 	} else {
 		return nil
 	}
 }
 
 func DayQuery(db *Database, year_month_day string) Query {
-	tim, err := time.Parse("2006-01-02 MST", year_month_day+" PST")
+	tim, err := time.Parse("2006-01-02", year_month_day)
 	if err == nil {
-		return TimeRangeQuery(db, tim, tim.AddDate(0, 0, 1))
+		return LocalTimeRangeQuery(db, tim, tim.AddDate(0, 0, 1))
 	} else {
 		return nil
 	}
@@ -324,6 +343,7 @@ func MonthDayQuery(db *Database, month_day string) Query {
 	if err != nil {
 		return KeywordQuery(db, month_day)
 	}
+	// Item times are in the zone where they were taken.
 	filter := func(img *Image) bool {
 		return img.ItemTime().Month() == time.Month(dateArray[0]) && img.ItemTime().Day() == dateArray[1]
 	}
@@ -377,6 +397,20 @@ func tokenize(s string) []string {
 	}
 }
 
+// The token of a query made of a single one, without its leading quote.
+func loneToken(s string) (string, bool) {
+	var tokens []string
+	if UseLRParser {
+		tokens = strings.Split(s, ",")
+	} else {
+		tokens = tokenize(s)
+	}
+	if len(tokens) != 1 {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.TrimSpace(tokens[0]), "\""), true
+}
+
 func tokenize_comma(s string) []string {
 	splits := strings.Split(s, ",")
 	tokens := make([]string, len(splits))
@@ -467,11 +501,29 @@ func keywordMatchQuery(db *Database, s string) Query {
 var UseLRParser bool = false
 
 func ParseQuery(s string, db *Database) Query {
+	return hideRejected(s, parseQuery(s, db))
+}
+
+func parseQuery(s string, db *Database) Query {
+	s, geo_qs := extractGeoQueries(s, db)
+	if geo_qs != nil && s == "" {
+		return AndQuery(geo_qs)
+	}
+	// A collection alone comes in its order.
+	if t, ok := loneToken(s); ok && geo_qs == nil &&
+		strings.HasPrefix(strings.ToLower(t), "collection:") {
+		return collectionOrderQuery(db, t[len("collection:"):])
+	}
+	var q Query
 	if UseLRParser {
-		return ParseQueryLR(s, db)
+		q = ParseQueryLR(s, db)
 	} else {
-		return ParseQueryOriginal(s, db)
+		q = ParseQueryOriginal(s, db)
+	}
+	if geo_qs != nil {
+		return AndQuery(append(geo_qs, q))
 	}
+	return q
 }
 
 func ParseQueryOriginal(s string, db *Database) Query {
@@ -490,6 +542,22 @@ func ParseQueryOriginal(s string, db *Database) Query {
 			qs[i] = KeywordCountQuery(db, t[len("count:"):])
 		case strings.HasPrefix(lower_t, "stereo:"):
 			qs[i] = StereoQuery(db)
+		case isCameraPredicate(lower_t):
+			qs[i] = CameraPredicateQuery(db, t)
+		case strings.HasPrefix(lower_t, "rating:"):
+			qs[i] = RatingQuery(db, t[len("rating:"):])
+		case strings.HasPrefix(lower_t, "flag:"):
+			qs[i] = FlagQuery(db, t[len("flag:"):])
+		case strings.HasPrefix(lower_t, "text:"), strings.HasPrefix(lower_t, "\"text:"):
+			qs[i] = TextQuery(db, t[strings.Index(t, ":")+1:])
+		case strings.HasPrefix(lower_t, "\"collection:"):
+			qs[i] = CollectionQuery(db, t[len("\"collection:"):])
+		case strings.HasPrefix(lower_t, "collection:"):
+			qs[i] = CollectionQuery(db, t[len("collection:"):])
+		case strings.HasPrefix(lower_t, "\"saved:"):
+			qs[i] = SavedSearchQuery(db, t[len("\"saved:"):])
+		case strings.HasPrefix(lower_t, "saved:"):
+			qs[i] = SavedSearchQuery(db, t[len("saved:"):])
 		case strings.HasPrefix(lower_t, "\"album:"):
 			qs[i] = DirectoryByNameQuery(db, t[len("\"album:"):len(t)])
 		case strings.HasPrefix(lower_t, "album:"):
@@ -513,7 +581,7 @@ func ParseQueryOriginal(s string, db *Database) Query {
 		case strings.HasPrefix(lower_t, "\""):
 			qs[i] = KeywordSynonymsQuery(db, lower_t[1:len(t)])
 		default:
-			qs[i] = keywordMatchQuery(db, lower_t)
+			qs[i] = OrQuery([]Query{keywordMatchQuery(db, lower_t), TextQuery(db, lower_t)})
 		}
 	}
 	return AndQuery(qs)
@@ -561,6 +629,18 @@ func ParseQueryLR(s string, db *Database) Query {
 			qs[i] = KeywordCountQuery(db, t[len("count:"):])
 		case strings.HasPrefix(lower_t, "stereo:"):
 			qs[i] = StereoQuery(db)
+		case isCameraPredicate(lower_t):
+			qs[i] = CameraPredicateQuery(db, t)
+		case strings.HasPrefix(lower_t, "rating:"):
+			qs[i] = RatingQuery(db, t[len("rating:"):])
+		case strings.HasPrefix(lower_t, "flag:"):
+			qs[i] = FlagQuery(db, t[len("flag:"):])
+		case strings.HasPrefix(lower_t, "text:"):
+			qs[i] = TextQuery(db, t[len("text:"):])
+		case strings.HasPrefix(lower_t, "saved:"):
+			qs[i] = SavedSearchQuery(db, t[len("saved:"):])
+		case strings.HasPrefix(lower_t, "collection:"):
+			qs[i] = CollectionQuery(db, t[len("collection:"):])
 		case strings.HasPrefix(lower_t, "album:"):
 			qs[i] = DirectoryByNameQuery(db, t[len("album:"):])
 		case strings.HasPrefix(lower_t, "in:"):
@@ -583,7 +663,7 @@ func ParseQueryLR(s string, db *Database) Query {
 			// Multi-word token - treat as exact keyword match (like quoted string)
 			qs[i] = KeywordSynonymsQuery(db, lower_t)
 		default:
-			qs[i] = keywordMatchQuery(db, lower_t)
+			qs[i] = OrQuery([]Query{keywordMatchQuery(db, lower_t), TextQuery(db, lower_t)})
 		}
 	}
 	return AndQuery(qs)
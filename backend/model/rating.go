@@ -0,0 +1,175 @@
+package model
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import "github.com/golang/protobuf/proto"
+import "github.com/rwcarlsen/goexif/exif"
+
+// Ratings are 1 to 5 stars, 0 when unrated and -1 for rejected, as in
+// xmp:Rating.  The pick flag is 1 for picked and -1 for rejected.  An
+// image is rejected by either of them.
+
+var hide_rejected = flag.Bool("hide_rejected", false,
+	"If true the queries skip the rejected images, unless they ask for them with flag:reject.")
+
+// The Windows rating tag of IFD0, written by tools without XMP support.
+const exifRating exif.FieldName = "Rating"
+
+type ratingTagParser struct{}
+
+func (ratingTagParser) Parse(x *exif.Exif) error {
+	if len(x.Tiff.Dirs) > 0 {
+		x.LoadTags(x.Tiff.Dirs[0], map[uint16]exif.FieldName{0x4746: exifRating}, false)
+	}
+	return nil
+}
+
+func init() {
+	exif.RegisterParsers(ratingTagParser{})
+}
+
+// The rating of a decoded EXIF, nil if it has none.
+func exifRatingTag(ex *exif.Exif) *int32 {
+	tag, err := ex.Get(exifRating)
+	if err != nil {
+		return nil
+	}
+	r, err := tag.Int(0)
+	if err != nil || r < 0 || r > 5 {
+		return nil
+	}
+	return proto.Int32(int32(r))
+}
+
+func (img *Image) IsRejected() bool { return img.rating < 0 || img.pick < 0 }
+
+// rating: compares the rating, like rating:>=4, rating:5, rating:-1 or
+// rating:3-5.  Unrated images have a rating of 0.
+func RatingQuery(db *Database, s string) Query {
+	cmp, err := parseRatingComparison(strings.TrimSpace(s))
+	if err != nil {
+		return EmptyQuery(db)
+	}
+	filter := func(img *Image) bool {
+		return cmp(img.rating)
+	}
+	return FilteredQuery(db, filter)
+}
+
+// Like parseComparison, with exact integers.  The ratings can be
+// negative: the "-" of a range is after the first character.
+func parseRatingComparison(s string) (func(int32) bool, error) {
+	parse := func(s string) (int32, error) {
+		r, err := strconv.ParseInt(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return 0, errors.New("Bad rating: " + s)
+		}
+		return int32(r), nil
+	}
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		v, err := parse(s[len(op):])
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case ">=":
+			return func(r int32) bool { return r >= v }, nil
+		case "<=":
+			return func(r int32) bool { return r <= v }, nil
+		case ">":
+			return func(r int32) bool { return r > v }, nil
+		case "<":
+			return func(r int32) bool { return r < v }, nil
+		}
+		return func(r int32) bool { return r == v }, nil
+	}
+	if i := strings.Index(s[min(len(s), 1):], "-"); i >= 0 {
+		lo, err := parse(s[:i+1])
+		if err != nil {
+			return nil, err
+		}
+		hi, err := parse(s[i+2:])
+		if err != nil {
+			return nil, err
+		}
+		return func(r int32) bool { return r >= lo && r <= hi }, nil
+	}
+	return parseRatingComparison("=" + s)
+}
+
+// flag:pick, flag:reject or flag:none.
+func FlagQuery(db *Database, s string) Query {
+	var filter func(img *Image) bool
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "pick", "picked":
+		filter = func(img *Image) bool { return img.pick > 0 }
+	case "reject", "rejected":
+		filter = func(img *Image) bool { return img.IsRejected() }
+	case "none":
+		filter = func(img *Image) bool { return img.pick == 0 && !img.IsRejected() }
+	default:
+		return EmptyQuery(db)
+	}
+	return FilteredQuery(db, filter)
+}
+
+// The images of q that pass filter.
+func FilterQuery(q Query, filter func(*Image) bool) Query {
+	qq := make(chan *Image)
+
+	go func(qq chan *Image) {
+		defer close(qq)
+		for img := range q {
+			if filter(img) {
+				qq <- img
+			}
+		}
+	}(qq)
+
+	return qq
+}
+
+// Drop the rejected images from q if they are hidden and the query s does
+// not ask for them.
+func hideRejected(s string, q Query) Query {
+	if !*hide_rejected || q == nil || strings.Contains(strings.ToLower(s), "flag:reject") {
+		return q
+	}
+	return FilterQuery(q, func(img *Image) bool { return !img.IsRejected() })
+}
+
+// The queries listing albums keep the order of the albums and of their
+// images, and a collection its order: they are not sorted by rating.
+func keepsQueryOrder(q string) bool {
+	t, ok := loneToken(q)
+	if !ok {
+		return false
+	}
+	t = strings.ToLower(t)
+	for _, prefix := range []string{"album:", "albums:", "in:", "titre:", "collection:"} {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort images by decreasing rating, the picked ones first among equal
+// ratings, keeping the order of the others.
+func sortByRating(imgs []*Image) {
+	sort.SliceStable(imgs, func(i, j int) bool {
+		if imgs[i].rating != imgs[j].rating {
+			return imgs[i].rating > imgs[j].rating
+		}
+		return imgs[i].pick > imgs[j].pick
+	})
+}
@@ -0,0 +1,140 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func pickXmp(attr string) string {
+	return `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:digiKam="http://www.digikam.org/ns/1.0/"
+    xmlns:xmpDM="http://ns.adobe.com/xmp/1.0/DynamicMedia/"
+    ` + attr + `/>
+ </rdf:RDF>
+</x:xmpmeta>`
+}
+
+func Test_ParsePick(t *testing.T) {
+	for attr, want := range map[string]int32{
+		`digiKam:PickLabel="3"`: 1,
+		`digiKam:PickLabel="1"`: -1,
+		`xmpDM:good="True"`:     1,
+		`xmpDM:good="False"`:    -1,
+	} {
+		meta, err := parseXmp([]byte(pickXmp(attr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.pick == nil || *meta.pick != want {
+			t.Errorf("%s: bad pick %v", attr, meta.pick)
+		}
+	}
+	if meta, _ := parseXmp([]byte(pickXmp(`digiKam:PickLabel="2"`))); meta.pick != nil {
+		t.Errorf("pending label read as %d", *meta.pick)
+	}
+}
+
+func loadRatedDatabase(t *testing.T) (*Database, string, string) {
+	orig, root := makeOrigTree(t, nil)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg"} {
+		writeTestJpeg(t, path.Join(orig, name), 8, 6)
+	}
+	ioutil.WriteFile(path.Join(orig, "b.xmp"), []byte(testXmp("4")), 0777)
+	ioutil.WriteFile(path.Join(orig, "c.xmp"), []byte(testXmp("5")), 0777)
+	ioutil.WriteFile(path.Join(orig, "d.xmp"), []byte(testXmp("-1")), 0777)
+	ioutil.WriteFile(path.Join(orig, "e.xmp"), []byte(pickXmp(`digiKam:PickLabel="3"`)), 0777)
+	// The Windows rating tag, overridden by the XMP.
+	setExif(t, path.Join(orig, "a.jpg"), []tiffEntry{shortEntry(0x4746, 2)}, nil)
+	setExif(t, path.Join(orig, "c.jpg"), []tiffEntry{shortEntry(0x4746, 1)}, nil)
+	return loadTestDatabase(t, orig, root), orig, root
+}
+
+func Test_RatingQueries(t *testing.T) {
+	db, orig, root := loadRatedDatabase(t)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	if a := imageNamed(db, "a.jpg"); a.Rating() != 2 {
+		t.Errorf("EXIF rating not read: %d", a.Rating())
+	}
+	if c := imageNamed(db, "c.jpg"); c.Rating() != 5 {
+		t.Errorf("XMP rating does not win: %d", c.Rating())
+	}
+	if itm := indexItem(t, db, "e.jpg"); itm.GetPick() != 1 {
+		t.Errorf("pick not indexed: %v", itm)
+	}
+
+	for q, want := range map[string]string{
+		"rating:>=4":  "b.jpg c.jpg",
+		"rating:5":    "c.jpg",
+		"rating:1-2":  "a.jpg",
+		"rating:-1":   "d.jpg",
+		"rating:=-1":  "d.jpg",
+		"rating:-1-0": "d.jpg e.jpg",
+		"rating:>-1":  "a.jpg b.jpg c.jpg e.jpg",
+		"flag:pick":   "e.jpg",
+		"flag:reject": "d.jpg",
+		"flag:none":   "a.jpg b.jpg c.jpg",
+		"rating:lots": "",
+		"flag:maybe":  "",
+	} {
+		if got := queryNames(db, q); got != want {
+			t.Errorf("%q: got %q, want %q", q, got, want)
+		}
+	}
+
+	*hide_rejected = true
+	defer func() { *hide_rejected = false }()
+	if got := queryNames(db, "rating:<=0"); got != "e.jpg" {
+		t.Errorf("rejected not hidden: %q", got)
+	}
+	if got := queryNames(db, "flag:reject"); got != "d.jpg" {
+		t.Errorf("rejected hidden when asked for: %q", got)
+	}
+}
+
+func Test_RatingOrderAndCover(t *testing.T) {
+	db, orig, root := loadRatedDatabase(t)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db.publish()
+
+	if cover := db.Directories()[0].Cover(); cover == nil || cover.Name() != "c.jpg" {
+		t.Errorf("bad cover %v", cover)
+	}
+	var jdir JsonDirectory
+	db.Directories()[0].Json(&jdir)
+	for _, name := range jdir.PreviewNames {
+		if name == "d.jpg" {
+			t.Errorf("rejected image in the previews %v", jdir.PreviewNames)
+		}
+	}
+
+	order := func(params string) string {
+		req := httptest.NewRequest("GET", "/q?q=rating:>-2&"+params, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", "test@example.com"))
+		rec := httptest.NewRecorder()
+		HandleQuery(rec, req, db)
+		var res []JsonImage
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		names := ""
+		for _, jimg := range res {
+			names += jimg.In + " "
+		}
+		return names
+	}
+	if got := order(""); got != "c.jpg b.jpg a.jpg e.jpg d.jpg " {
+		t.Errorf("bad rating order %q", got)
+	}
+	if got := order("order=index"); got != "a.jpg b.jpg c.jpg d.jpg e.jpg " {
+		t.Errorf("bad index order %q", got)
+	}
+}
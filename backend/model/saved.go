@@ -0,0 +1,238 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Saved searches are named queries stored on the server, used in other
+// queries with the "saved:<name>" token.  They are listed with their
+// current number of images and cover, like albums.  Names are unique per
+// owner and compared case-insensitively.  Only the owner of a search can
+// change it, sharing it makes it visible to other users.  The token
+// expands the search of the requesting user with that name, or else the
+// one shared with them.
+
+type SavedSearch struct {
+	Name    string
+	Query   string
+	Owner   string
+	Shared  []string `json:",omitempty"` // Users it is shared with, "*" for all.
+	Created time.Time
+	Updated time.Time
+}
+
+// The search can be listed by user.
+func (s *SavedSearch) visibleTo(user string) bool {
+	return s.Owner == user || containsFold(s.Shared, user) || containsFold(s.Shared, "*")
+}
+
+func (db *Database) SavedSearchesPath() string {
+	return path.Join(db.indx_root, "saved_searches.json")
+}
+
+var saved_mu sync.Mutex // Serializes the edits of the saved searches.
+
+// All the saved searches, sorted by name and owner.
+func (db *Database) ReadSavedSearches() ([]SavedSearch, error) {
+	data, err := ioutil.ReadFile(db.SavedSearchesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var searches []SavedSearch
+	if err = json.Unmarshal(data, &searches); err != nil {
+		return nil, errors.New(db.SavedSearchesPath() + ": " + err.Error())
+	}
+	return searches, nil
+}
+
+func (db *Database) writeSavedSearches(searches []SavedSearch) error {
+	sort.Slice(searches, func(i, j int) bool {
+		name_i, name_j := strings.ToLower(searches[i].Name), strings.ToLower(searches[j].Name)
+		if name_i != name_j {
+			return name_i < name_j
+		}
+		return searches[i].Owner < searches[j].Owner
+	})
+	data, err := json.MarshalIndent(searches, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(db.SavedSearchesPath(), data, 0644)
+}
+
+// The saved search called name visible to user, nil if none.  The search
+// of user wins over the ones shared with them.
+func (db *Database) SavedSearch(user string, name string) (*SavedSearch, error) {
+	searches, err := db.ReadSavedSearches()
+	if err != nil {
+		return nil, err
+	}
+	var shared *SavedSearch
+	for i := range searches {
+		s := &searches[i]
+		if !strings.EqualFold(s.Name, name) || !s.visibleTo(user) {
+			continue
+		}
+		if s.Owner == user {
+			return s, nil
+		}
+		if shared == nil {
+			shared = s
+		}
+	}
+	return shared, nil
+}
+
+// The snapshot of db for the request r: its saved: queries expand the
+// searches visible to the user making it.
+func requestSnapshot(r *http.Request, db *Database) *Database {
+	snap := db.Snapshot()
+	if snap == db {
+		// Not published yet, leave db alone.
+		snap = withRoots(db)
+		snap.directories = db.directories
+		snap.indexer = db.indexer
+		snap.recentActiveKeywords = db.recentActiveKeywords
+	}
+	snap.user, _ = r.Context().Value("userEmail").(string)
+	return snap
+}
+
+func checkSavedSearch(s *SavedSearch) error {
+	if s.Name == "" || strings.TrimSpace(s.Name) != s.Name || strings.ContainsAny(s.Name, "\",") {
+		return errors.New("Bad name: " + s.Name)
+	}
+	if strings.TrimSpace(s.Query) == "" {
+		return errors.New("Empty query")
+	}
+	// Saved searches cannot expand each other, so they cannot loop.
+	if strings.Contains(strings.ToLower(s.Query), "saved:") {
+		return errors.New("A saved search cannot use other saved searches")
+	}
+	return nil
+}
+
+// Save the search s for user, replacing the search of user with the same
+// name.
+func (db *Database) SaveSearch(user string, s SavedSearch) error {
+	if err := checkSavedSearch(&s); err != nil {
+		return err
+	}
+	saved_mu.Lock()
+	defer saved_mu.Unlock()
+	searches, err := db.ReadSavedSearches()
+	if err != nil {
+		return err
+	}
+	s.Owner = user
+	s.Created = time.Now()
+	s.Updated = s.Created
+	for i := range searches {
+		if !strings.EqualFold(searches[i].Name, s.Name) || searches[i].Owner != user {
+			continue
+		}
+		s.Created = searches[i].Created
+		searches[i] = s
+		return db.writeSavedSearches(searches)
+	}
+	return db.writeSavedSearches(append(searches, s))
+}
+
+// Delete the search of user called name.
+func (db *Database) DeleteSearch(user string, name string) error {
+	saved_mu.Lock()
+	defer saved_mu.Unlock()
+	searches, err := db.ReadSavedSearches()
+	if err != nil {
+		return err
+	}
+	for i, s := range searches {
+		if !strings.EqualFold(s.Name, name) || s.Owner != user {
+			continue
+		}
+		return db.writeSavedSearches(append(searches[:i], searches[i+1:]...))
+	}
+	return errors.New("Unknown saved search: " + name)
+}
+
+// The images of the saved search called name visible to the user of the
+// snapshot db, none if there is none.
+func SavedSearchQuery(db *Database, name string) Query {
+	s, err := db.SavedSearch(db.user, name)
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+	}
+	if s == nil {
+		return EmptyQuery(db)
+	}
+	return parseQuery(s.Query, db)
+}
+
+type JsonSavedSearch struct {
+	Name    string
+	Q       string // The query
+	Owner   string
+	Shared  []string
+	Nimgs   int    // Number of images matching the query now
+	Cov     int    // Cover image id, 0 if no image matches
+	CovName string // Cover image name
+}
+
+// GET lists the saved searches visible to the user.  POST with "name" and
+// "q" saves a search, shared with the users in "share", repeatable, or
+// with "delete" deletes it.
+func HandleSavedSearches(w http.ResponseWriter, r *http.Request, db *Database) {
+	userEmail := r.Context().Value("userEmail").(string)
+	r.ParseForm()
+	if r.Method != "POST" {
+		searches, err := db.ReadSavedSearches()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		db = db.Snapshot()
+		res := make([]JsonSavedSearch, 0, len(searches))
+		for _, s := range searches {
+			if !s.visibleTo(userEmail) {
+				continue
+			}
+			js := JsonSavedSearch{Name: s.Name, Q: s.Query, Owner: s.Owner, Shared: s.Shared}
+			imgs := queryImages(s.Query, db)
+			js.Nimgs = len(imgs)
+			if cover := bestImage(imgs); cover != nil {
+				js.Cov = cover.Id
+				js.CovName = cover.Name()
+			}
+			res = append(res, js)
+		}
+		json.NewEncoder(w).Encode(&res)
+		return
+	}
+	var res StringResults
+	var err error
+	log.Printf("Saved search from %s: %v", userEmail, r.Form)
+	if r.FormValue("delete") != "" {
+		err = db.DeleteSearch(userEmail, r.FormValue("name"))
+	} else {
+		err = db.SaveSearch(userEmail, SavedSearch{Name: strings.TrimSpace(r.FormValue("name")),
+			Query: r.FormValue("q"), Shared: r.Form["share"]})
+	}
+	if err == nil {
+		res.Message = "ok"
+	} else {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
@@ -0,0 +1,110 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_SavedSearches(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for name, xmp := range map[string]string{
+		"a": testXmp("3", "plage"),
+		"b": testXmp("1", "plage", "mer"),
+		"c": testXmp("0", "lyon"),
+	} {
+		writeTestJpeg(t, path.Join(orig, name+".jpg"), 8, 6)
+		ioutil.WriteFile(path.Join(orig, name+".xmp"), []byte(xmp), 0777)
+	}
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+
+	save := func(user string, form url.Values, want string) {
+		var res StringResults
+		postAs(t, user, db, HandleSavedSearches, form, &res)
+		if res.Message != want {
+			t.Errorf("%v: got %q, want %q", form, res.Message, want)
+		}
+	}
+	list := func(user string) map[string]JsonSavedSearch {
+		req := httptest.NewRequest("GET", "/saved-searches", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", user))
+		rec := httptest.NewRecorder()
+		HandleSavedSearches(rec, req, db)
+		var res []JsonSavedSearch
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		by_name := make(map[string]JsonSavedSearch)
+		for _, s := range res {
+			by_name[s.Name] = s
+		}
+		return by_name
+	}
+
+	query := func(user string, q string) string {
+		req := httptest.NewRequest("GET", "/q", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", user))
+		return queryNames(requestSnapshot(req, db), q)
+	}
+
+	save("alice", url.Values{"name": {"plages"}, "q": {"plage"}, "share": {"bob"}}, "ok")
+	save("alice", url.Values{"name": {"vacances mer"}, "q": {"mer"}}, "ok")
+	save("bob", url.Values{"name": {"tout"}, "q": {"saved:plages lyon"}},
+		"A saved search cannot use other saved searches")
+	save("bob", url.Values{"name": {"a,b"}, "q": {"mer"}}, "Bad name: a,b")
+
+	if l := list("bob"); len(l) != 1 || l["plages"].Nimgs != 2 || l["plages"].CovName != "a.jpg" ||
+		l["plages"].Owner != "alice" {
+		t.Errorf("bad list for bob %+v", l)
+	}
+	if l := list("carol"); len(l) != 0 {
+		t.Errorf("bad list for carol %+v", l)
+	}
+	for _, c := range []struct{ user, q, want string }{
+		{"alice", "saved:plages", "a.jpg b.jpg"},
+		{"bob", "saved:Plages mer", "b.jpg"},
+		{"alice", `"saved:vacances mer`, "b.jpg"},
+		{"bob", `"saved:vacances mer`, ""},
+		{"carol", "saved:plages", ""},
+		{"alice", "saved:inconnu", ""},
+	} {
+		if got := query(c.user, c.q); got != c.want {
+			t.Errorf("%s %q: got %q, want %q", c.user, c.q, got, c.want)
+		}
+	}
+
+	// The names are unique per owner, the search of the user wins.
+	save("bob", url.Values{"name": {"Plages"}, "q": {"lyon"}}, "ok")
+	if got := query("bob", "saved:plages"); got != "c.jpg" {
+		t.Errorf("bob's search not used: %q", got)
+	}
+	if got := query("alice", "saved:plages"); got != "a.jpg b.jpg" {
+		t.Errorf("alice's search not used: %q", got)
+	}
+
+	// The counts follow the new images.
+	writeTestJpeg(t, path.Join(orig, "d.jpg"), 8, 6)
+	ioutil.WriteFile(path.Join(orig, "d.xmp"), []byte(testXmp("0", "plage")), 0777)
+	if err := db.ReloadDirectories([]string{""}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if l := list("alice"); len(l) != 2 || l["plages"].Nimgs != 3 {
+		t.Errorf("bad list after reload %+v", l)
+	}
+
+	save("carol", url.Values{"name": {"plages"}, "delete": {"1"}}, "Unknown saved search: plages")
+	save("bob", url.Values{"name": {"plages"}, "delete": {"1"}}, "ok")
+	if got := query("bob", "saved:plages"); got != "a.jpg b.jpg d.jpg" {
+		t.Errorf("shared search not used after delete: %q", got)
+	}
+	save("alice", url.Values{"name": {"plages"}, "delete": {"1"}}, "ok")
+	if got := query("alice", "saved:plages"); got != "" {
+		t.Errorf("deleted search still expanded: %q", got)
+	}
+}
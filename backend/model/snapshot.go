@@ -0,0 +1,115 @@
+package model
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// Version of the catalog snapshot format.  Bump it when the meaning of
+// the stored directories changes, older snapshots are then ignored and
+// the database is loaded from the per directory indexes.
+const catalogVersion = 2
+
+func (db *Database) CatalogPath() string {
+	return path.Join(db.indx_root, "catalog.pbin")
+}
+
+// Mod time of the index of a directory, 0 if it does not exist.
+func (db *Database) indexTimestamp(rel_pat string) int64 {
+	fi, err := os.Stat(db.IndexPath(rel_pat))
+	if err != nil {
+		return 0
+	}
+	return fi.ModTime().UnixNano()
+}
+
+// Read the catalog snapshot.  Returns nil if it is missing, unreadable or
+// from another version.
+func (db *Database) readCatalog() map[string]*store.CatalogEntry {
+	buffer, err := ioutil.ReadFile(db.CatalogPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("%s: %s\n", db.CatalogPath(), err.Error())
+		}
+		return nil
+	}
+	var cat store.Catalog
+	err = proto.Unmarshal(buffer, &cat)
+	if err != nil {
+		log.Printf("%s: %s\n", db.CatalogPath(), err.Error())
+		return nil
+	}
+	if cat.GetVersion() != catalogVersion {
+		log.Printf("%s: ignoring catalog version %d\n", db.CatalogPath(),
+			cat.GetVersion())
+		return nil
+	}
+	entries := make(map[string]*store.CatalogEntry, len(cat.Entries))
+	for _, entry := range cat.Entries {
+		if entry.RelPat != nil && entry.Directory != nil {
+			entries[*entry.RelPat] = entry
+		}
+	}
+	log.Printf("Read catalog with %d directories\n", len(entries))
+	return entries
+}
+
+// Write the catalog snapshot for the loaded directories.  Must be called
+// while the file times are still available.
+func (db *Database) writeCatalog() error {
+	cat := &store.Catalog{Version: proto.Int32(catalogVersion)}
+	for _, dir := range db.directories {
+		mod_time, ok := db.file_times.ModTime(dir.RelPat())
+		if !ok {
+			continue
+		}
+		cat.Entries = append(cat.Entries, &store.CatalogEntry{
+			RelPat:         proto.String(dir.RelPat()),
+			OrgdTimestamp:  proto.Int64(TimeToProto(mod_time.Round(time.Second))),
+			IndexTimestamp: proto.Int64(db.indexTimestamp(dir.RelPat())),
+			Directory:      dir.ToProto(),
+		})
+	}
+	data, err := proto.Marshal(cat)
+	if err != nil {
+		return err
+	}
+	log.Printf("write %s (%d directories)\n", db.CatalogPath(), len(cat.Entries))
+	return WriteFileAtomic(db.CatalogPath(), data, 0644)
+}
+
+// Try to build the loader result from the catalog snapshot.  Returns nil
+// if the directory changed since the snapshot was written, in which case
+// the directory must be loaded from its index.
+func (db *Database) loadFromCatalog(lod *loaderLoad) *loaderResult {
+	entry, ok := db.catalog[lod.rel_pat]
+	if !ok {
+		return nil
+	}
+	if entry.GetOrgdTimestamp() != TimeToProto(lod.orgd_mtime) ||
+		entry.GetIndexTimestamp() != db.indexTimestamp(lod.rel_pat) ||
+		entry.Directory.GetVersion() != currentIndexVersion() {
+		return nil
+	}
+	// Adding or removing a sub directory changes the mod time of the
+	// directory, so the sub directories from the snapshot are still valid.
+	// Stat them to get their mod times.
+	sdir := entry.Directory
+	subs := make([]os.FileInfo, 0, len(sdir.SubDirectories))
+	for _, name := range sdir.SubDirectories {
+		fi, err := os.Stat(path.Join(db.FullOrigPath(lod.rel_pat), name))
+		if err != nil {
+			return nil
+		}
+		subs = append(subs, fi)
+	}
+	dir := ProtoToDirectory(sdir, lod.rel_pat)
+	return &loaderResult{dir: dir, rel_pat: lod.rel_pat, orgd_subs: subs,
+		from_catalog: true}
+}
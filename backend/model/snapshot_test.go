@@ -0,0 +1,118 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+func makeOrigTree(t *testing.T, files []string) (orig string, root string) {
+	orig, err := ioutil.TempDir("", "snapshot_orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = ioutil.TempDir("", "snapshot_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		p := path.Join(orig, f)
+		os.MkdirAll(path.Dir(p), 0777)
+		ioutil.WriteFile(p, nil, 0777)
+	}
+	return
+}
+
+func countImages(db *Database) int {
+	n := 0
+	for _, dir := range db.Directories() {
+		n += len(dir.Images())
+	}
+	return n
+}
+
+func Test_CatalogSnapshot(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{
+		"a.jpg", "2001/b.jpg", "2001/c.jpg", "2001/2001-02-03/d.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+
+	db := NewDatabase2(orig, root, root)
+	if err := db.Load(true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Directories()) != 3 || countImages(db) != 4 {
+		t.Fatalf("loaded %d dirs, %d images", len(db.Directories()), countImages(db))
+	}
+
+	db = NewDatabase2(orig, root, root)
+	db.catalog = db.readCatalog()
+	if len(db.catalog) != 3 {
+		t.Fatalf("catalog has %d entries", len(db.catalog))
+	}
+	t0, _ := DirModTime(path.Join(orig, "2001"))
+	res := db.loadFromCatalog(&loaderLoad{rel_pat: "2001",
+		orgd_mtime: t0.Round(time.Second)})
+	if res == nil {
+		t.Fatal("unchanged directory not loaded from the catalog")
+	}
+	if len(res.dir.Images()) != 2 || len(res.orgd_subs) != 1 ||
+		res.orgd_subs[0].Name() != "2001-02-03" {
+		t.Errorf("bad catalog directory: %v %v", res.dir, res.orgd_subs)
+	}
+
+	// A changed directory falls back to its index.
+	t1 := t0.Add(time.Hour)
+	os.Chtimes(path.Join(orig, "2001"), t1, t1)
+	res = db.loadFromCatalog(&loaderLoad{rel_pat: "2001",
+		orgd_mtime: t1.Round(time.Second)})
+	if res != nil {
+		t.Error("changed directory loaded from the catalog")
+	}
+
+	// Same with a rewritten index.
+	t2 := time.Now().Add(time.Hour)
+	os.Chtimes(db.IndexPath(""), t2, t2)
+	t3, _ := DirModTime(orig)
+	res = db.loadFromCatalog(&loaderLoad{rel_pat: "",
+		orgd_mtime: t3.Round(time.Second)})
+	if res != nil {
+		t.Error("directory with a newer index loaded from the catalog")
+	}
+
+	db = NewDatabase2(orig, root, root)
+	if err := db.Load(false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Directories()) != 3 || countImages(db) != 4 {
+		t.Errorf("reloaded %d dirs, %d images", len(db.Directories()), countImages(db))
+	}
+}
+
+func Test_CatalogVersion(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+
+	db := NewDatabase2(orig, root, root)
+	if err := db.Load(true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if db.readCatalog() == nil {
+		t.Fatal("missing catalog")
+	}
+	data, _ := proto.Marshal(&store.Catalog{Version: proto.Int32(catalogVersion + 1)})
+	ioutil.WriteFile(db.CatalogPath(), data, 0777)
+	if db.readCatalog() != nil {
+		t.Error("read a catalog from another version")
+	}
+	ioutil.WriteFile(db.CatalogPath(), []byte("garbage"), 0777)
+	if db.readCatalog() != nil {
+		t.Error("read a corrupted catalog")
+	}
+}
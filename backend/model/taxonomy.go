@@ -0,0 +1,263 @@
+package model
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// The keyword hierarchy, built from the Lightroom hierarchical subjects of
+// the images ("Lieux|France|Paris") and from a Lightroom keyword list.  A
+// keyword query matches the images of the keyword and of all its
+// descendants.
+
+// Name of the keyword list in the static root, in the format of
+// Lightroom's Export Keywords: one keyword per line, indented by one tab
+// more than its parent, with its {synonyms} below it indented by one more
+// tab, and [categories] in brackets.
+const keywordListName = "keywords.txt"
+
+type KeywordNode struct {
+	name     string
+	children []*KeywordNode
+	synonyms []string
+}
+
+type Taxonomy struct {
+	root KeywordNode
+	// Nodes by their lowercase name and synonyms, with and without accents.
+	nodes map[string][]*KeywordNode
+}
+
+func NewTaxonomy() *Taxonomy {
+	return &Taxonomy{nodes: make(map[string][]*KeywordNode)}
+}
+
+func (tx *Taxonomy) addKey(key string, node *KeywordNode) {
+	for _, k := range []string{strings.ToLower(key), DropAccents(key, nil)} {
+		found := false
+		for _, n := range tx.nodes[k] {
+			found = found || n == node
+		}
+		if !found {
+			tx.nodes[k] = append(tx.nodes[k], node)
+		}
+	}
+}
+
+// The child of parent with name, created if needed.
+func (tx *Taxonomy) child(parent *KeywordNode, name string) *KeywordNode {
+	for _, c := range parent.children {
+		if c.name == name {
+			return c
+		}
+	}
+	node := &KeywordNode{name: name}
+	parent.children = append(parent.children, node)
+	tx.addKey(name, node)
+	return node
+}
+
+// Add a path of keywords from the top of the hierarchy.
+func (tx *Taxonomy) AddPath(names []string) {
+	node := &tx.root
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			node = tx.child(node, name)
+		}
+	}
+}
+
+func (tx *Taxonomy) addSynonym(node *KeywordNode, syn string) {
+	for _, s := range node.synonyms {
+		if s == syn {
+			return
+		}
+	}
+	node.synonyms = append(node.synonyms, syn)
+	tx.addKey(syn, node)
+}
+
+// A copy of tx that can be modified without changing tx.
+func (tx *Taxonomy) clone() *Taxonomy {
+	ntx := NewTaxonomy()
+	var copyChildren func(from *KeywordNode, to *KeywordNode)
+	copyChildren = func(from *KeywordNode, to *KeywordNode) {
+		for _, c := range from.children {
+			nc := ntx.child(to, c.name)
+			for _, syn := range c.synonyms {
+				ntx.addSynonym(nc, syn)
+			}
+			copyChildren(c, nc)
+		}
+	}
+	copyChildren(&tx.root, &ntx.root)
+	return ntx
+}
+
+// The index keys of the nodes named kwd and of their descendants, nil if
+// kwd is not in the hierarchy.
+func (tx *Taxonomy) subtreeKeys(kwd string) []string {
+	seen := make(map[*KeywordNode]bool)
+	keys := make(map[string]bool)
+	var walk func(node *KeywordNode)
+	walk = func(node *KeywordNode) {
+		if seen[node] {
+			return
+		}
+		seen[node] = true
+		keys[DropAccents(node.name, nil)] = true
+		for _, syn := range node.synonyms {
+			keys[DropAccents(syn, nil)] = true
+		}
+		for _, c := range node.children {
+			walk(c)
+		}
+	}
+	for _, node := range tx.nodes[kwd] {
+		walk(node)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(keys))
+	for key := range keys {
+		res = append(res, key)
+	}
+	return res
+}
+
+// Read a Lightroom keyword list.
+func ReadKeywordList(r io.Reader) (*Taxonomy, error) {
+	tx := NewTaxonomy()
+	// The last node seen at each depth, stack[0] is the root.
+	stack := []*KeywordNode{&tx.root}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		name := strings.TrimLeft(line, "\t")
+		depth := len(line) - len(name)
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+			// A synonym of the keyword above.
+			if depth > 0 && depth < len(stack) {
+				tx.addSynonym(stack[depth], strings.Trim(name, "{}"))
+			}
+			continue
+		}
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+		if depth >= len(stack) {
+			depth = len(stack) - 1
+		}
+		node := tx.child(stack[depth], name)
+		stack = append(stack[:depth+1], node)
+	}
+	return tx, scanner.Err()
+}
+
+// The keyword list of the static root, shared by all the indexes.
+var keyword_list atomic.Pointer[Taxonomy]
+
+func keywordList() *Taxonomy {
+	if tx := keyword_list.Load(); tx != nil {
+		return tx
+	}
+	return NewTaxonomy()
+}
+
+func LoadKeywordList(root string) {
+	list_path := path.Join(root, keywordListName)
+	fi, err := os.Open(list_path)
+	if os.IsNotExist(err) {
+		keyword_list.Store(nil)
+		return
+	} else if err != nil {
+		log.Printf("Error loading %s: %s\n", list_path, err.Error())
+		return
+	}
+	defer fi.Close()
+	tx, err := ReadKeywordList(fi)
+	if err != nil {
+		log.Printf("Error loading %s: %s\n", list_path, err.Error())
+		return
+	}
+	keyword_list.Store(tx)
+}
+
+// A node of the keyword tree returned to the apps.
+type JsonKeywordNode struct {
+	Name     string
+	Synonyms []string           `json:",omitempty"`
+	Count    int                // Images with the keyword or one of its descendants.
+	Children []*JsonKeywordNode `json:",omitempty"`
+}
+
+// The subtree of node with the image counts of idx, nil if it has no
+// images.  imgs receives the images of the subtree, sorted by rank.
+func (idx *Indexer) jsonKeywordNode(node *KeywordNode, imgs *[]*Image) *JsonKeywordNode {
+	jnode := &JsonKeywordNode{Name: node.name, Synonyms: node.synonyms}
+	sets := [][]*Image{}
+	for _, key := range append([]string{node.name}, node.synonyms...) {
+		sets = append(sets, idx.Images(DropAccents(key, nil)))
+	}
+	for _, c := range node.children {
+		var cimgs []*Image
+		if jc := idx.jsonKeywordNode(c, &cimgs); jc != nil {
+			jnode.Children = append(jnode.Children, jc)
+			sets = append(sets, cimgs)
+		}
+	}
+	*imgs = unionByRank(sets)
+	jnode.Count = len(*imgs)
+	if jnode.Count == 0 {
+		return nil
+	}
+	sort.Slice(jnode.Children, func(i, j int) bool {
+		return jnode.Children[i].Name < jnode.Children[j].Name
+	})
+	return jnode
+}
+
+// The keyword tree, with the subtrees of kwd only if kwd is not empty.
+// The keywords without images are left out.
+func (idx *Indexer) KeywordTree(kwd string) []*JsonKeywordNode {
+	var tops []*KeywordNode
+	if kwd == "" {
+		tops = idx.taxonomy.root.children
+	} else {
+		tops = idx.taxonomy.nodes[strings.ToLower(kwd)]
+	}
+	tree := []*JsonKeywordNode{}
+	for _, node := range tops {
+		var imgs []*Image
+		if jnode := idx.jsonKeywordNode(node, &imgs); jnode != nil {
+			tree = append(tree, jnode)
+		}
+	}
+	sort.Slice(tree, func(i, j int) bool { return tree[i].Name < tree[j].Name })
+	return tree
+}
+
+// The distinct images of some lists, sorted by rank.
+func unionByRank(sets [][]*Image) []*Image {
+	seen := make(map[*Image]bool)
+	var imgs []*Image
+	for _, set := range sets {
+		for _, img := range set {
+			if !seen[img] {
+				seen[img] = true
+				imgs = append(imgs, img)
+			}
+		}
+	}
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].Rank < imgs[j].Rank })
+	return imgs
+}
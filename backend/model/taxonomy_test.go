@@ -0,0 +1,122 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeSidecar(t *testing.T, p string, subjects []string, hierarchical []string) {
+	lis := func(vals []string) string {
+		s := ""
+		for _, v := range vals {
+			s += "<rdf:li>" + v + "</rdf:li>"
+		}
+		return s
+	}
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:lr="http://ns.adobe.com/lightroom/1.0/">
+   <dc:subject><rdf:Bag>` + lis(subjects) + `</rdf:Bag></dc:subject>
+   <lr:hierarchicalSubject><rdf:Bag>` + lis(hierarchical) + `</rdf:Bag></lr:hierarchicalSubject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+	if err := ioutil.WriteFile(p, []byte(xmp), 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queryNames(db *Database, q string) string {
+	var names []string
+	for img := range ParseQuery(q, db) {
+		names = append(names, img.Name())
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func Test_ReadKeywordList(t *testing.T) {
+	tx, err := ReadKeywordList(strings.NewReader(
+		"[Lieux]\n\tFrance\n\t\tParis\n\t\t\t{Paname}\n\t\tLyon\n\tItalie\nFamille\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.root.children) != 2 || tx.root.children[0].name != "Lieux" {
+		t.Fatalf("bad top keywords %v", tx.root.children)
+	}
+	keys := tx.subtreeKeys("france")
+	sort.Strings(keys)
+	if strings.Join(keys, " ") != "france lyon paname paris" {
+		t.Errorf("bad france keys %v", keys)
+	}
+	if keys = tx.subtreeKeys("paname"); len(keys) != 2 {
+		t.Errorf("bad paname keys %v", keys)
+	}
+	if tx.subtreeKeys("espagne") != nil {
+		t.Error("found a missing keyword")
+	}
+}
+
+func Test_KeywordHierarchy(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeTestJpeg(t, path.Join(orig, name), 8, 6)
+	}
+	writeSidecar(t, path.Join(orig, "a.xmp"),
+		[]string{"Paris"}, []string{"Lieux|France|Paris"})
+	writeSidecar(t, path.Join(orig, "b.xmp"),
+		[]string{"Julien"}, []string{"Famille|Devin|Julien"})
+	// c.jpg is only placed in the hierarchy by the keyword list.
+	writeSidecar(t, path.Join(orig, "c.xmp"), []string{"Lyon"}, nil)
+	ioutil.WriteFile(path.Join(root, keywordListName),
+		[]byte("Lieux\n\tFrance\n\t\tLyon\n\t\t\t{Lugdunum}\n\tItalie\n"), 0777)
+	defer keyword_list.Store(nil)
+
+	db := loadTestDatabase(t, orig, root)
+	for q, want := range map[string]string{
+		"france":   "a.jpg c.jpg",
+		"lieux":    "a.jpg c.jpg",
+		"fran":     "a.jpg c.jpg",
+		"lugdunum": "c.jpg",
+		"devin":    "b.jpg",
+		"paris":    "a.jpg",
+		"italie":   "",
+	} {
+		if got := queryNames(db, q); got != want {
+			t.Errorf("%s: got %q, want %q", q, got, want)
+		}
+	}
+
+	tree := db.Indexer().KeywordTree("")
+	if len(tree) != 2 || tree[0].Name != "Famille" || tree[1].Name != "Lieux" ||
+		tree[1].Count != 2 {
+		t.Fatalf("bad tree %+v", tree)
+	}
+	france := tree[1].Children[0]
+	if len(tree[1].Children) != 1 || france.Name != "France" || france.Count != 2 ||
+		len(france.Children) != 2 || france.Children[0].Name != "Lyon" ||
+		france.Children[0].Synonyms[0] != "Lugdunum" || france.Children[1].Count != 1 {
+		t.Errorf("bad france %+v", france)
+	}
+	if sub := db.Indexer().KeywordTree("devin"); len(sub) != 1 || sub[0].Count != 1 {
+		t.Errorf("bad devin subtree %+v", sub)
+	}
+
+	// Reloading a directory patches the hierarchy.
+	writeTestJpeg(t, path.Join(orig, "d.jpg"), 8, 6)
+	writeSidecar(t, path.Join(orig, "d.xmp"), []string{"Rome"}, []string{"Lieux|Italie|Rome"})
+	if err := db.ReloadDirectories([]string{""}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryNames(db.Snapshot(), "italie"); got != "d.jpg" {
+		t.Errorf("italie after reload: %q", got)
+	}
+}
@@ -0,0 +1,99 @@
+package model
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The full-text index of the titles and captions.  Words are lowercased,
+// without accents and lightly stemmed for French, so "Marchés" finds
+// "marché" and "marcher".
+
+// Words too common to be searched.
+var stopWords = map[string]bool{
+	"au": true, "aux": true, "avec": true, "ce": true, "ces": true,
+	"cet": true, "cette": true, "chez": true, "dans": true, "de": true,
+	"des": true, "du": true, "elle": true, "elles": true, "en": true,
+	"est": true, "et": true, "il": true, "ils": true, "je": true,
+	"la": true, "le": true, "les": true, "leur": true, "leurs": true,
+	"ma": true, "mes": true, "mon": true, "ne": true, "nos": true,
+	"notre": true, "nous": true, "on": true, "ou": true, "par": true,
+	"pas": true, "pour": true, "qui": true, "que": true, "sa": true,
+	"ses": true, "son": true, "sont": true, "sur": true, "ta": true,
+	"tes": true, "ton": true, "tu": true, "un": true, "une": true,
+	"vos": true, "votre": true, "vous": true,
+	"an": true, "and": true, "are": true, "at": true, "for": true,
+	"in": true, "is": true, "of": true, "or": true, "the": true,
+	"to": true, "with": true,
+}
+
+// Strip the plural, then the feminine ("ée" once without accents) or the
+// infinitive, keeping at least 3 letters.
+func stemWord(w string) string {
+	if len(w) > 3 && (strings.HasSuffix(w, "s") || strings.HasSuffix(w, "x")) {
+		w = w[:len(w)-1]
+	}
+	if strings.HasSuffix(w, "e") {
+		for len(w) > 3 && strings.HasSuffix(w, "e") {
+			w = w[:len(w)-1]
+		}
+	} else if len(w) > 4 && strings.HasSuffix(w, "er") {
+		w = w[:len(w)-2]
+	}
+	return w
+}
+
+// The distinct index keys of the words of s.
+func textKeys(s string, drop_cache map[string]string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		w = DropAccents(w, drop_cache)
+		if len(w) < 2 || stopWords[w] {
+			continue
+		}
+		if key := stemWord(w); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Calls f with the full-text keys of img.
+func imageTextKeys(img *Image, drop_cache map[string]string, f func(key string)) {
+	if img.title == "" && img.description == "" {
+		return
+	}
+	for _, key := range textKeys(img.title+" "+img.description, drop_cache) {
+		f(key)
+	}
+}
+
+// The images whose title or caption has the word of key, sorted by rank.
+func (idx *Indexer) ImagesWithText(key string) []*Image {
+	return idx.images_by_text[key]
+}
+
+// The images whose title or caption has all the words of s.
+func TextQuery(db *Database, s string) Query {
+	keys := textKeys(s, nil)
+	if len(keys) == 0 {
+		return EmptyQuery(db)
+	}
+	qs := make([]Query, len(keys))
+	for i, key := range keys {
+		q := make(chan *Image)
+		go func(q chan *Image, imgs []*Image) {
+			defer close(q)
+			for _, img := range imgs {
+				q <- img
+			}
+		}(q, db.Indexer().ImagesWithText(key))
+		qs[i] = q
+	}
+	return AndQuery(qs)
+}
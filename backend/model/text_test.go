@@ -0,0 +1,129 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Insert a Photoshop APP13 segment with the IPTC datasets of record 2
+// after the SOI marker of a JPEG file.
+func embedIptc(t *testing.T, p string, datasets map[byte]string) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var iim bytes.Buffer
+	for _, num := range []byte{5, 25, 120} {
+		if val, ok := datasets[num]; ok {
+			iim.Write([]byte{0x1C, 2, num})
+			binary.Write(&iim, binary.BigEndian, uint16(len(val)))
+			iim.WriteString(val)
+		}
+	}
+	var payload bytes.Buffer
+	payload.WriteString("Photoshop 3.0\x00")
+	payload.WriteString("8BIM")
+	payload.Write([]byte{0x04, 0x04, 0, 0})
+	binary.Write(&payload, binary.BigEndian, uint32(iim.Len()))
+	payload.Write(iim.Bytes())
+	if iim.Len()%2 != 0 {
+		payload.WriteByte(0)
+	}
+	var seg bytes.Buffer
+	seg.Write([]byte{0xFF, 0xED})
+	binary.Write(&seg, binary.BigEndian, uint16(payload.Len()+2))
+	seg.Write(payload.Bytes())
+	out := append(append(append([]byte{}, data[:2]...), seg.Bytes()...), data[2:]...)
+	if err = ioutil.WriteFile(p, out, 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_TextKeys(t *testing.T) {
+	for s, want := range map[string][]string{
+		"Le marché de Noël":             {"march", "noel"},
+		"Marchés, marcher et marchées!": {"march"},
+		"Les chevaux à l'Étang":         {"chevau", "etang"},
+		"The kids in 2024":              {"kid", "2024"},
+		"de la":                         nil,
+	} {
+		if got := textKeys(s, nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", s, got, want)
+		}
+	}
+}
+
+func Test_TextQueries(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	b := path.Join(orig, "b.jpg")
+	writeTestJpeg(t, b, 8, 6)
+	a := path.Join(orig, "a.jpg")
+	writeTestJpeg(t, a, 8, 6)
+	embedIptc(t, a, map[byte]string{
+		5:   "Marché de Noël",
+		25:  "Lyon",
+		120: "Les santons au marché"})
+	// A Latin-1 caption, and a title overridden by the XMP.
+	c := path.Join(orig, "c.jpg")
+	writeTestJpeg(t, c, 8, 6)
+	embedIptc(t, c, map[byte]string{5: "Oubli", 120: "La f\xeate du village"})
+	embedXmp(t, c, `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Santons</rdf:li></rdf:Alt></dc:title>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`)
+
+	_, _, kwds, title, caption, err := GetImageInfo2(a)
+	if err != nil || title != "Marché de Noël" || caption != "Les santons au marché" ||
+		!reflect.DeepEqual(kwds, []string{"Lyon"}) {
+		t.Errorf("bad info %v %q %q %v", kwds, title, caption, err)
+	}
+
+	db := loadTestDatabase(t, orig, root)
+	if itm := indexItem(t, db, "c.jpg"); itm.GetTitle() != "Santons" ||
+		itm.GetDescription() != "La fête du village" {
+		t.Errorf("bad item %v", itm)
+	}
+	var jimg JsonImage
+	imageNamed(db, "a.jpg").Json(&jimg)
+	if jimg.Ttl != "Marché de Noël" || jimg.Cap != "Les santons au marché" {
+		t.Errorf("bad json %+v", jimg)
+	}
+
+	for q, want := range map[string]string{
+		"text:marches":       "a.jpg",
+		"text:santon":        "a.jpg c.jpg",
+		"\"text:fete noel\"": "",
+		"text:FÊTES":         "c.jpg",
+		"text:de":            "",
+		"santons":            "a.jpg c.jpg",
+		"lyon":               "a.jpg",
+		"village":            "c.jpg",
+	} {
+		if got := queryNames(db, q); got != want {
+			t.Errorf("%q: got %q, want %q", q, got, want)
+		}
+	}
+
+	// Patching the index for a changed caption.
+	embedIptc(t, b, map[byte]string{120: "Noël"})
+	tm := time.Now().Add(time.Hour)
+	os.Chtimes(b, tm, tm)
+	if err := db.ReloadDirectories([]string{""}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, db)
+	if got := queryNames(db, "text:noel"); got != "a.jpg b.jpg" {
+		t.Errorf("index not patched: %q", got)
+	}
+}
@@ -0,0 +1,132 @@
+package model
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
+)
+
+import "github.com/golang/protobuf/proto"
+import "github.com/rwcarlsen/goexif/exif"
+import "github.com/rwcarlsen/goexif/tiff"
+
+// Capture times are stored as instants with the UTC offset of the place
+// they were taken, and the date queries compare the local dates and
+// times of the photos.
+
+var time_zone = flag.String("time_zone", "America/Los_Angeles",
+	"Time zone of the capture times without UTC offset and of the dates in album names.")
+
+// The EXIF 2.31 offset tags, unknown to goexif.
+const (
+	exifOffsetTime          exif.FieldName = "OffsetTime"
+	exifOffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	exifOffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var offsetFields = map[uint16]exif.FieldName{
+	0x9010: exifOffsetTime,
+	0x9011: exifOffsetTimeOriginal,
+	0x9012: exifOffsetTimeDigitized,
+}
+
+// Loads the offset tags of the Exif IFD.
+type offsetTimeParser struct{}
+
+func (offsetTimeParser) Parse(x *exif.Exif) error {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err = r.Seek(offset, 0); err != nil {
+		return nil
+	}
+	// goexif already reports the errors of the Exif IFD.
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, offsetFields, false)
+	return nil
+}
+
+func init() {
+	exif.RegisterParsers(offsetTimeParser{})
+}
+
+// The capture time fields by decreasing preference, with their
+// sub-second and offset fields.
+var exifTimeFields = []struct {
+	time, subsec, offset exif.FieldName
+}{
+	{exif.DateTimeOriginal, exif.SubSecTimeOriginal, exifOffsetTimeOriginal},
+	{exif.DateTimeDigitized, exif.SubSecTimeDigitized, exifOffsetTimeDigitized},
+	{exif.DateTime, exif.SubSecTime, exifOffsetTime},
+}
+
+var locations sync.Map // Zone name to *time.Location.
+
+// The zone of the times without offset.
+func defaultLocation() *time.Location {
+	name := *time_zone
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Bad time zone %q, using PST: %s\n", name, err.Error())
+		loc = time.FixedZone("PST", -8*3600)
+	}
+	locations.Store(name, loc)
+	return loc
+}
+
+// The zone of an item with a UTC offset in seconds, the default zone if
+// it has none.
+func itemLocation(offset *int32) *time.Location {
+	if offset == nil {
+		return defaultLocation()
+	}
+	return time.FixedZone("", int(*offset))
+}
+
+// The UTC offset of t in the default zone.
+func defaultOffset(t time.Time) *int32 {
+	_, offset := t.In(defaultLocation()).Zone()
+	return proto.Int32(int32(offset))
+}
+
+// Parse an EXIF offset like "+02:00".
+func parseExifOffset(s string) (int32, bool) {
+	s = strings.TrimSpace(strings.Trim(s, "\x00"))
+	if len(s) != 6 || (s[0] != '+' && s[0] != '-') || s[3] != ':' {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(s[1:3])
+	m, err2 := strconv.Atoi(s[4:6])
+	if err1 != nil || err2 != nil || h > 14 || m > 59 {
+		return 0, false
+	}
+	offset := int32(h*3600 + m*60)
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return offset, true
+}
+
+// The wall clock of t in its zone, as a UTC time.
+func wallClock(t time.Time) time.Time {
+	y, m, d := t.Date()
+	h, mi, s := t.Clock()
+	return time.Date(y, m, d, h, mi, s, t.Nanosecond(), time.UTC)
+}
@@ -0,0 +1,103 @@
+package model
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+func writeTimedJpeg(t *testing.T, p string, datetime, subsec, offset string) {
+	writeTestJpeg(t, p, 8, 6)
+	exif_ifd := []tiffEntry{asciiEntry(0x9003, datetime)}
+	if subsec != "" {
+		exif_ifd = append(exif_ifd, asciiEntry(0x9291, subsec))
+	}
+	if offset != "" {
+		exif_ifd = append(exif_ifd, asciiEntry(0x9011, offset))
+	}
+	setExif(t, p, nil, exif_ifd)
+}
+
+func Test_ParseExifOffset(t *testing.T) {
+	for s, want := range map[string]int32{"+02:00": 7200, "-07:00": -25200, "+05:30": 19800} {
+		if got, ok := parseExifOffset(s); !ok || got != want {
+			t.Errorf("%q: got %d", s, got)
+		}
+	}
+	for _, s := range []string{"", "02:00", "+2:00", "+02:60", "   :  "} {
+		if _, ok := parseExifOffset(s); ok {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func Test_LocalTimes(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	// Just after midnight in Paris, still the day before in California.
+	writeTimedJpeg(t, path.Join(orig, "paris.jpg"), "2024:07:01 00:30:00", "25", "+02:00")
+	writeTimedJpeg(t, path.Join(orig, "home.jpg"), "2024:07:01 00:30:00", "", "")
+
+	db := loadTestDatabase(t, orig, root)
+	paris := imageNamed(db, "paris.jpg")
+	want := time.Date(2024, 6, 30, 22, 30, 0, 250*int(time.Millisecond), time.UTC)
+	if !paris.ItemTime().Equal(want) {
+		t.Errorf("bad time %s, want %s", paris.ItemTime(), want)
+	}
+	if _, offset := paris.ItemTime().Zone(); offset != 7200 {
+		t.Errorf("bad offset %d", offset)
+	}
+	if itm := indexItem(t, db, "paris.jpg"); itm.GetUtcOffset() != 7200 {
+		t.Errorf("offset not indexed: %v", itm)
+	}
+	home := imageNamed(db, "home.jpg")
+	if la, _ := time.LoadLocation("America/Los_Angeles"); !home.ItemTime().Equal(
+		time.Date(2024, 7, 1, 0, 30, 0, 0, la)) {
+		t.Errorf("bad default zone time %s", home.ItemTime())
+	}
+
+	for q, want := range map[string]string{
+		"2024-07-01": "home.jpg paris.jpg",
+		"2024-06-30": "",
+		"2024-07":    "home.jpg paris.jpg",
+		"07-01":      "home.jpg paris.jpg",
+		"2024":       "home.jpg paris.jpg",
+		"2023":       "",
+	} {
+		if got := queryNames(db, q); got != want {
+			t.Errorf("%q: got %q, want %q", q, got, want)
+		}
+	}
+}
+
+// The EXIF times used to be stored as UTC times.
+func Test_MigrateUtcOffsets(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTimedJpeg(t, path.Join(orig, "paris.jpg"), "2024:07:01 00:30:00", "", "+02:00")
+	old_time := time.Date(2024, 7, 1, 0, 30, 0, 0, time.UTC)
+	file_time := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	sdir := &store.Directory{Items: []*store.Item{
+		{Name: proto.String("paris.jpg"), ItemTimestamp: proto.Int64(TimeToProto(old_time))},
+		{Name: proto.String("gone.jpg"), ItemTimestamp: proto.Int64(TimeToProto(file_time))},
+	}}
+	if err := migrateUtcOffsets(newOriginals(orig), "", sdir); err != nil {
+		t.Fatal(err)
+	}
+	paris := sdir.Items[0]
+	if paris.GetUtcOffset() != 7200 ||
+		!ProtoToTime(paris.GetItemTimestamp()).Equal(old_time.Add(-2*time.Hour)) {
+		t.Errorf("bad migrated item %v", paris)
+	}
+	// Winter in California.
+	if gone := sdir.Items[1]; gone.GetUtcOffset() != -8*3600 ||
+		!ProtoToTime(gone.GetItemTimestamp()).Equal(file_time) {
+		t.Errorf("bad migrated item %v", gone)
+	}
+}
@@ -1,13 +1,15 @@
 package model
 
 import (
+  "fmt"
+  "hash/fnv"
 	"log"
   "os"
   "path"
   "strings"
 )
 
-// import "github.com/golang/protobuf/proto"
+import "github.com/golang/protobuf/proto"
 import "toutizes.com/go-photwo/backend/store"
 
 const (
@@ -23,19 +25,20 @@ var ignored_names = map[string]bool{
   // iPhoto names.
   "Data":true, "Albums":true, "Desktop":true, "Originals":true, "Thumbs":true}
   
+var image_exts = map[string]bool{
+  ".jpg": true, ".jpeg": true, ".gif": true, ".png": true, ".bmp": true,
+  ".tif": true, ".tiff": true, ".webp": true}
+
+// The extensions are case-insensitive.
 func isImageName(name string) bool {
-  return strings.HasSuffix(name, ".jpg") ||
-    strings.HasSuffix(name, ".JPG") ||
-    strings.HasSuffix(name, ".jpeg") ||
-    strings.HasSuffix(name, ".BMP") ||
-    strings.HasSuffix(name, ".TIF") ||
-    strings.HasSuffix(name, ".gif") ||
-    strings.HasSuffix(name, ".GIF")
+  return image_exts[strings.ToLower(path.Ext(name))]
 }
 
+var video_exts = map[string]bool{
+  ".webm": true, ".mkv": true, ".mp4": true, ".m4v": true, ".mov": true}
+
 func isVideoName(name string) bool {
-  return strings.HasSuffix(name, ".webm") ||
-    strings.HasSuffix(name, ".WEBM")
+  return video_exts[strings.ToLower(path.Ext(name))]
 }
 
 func fileType(file os.FileInfo) int {
@@ -75,11 +78,24 @@ func makeVideo(file os.FileInfo) *store.Item {
 }
 
 func filterEntries(files []os.FileInfo) (imgs []*store.Item, vids []*store.Item, dirs []string) {
+  sidecars := make(map[string]int64)
   for _, file := range files {
     switch fileType(file) {
     case ft_dir: dirs = append(dirs, file.Name())
     case ft_img: imgs = append(imgs, makeImage(file))
     case ft_vid: vids = append(vids, makeVideo(file))
+    case ft_ign:
+      if strings.HasSuffix(file.Name(), ".xmp") {
+        sidecars[file.Name()] = TimeToProto(file.ModTime())
+      }
+    }
+  }
+  // Reload the images when their sidecar changes.
+  for _, img := range imgs {
+    for _, name := range sidecarNames(*img.Name) {
+      if ts, ok := sidecars[name]; ok && ts > *img.FileTimestamp {
+        img.FileTimestamp = proto.Int64(ts)
+      }
     }
   }
   return
@@ -88,25 +104,45 @@ func filterEntries(files []os.FileInfo) (imgs []*store.Item, vids []*store.Item,
 func mergeVideo(old_vid *store.Item, new_vid *store.Item) *store.Item {
   if old_vid != nil {
     new_vid.Keywords = old_vid.Keywords
-    new_vid.ItemTimestamp = old_vid.ItemTimestamp
+    new_vid.KeywordOverrides = old_vid.KeywordOverrides
+    new_vid.Id = old_vid.Id
+    if new_vid.ItemTimestamp == nil {
+      new_vid.ItemTimestamp = old_vid.ItemTimestamp
+    }
+    if new_vid.Video.DurationMs == nil && old_vid.Video != nil {
+      new_vid.Video = old_vid.Video
+    }
   }
   return new_vid
 }
 
-func mergeImage(old_img *store.Item, new_img *store.Item) *store.Item {
+// Merge the old version of an image in the new one.  reread is true when
+// new_img was read from its file: its metadata then replaces the old one
+// even when unset, so that the hierarchical keywords, titles, captions,
+// ratings, flags, orientations, locations and cameras cleared in the file
+// are cleared in the index.
+func mergeImage(old_img *store.Item, new_img *store.Item, reread bool) *store.Item {
   if old_img != nil {
+    // Keep the id across file edits.
+    new_img.Id = old_img.Id
     if len(new_img.Keywords) == 0 {
-      // Did not find keywords in the image, use old ones, but filter some.
-			for _, kwd := range old_img.Keywords {
-				kwd = strings.Replace(kwd, "\n", "", -1)
-				if len(kwd) > 0 {
-					new_img.Keywords = append(new_img.Keywords, kwd)
-				}
-			}
+      // Did not find keywords in the image, use old ones.
+      new_img.Keywords = old_img.Keywords
+    }
+    // The edits made through the API apply to the keywords read again.
+    new_img.KeywordOverrides = old_img.KeywordOverrides
+    new_img.Keywords = applyOverrides(new_img.Keywords, new_img.KeywordOverrides)
+    if !reread {
+      new_img.HierarchicalKeywords = old_img.HierarchicalKeywords
+      new_img.Title = old_img.Title
+      new_img.Description = old_img.Description
+      new_img.Rating = old_img.Rating
+      new_img.Pick = old_img.Pick
     }
     if new_img.ItemTimestamp == nil {
       // Did not find item timestamp in image, use old one.
       new_img.ItemTimestamp = old_img.ItemTimestamp
+      new_img.UtcOffset = old_img.UtcOffset
     }
 		if old_img.Image != nil {
 			if old_img.Image.Stereo != nil {
@@ -115,10 +151,16 @@ func mergeImage(old_img *store.Item, new_img *store.Item) *store.Item {
 			if old_img.Image.RotateDegrees != nil {
 				new_img.Image.RotateDegrees = old_img.Image.RotateDegrees
 			}
-			if old_img.Image.Height != nil {
+			if !reread {
+				new_img.Image.Orientation = old_img.Image.Orientation
+				new_img.Image.Location = old_img.Image.Location
+				new_img.Image.Camera = old_img.Image.Camera
+			}
+			// The image could not be read, keep its old dimensions.
+			if new_img.Image.Height == nil {
 				new_img.Image.Height = old_img.Image.Height
 			}
-			if old_img.Image.Width != nil {
+			if new_img.Image.Width == nil {
 				new_img.Image.Width = old_img.Image.Width
 			}
 		}
@@ -128,35 +170,178 @@ func mergeImage(old_img *store.Item, new_img *store.Item) *store.Item {
 
 func UpdateDirectory(origd string, subs []os.FileInfo, force_reload bool, 
 	                   sdir *store.Directory) error {
+  _, err := updateDirectory(origd, subs, force_reload, sdir)
+  return err
+}
+
+// Like UpdateDirectory, also returns the removed items whose ids were not
+// given to a renamed item, see inheritMovedIds.
+func updateDirectory(origd string, subs []os.FileInfo, force_reload bool,
+                     sdir *store.Directory) ([]*store.Item, error) {
   old_itms := make(map[string]*store.Item, len(sdir.Items))
   for _, itm := range sdir.Items {
     old_itms[*itm.Name] = itm
   }
   imgs, vids, dirs := filterEntries(subs)
   sdir.SubDirectories = dirs
+  updateAlbumFile(origd, sdir)
 
   new_items := make([]*store.Item, 0, len(imgs) + len(vids))
+  seen := make(map[string]bool, len(imgs) + len(vids))
 
   for _, new_vid := range vids {
-    old_vid, _ := old_itms[*new_vid.Name]
+    old_vid, ok := old_itms[*new_vid.Name]
+    seen[*new_vid.Name] = true
+    if !ok || old_vid.FileTimestamp == nil ||
+      *old_vid.FileTimestamp != *new_vid.FileTimestamp || force_reload {
+      err := LoadVideoFile(path.Join(origd, *new_vid.Name), new_vid)
+      if err != nil {
+        log.Printf("%s: %s\n", path.Join(origd, *new_vid.Name), err.Error())
+      }
+    }
     new_items = append(new_items, mergeVideo(old_vid, new_vid))
   }
 
   for _, new_img := range imgs {
     old_img, ok := old_itms[*new_img.Name]
+    seen[*new_img.Name] = true
+    reread := false
     if !ok || old_img.FileTimestamp == nil || 
       *old_img.FileTimestamp != *new_img.FileTimestamp || force_reload {
       err := LoadImageFile(path.Join(origd, *new_img.Name), new_img)
 			if err != nil {
 				log.Printf("%s: %s\n", path.Join(origd, *new_img.Name), err.Error())
 			}
+      reread = err == nil
     }
-    new_items = append(new_items, mergeImage(old_img, new_img))
+    new_items = append(new_items, mergeImage(old_img, new_img, reread))
 		if len(new_img.Keywords) == 0 {
 			log.Printf("%s: no keywords\n", path.Join(origd, *new_img.Name))
 		}
   }
 
+  removed := make([]*store.Item, 0)
+  for _, itm := range sdir.Items {
+    if !seen[*itm.Name] {
+      removed = append(removed, itm)
+    }
+  }
+  removed = inheritRenamedIds(removed, new_items)
+
   sdir.Items = new_items
-  return nil
+  return removed, nil
+}
+
+// Key used to recognize a renamed image: same capture time and same
+// dimensions.
+func renameKey(itm *store.Item) (key string, ok bool) {
+  if itm.Image == nil || itm.ItemTimestamp == nil {
+    return "", false
+  }
+  return fmt.Sprintf("%d/%dx%d", *itm.ItemTimestamp, itm.Image.GetHeight(),
+    itm.Image.GetWidth()), true
+}
+
+// Give the ids of the removed items to the new items without ids when
+// they look like the same image under a new name.  Only unambiguous
+// matches are used.  Returns the removed items whose ids were not given.
+func inheritRenamedIds(removed []*store.Item, items []*store.Item) []*store.Item {
+  if len(removed) == 0 {
+    return nil
+  }
+  old_by_key := make(map[string][]*store.Item)
+  for _, itm := range removed {
+    if key, ok := renameKey(itm); ok && itm.Id != nil {
+      old_by_key[key] = append(old_by_key[key], itm)
+    }
+  }
+  new_by_key := make(map[string][]*store.Item)
+  for _, itm := range items {
+    if key, ok := renameKey(itm); ok && itm.Id == nil {
+      new_by_key[key] = append(new_by_key[key], itm)
+    }
+  }
+  inherited := make(map[*store.Item]bool)
+  for key, olds := range old_by_key {
+    news := new_by_key[key]
+    if len(olds) == 1 && len(news) == 1 {
+      log.Printf("Renamed %s to %s\n", *olds[0].Name, *news[0].Name)
+      news[0].Id = olds[0].Id
+      inherited[olds[0]] = true
+    }
+  }
+  var left []*store.Item
+  for _, itm := range removed {
+    if !inherited[itm] {
+      left = append(left, itm)
+    }
+  }
+  return left
+}
+
+// The rename keys of the items of sdir without ids, by name.
+func unassignedKeys(sdir *store.Directory) map[string]string {
+  keys := make(map[string]string)
+  for _, itm := range sdir.Items {
+    if key, ok := renameKey(itm); ok && itm.Id == nil {
+      keys[itm.GetName()] = key
+    }
+  }
+  return keys
+}
+
+// Give the ids of the items removed from the directories of a load to
+// the images that got a new id in another directory of the same load,
+// when they look like the same image moved there.  Only unambiguous
+// matches are used.  An image moved to a directory loaded before the one
+// it left gets a new id.
+func inheritMovedIds(results []*loaderResult) {
+  old_by_key := make(map[string][]*store.Item)
+  for _, res := range results {
+    for _, itm := range res.removed {
+      if key, ok := renameKey(itm); ok && itm.Id != nil {
+        old_by_key[key] = append(old_by_key[key], itm)
+      }
+    }
+  }
+  if len(old_by_key) == 0 {
+    return
+  }
+  new_by_key := make(map[string][]*Image)
+  for _, res := range results {
+    if res.dir == nil {
+      continue
+    }
+    for _, img := range res.dir.images {
+      if key, ok := res.new_keys[img.Name()]; ok {
+        new_by_key[key] = append(new_by_key[key], img)
+      }
+    }
+  }
+  for key, olds := range old_by_key {
+    news := new_by_key[key]
+    if len(olds) == 1 && len(news) == 1 {
+      log.Printf("Moved %s to %s/%s\n", olds[0].GetName(), news[0].dir.RelPat(),
+        news[0].Name())
+      news[0].Id = int(olds[0].GetId())
+      news[0].dir.ids_changed = true
+    }
+  }
+}
+
+// Give an id to the items that do not have one yet.  New items get the id
+// they would have had before ids were stored in the index so that existing
+// links keep working.  Returns true if any id was assigned.
+func assignIds(rel_pat string, sdir *store.Directory) bool {
+  hasher := fnv.New32a()
+  assigned := false
+  for _, itm := range sdir.Items {
+    if itm.Id == nil {
+      id := legacyImageId(hasher, rel_pat, itm.GetName(),
+        ProtoToTime(itm.GetFileTimestamp()))
+      itm.Id = proto.Int64(int64(id))
+      assigned = true
+    }
+  }
+  return assigned
 }
@@ -8,6 +8,7 @@ import (
   "time"
 )
 
+import "github.com/golang/protobuf/proto"
 import "toutizes.com/go-photwo/backend/store"
 
 func makeDir(t *testing.T, prefix string, files []string) (pat string, mod_time time.Time) {
@@ -44,7 +45,7 @@ func Test_MergeImage(t *testing.T) {
   old_img := testImage([]string{"a", "b"}, 123)
   var mrg_img *store.Item
 
-  mrg_img = mergeImage(old_img, testImageNoTs(nil))
+  mrg_img = mergeImage(old_img, testImageNoTs(nil), false)
   if len(mrg_img.Keywords) != 2 {
     t.Error("kwds")
   }
@@ -52,7 +53,7 @@ func Test_MergeImage(t *testing.T) {
     t.Error("ts")
   }
 
-  mrg_img = mergeImage(old_img, testImage(nil, 456))
+  mrg_img = mergeImage(old_img, testImage(nil, 456), true)
   if len(mrg_img.Keywords) != 2 {
     t.Error("kwds")
   }
@@ -60,7 +61,7 @@ func Test_MergeImage(t *testing.T) {
     t.Error("ts")
   }
 
-  mrg_img = mergeImage(old_img, testImage([]string{"z"}, 789))
+  mrg_img = mergeImage(old_img, testImage([]string{"z"}, 789), true)
   if len(mrg_img.Keywords) != 1 {
     t.Error("kwds")
   }
@@ -69,13 +70,67 @@ func Test_MergeImage(t *testing.T) {
   }
 }
 
-func findItem(sdir *store.Directory, name string) *store.Item {
-  for _, it := range sdir.Items {
-    if *it.Name == name {
-      return it
-    }
+// A rating or a flag cleared in the file is cleared in the index, they are
+// kept when the file was not read.
+func Test_MergeRating(t *testing.T) {
+  old_img := &store.Item{Rating:proto.Int32(4), Pick:proto.Int32(-1)}
+  if mrg_img := mergeImage(old_img, &store.Item{}, true); mrg_img.Rating != nil || mrg_img.Pick != nil {
+    t.Errorf("rating or pick not cleared %v", mrg_img)
+  }
+  if mrg_img := mergeImage(old_img, &store.Item{}, false); mrg_img.GetRating() != 4 || mrg_img.GetPick() != -1 {
+    t.Errorf("rating or pick lost %v", mrg_img)
+  }
+}
+
+func Test_MergeCaptions(t *testing.T) {
+  old_img := &store.Item{Title:proto.String("Lyon"), Description:proto.String("Chez les cousins.")}
+  if mrg_img := mergeImage(old_img, &store.Item{}, true); mrg_img.Title != nil || mrg_img.Description != nil {
+    t.Errorf("title or description not cleared %v", mrg_img)
+  }
+  if mrg_img := mergeImage(old_img, &store.Item{}, false); mrg_img.GetTitle() != "Lyon" ||
+    mrg_img.GetDescription() != "Chez les cousins." {
+    t.Errorf("title or description lost %v", mrg_img)
+  }
+}
+
+func Test_MergeHierarchicalKeywords(t *testing.T) {
+  old_img := &store.Item{HierarchicalKeywords:[]string{"lieux|france|lyon"}}
+  if mrg_img := mergeImage(old_img, &store.Item{}, true); len(mrg_img.HierarchicalKeywords) != 0 {
+    t.Errorf("hierarchical keywords not cleared %v", mrg_img)
+  }
+  if mrg_img := mergeImage(old_img, &store.Item{}, false); len(mrg_img.HierarchicalKeywords) != 1 {
+    t.Errorf("hierarchical keywords lost %v", mrg_img)
+  }
+}
+
+func Test_MergeExif(t *testing.T) {
+  old_img := &store.Item{Image:&store.Image{Orientation:proto.Int32(6),
+    Location:&store.Location{Latitude:proto.Float64(45.76), Longitude:proto.Float64(4.84)},
+    Camera:&store.Camera{Model:proto.String("X100")}}}
+  if mrg_img := mergeImage(old_img, &store.Item{Image:&store.Image{}}, true);
+    mrg_img.Image.Orientation != nil || mrg_img.Image.Location != nil || mrg_img.Image.Camera != nil {
+    t.Errorf("orientation, location or camera not cleared %v", mrg_img.Image)
+  }
+  if mrg_img := mergeImage(old_img, &store.Item{Image:&store.Image{}}, false);
+    mrg_img.Image.GetOrientation() != 6 || mrg_img.Image.Location == nil || mrg_img.Image.Camera == nil {
+    t.Errorf("orientation, location or camera lost %v", mrg_img.Image)
+  }
+}
+
+// The dimensions read again replace the old ones, they are kept only when
+// the image could not be read.
+func Test_MergeDimensions(t *testing.T) {
+  old_img := &store.Item{Image:&store.Image{Height:proto.Int32(0), Width:proto.Int32(0)}}
+  new_img := &store.Item{Image:&store.Image{Height:proto.Int32(6), Width:proto.Int32(8)}}
+  if mrg_img := mergeImage(old_img, new_img, true); mrg_img.Image.GetHeight() != 6 ||
+    mrg_img.Image.GetWidth() != 8 {
+    t.Errorf("bad dimensions %v", mrg_img.Image)
+  }
+  old_img = &store.Item{Image:&store.Image{Height:proto.Int32(6), Width:proto.Int32(8)}}
+  if mrg_img := mergeImage(old_img, &store.Item{Image:&store.Image{}}, false); mrg_img.Image.GetHeight() != 6 ||
+    mrg_img.Image.GetWidth() != 8 {
+    t.Errorf("old dimensions lost %v", mrg_img.Image)
   }
-  return nil
 }
 
 func Test_UpdateDir(t *testing.T) {
@@ -85,7 +140,7 @@ func Test_UpdateDir(t *testing.T) {
   {
     sdir := store.Directory{}
     subs, _ := ioutil.ReadDir(dir)
-    _ = UpdateDirectory(subs, &sdir)
+    _ = UpdateDirectory(dir, subs, false, &sdir)
     
     if len(sdir.Items) != 3 {
       t.Error("num items")
@@ -93,7 +148,7 @@ func Test_UpdateDir(t *testing.T) {
     for _, name := range []string{"foo.jpg", "bar.webm",  "gee.JPG"} {
       it := findItem(&sdir, name)
       if it == nil {
-        t.Error("missing item %s", name)
+        t.Errorf("missing item %s", name)
       }
     }
   }
@@ -104,7 +159,7 @@ func Test_UpdateDir(t *testing.T) {
       testNamedImage("gee.JPG", []string{"ba ba"}),
     }}
     subs, _ := ioutil.ReadDir(dir)
-    _ = UpdateDirectory(subs, &sdir)
+    _ = UpdateDirectory(dir, subs, false, &sdir)
     
     if len(sdir.Items) != 3 {
       t.Error("num items")
@@ -112,7 +167,7 @@ func Test_UpdateDir(t *testing.T) {
     for _, name := range []string{"foo.jpg", "bar.webm",  "gee.JPG"} {
       it := findItem(&sdir, name)
       if it == nil {
-        t.Error("missing item %s", name)
+        t.Errorf("missing item %s", name)
       }
     }
     gee := findItem(&sdir, "gee.JPG")
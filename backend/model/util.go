@@ -1,19 +1,27 @@
 package model
 
 import (
+  "io/ioutil"
   "os"
+  "path"
+  "strings"
   "time"
 )
 
 // Convert between proto time and time.Time
 func ProtoToTime(ptime int64) time.Time {
-  return time.Unix(ptime / 1000, 0)
+  return time.UnixMilli(ptime)
 }
 
 func TimeToProto(t time.Time) int64 { 
   return 1000 * t.Unix()
 }
 
+// Item times keep their milliseconds, from the EXIF sub-second times.
+func ItemTimeToProto(t time.Time) int64 {
+  return t.UnixMilli()
+}
+
 func DirModTime(dir string) (time time.Time, err error) {
   file, err := os.Open(dir)
   if err != nil {
@@ -37,3 +45,40 @@ func ChangedSince(path string, timestamp time.Time) (changed bool, err error) {
   changed = t.After(timestamp)
   return
 }
+
+// Write data to a temporary file next to "name" and rename it over "name",
+// so that readers never see a partially written file.  The file gets perm
+// as is, without the umask: pass 0644 for the files of the database.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+  tmp, err := ioutil.TempFile(path.Dir(name), "."+path.Base(name)+".tmp")
+  if err != nil {
+    return err
+  }
+  _, err = tmp.Write(data)
+  if err == nil {
+    err = tmp.Sync()
+  }
+  if cerr := tmp.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    err = os.Chmod(tmp.Name(), perm)
+  }
+  if err == nil {
+    err = os.Rename(tmp.Name(), name)
+  }
+  if err != nil {
+    os.Remove(tmp.Name())
+  }
+  return err
+}
+
+// Whether name is a temporary file of WriteFileAtomic, left by a crash if
+// it is still there when nothing writes.
+func isAtomicTempName(name string) bool {
+  i := strings.LastIndex(name, ".tmp")
+  if !strings.HasPrefix(name, ".") || i < 0 || i + 4 == len(name) {
+    return false
+  }
+  return strings.Trim(name[i + 4:], "0123456789") == ""
+}
@@ -0,0 +1,298 @@
+package model
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// What is read from the header of a video file.
+type videoInfo struct {
+	duration time.Duration
+	width    int
+	height   int
+	created  time.Time // Zero if unknown.
+}
+
+// Matroska (and WebM) element ids.
+const (
+	mkvEBML          = 0x1A45DFA3
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDuration      = 0x4489
+	mkvDateUTC       = 0x4461
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+	mkvCluster       = 0x1F43B675
+)
+
+// Elements whose children are read, the others are skipped.
+var mkvMasters = map[uint64]bool{
+	mkvSegment: true, mkvInfo: true, mkvTracks: true, mkvTrackEntry: true,
+	mkvVideo: true,
+}
+
+// Read an EBML variable length integer.  Ids keep their length marker.
+// Returns -1 as value for an unknown size.
+func readVint(r *bufio.Reader, is_id bool) (int64, int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && b&mask == 0; mask >>= 1 {
+		n += 1
+	}
+	if n > 8 {
+		return 0, 0, errors.New("bad EBML integer")
+	}
+	v := int64(b)
+	if !is_id {
+		v &= int64(0xFF >> uint(n))
+	}
+	all_ones := v == int64(0xFF>>uint(n))
+	for i := 1; i < n; i++ {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		v = v<<8 | int64(b)
+		all_ones = all_ones && b == 0xFF
+	}
+	if !is_id && all_ones {
+		return -1, n, nil
+	}
+	return v, n, nil
+}
+
+func readUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// Read the info of a Matroska or WebM file, up to its first cluster.
+func readMatroskaInfo(r io.Reader) (*videoInfo, error) {
+	br := bufio.NewReader(r)
+	info := new(videoInfo)
+	scale := int64(1000000) // Timecode scale in ns.
+	duration := -1.0
+	for {
+		id, _, err := readVint(br, true)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		size, _, err := readVint(br, false)
+		if err != nil {
+			return nil, err
+		}
+		if id == mkvCluster {
+			break
+		}
+		if mkvMasters[uint64(id)] {
+			continue
+		}
+		if size < 0 {
+			break
+		}
+		if id != mkvTimecodeScale && id != mkvDuration && id != mkvDateUTC &&
+			id != mkvPixelWidth && id != mkvPixelHeight {
+			if _, err = br.Discard(int(size)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if size > 8 {
+			return nil, errors.New("bad Matroska element size")
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		switch id {
+		case mkvTimecodeScale:
+			scale = int64(readUint(data))
+		case mkvDuration:
+			if size == 4 {
+				duration = float64(math.Float32frombits(uint32(readUint(data))))
+			} else if size == 8 {
+				duration = math.Float64frombits(readUint(data))
+			}
+		case mkvDateUTC:
+			// Nanoseconds since the start of 2001.
+			info.created = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC).Add(
+				time.Duration(int64(readUint(data))))
+		case mkvPixelWidth:
+			if info.width == 0 {
+				info.width = int(readUint(data))
+			}
+		case mkvPixelHeight:
+			if info.height == 0 {
+				info.height = int(readUint(data))
+			}
+		}
+	}
+	if duration >= 0 {
+		info.duration = time.Duration(duration * float64(scale))
+	}
+	return info, nil
+}
+
+// Read the info of a MP4 or QuickTime file from its moov atom.
+func readMp4Info(r io.ReadSeeker) (*videoInfo, error) {
+	info := new(videoInfo)
+	found := false
+	// Offsets of the end of the atoms being read.
+	ends := []int64{math.MaxInt64}
+	pos := int64(0)
+	var hdr [16]byte
+	for {
+		for len(ends) > 1 && pos >= ends[len(ends)-1] {
+			ends = ends[:len(ends)-1]
+		}
+		if _, err := io.ReadFull(r, hdr[:8]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		kind := string(hdr[4:8])
+		hdr_size := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hdr_size = 16
+		} else if size == 0 {
+			size = ends[len(ends)-1] - pos
+		}
+		if size < hdr_size {
+			return nil, errors.New("bad MP4 atom size")
+		}
+		switch kind {
+		case "moov", "trak":
+			found = true
+			ends = append(ends, pos+size)
+			pos += hdr_size
+			continue
+		case "mvhd", "tkhd":
+			// Both headers are about 100 bytes.
+			if size-hdr_size > 256 {
+				return nil, errors.New("bad MP4 header size")
+			}
+			data := make([]byte, size-hdr_size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			if kind == "mvhd" {
+				readMvhd(data, info)
+			} else {
+				readTkhd(data, info)
+			}
+			pos += size
+			continue
+		}
+		pos += size
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, errors.New("no moov atom")
+	}
+	return info, nil
+}
+
+// Seconds between the MP4 epoch and the Unix one.
+const mp4Epoch = 2082844800
+
+func readMvhd(data []byte, info *videoInfo) {
+	var created, scale, duration uint64
+	if len(data) >= 32 && data[0] == 1 {
+		created = binary.BigEndian.Uint64(data[4:12])
+		scale = uint64(binary.BigEndian.Uint32(data[20:24]))
+		duration = binary.BigEndian.Uint64(data[24:32])
+	} else if len(data) >= 20 {
+		created = uint64(binary.BigEndian.Uint32(data[4:8]))
+		scale = uint64(binary.BigEndian.Uint32(data[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
+	if created > mp4Epoch {
+		info.created = time.Unix(int64(created-mp4Epoch), 0).UTC()
+	}
+	if scale > 0 {
+		info.duration = time.Duration(float64(duration) / float64(scale) * float64(time.Second))
+	}
+}
+
+func readTkhd(data []byte, info *videoInfo) {
+	// Width and height are 16.16 fixed point numbers at the end.
+	off := 76
+	if len(data) > 0 && data[0] == 1 {
+		off = 88
+	}
+	if len(data) < off+8 || info.width != 0 {
+		return
+	}
+	info.width = int(binary.BigEndian.Uint32(data[off:off+4]) >> 16)
+	info.height = int(binary.BigEndian.Uint32(data[off+4:off+8]) >> 16)
+}
+
+func readVideoInfo(file string) (*videoInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var magic [8]byte
+	if _, err = io.ReadFull(f, magic[:]); err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.BigEndian.Uint32(magic[:4]) == mkvEBML:
+		return readMatroskaInfo(f)
+	case string(magic[4:8]) == "ftyp" || string(magic[4:8]) == "moov" ||
+		string(magic[4:8]) == "wide" || string(magic[4:8]) == "mdat":
+		return readMp4Info(f)
+	}
+	return nil, errors.New("unknown video format")
+}
+
+// Set the duration, dimensions and item time of a video item from its
+// file.  Uses the file time when the file does not tell when it was shot.
+func LoadVideoFile(file string, video *store.Item) error {
+	video.ItemTimestamp = proto.Int64(video.GetFileTimestamp())
+	info, err := readVideoInfo(file)
+	if err != nil {
+		return err
+	}
+	video.Video = &store.Video{
+		DurationMs: proto.Int64(info.duration.Milliseconds()),
+		Height:     proto.Int32(int32(info.height)),
+		Width:      proto.Int32(int32(info.width)),
+	}
+	if !info.created.IsZero() {
+		video.ItemTimestamp = proto.Int64(TimeToProto(info.created))
+		video.UtcOffset = defaultOffset(info.created)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// An EBML element, with its size written on 8 bytes.
+func ebml(id []byte, children ...[]byte) []byte {
+	var payload []byte
+	for _, c := range children {
+		payload = append(payload, c...)
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(payload)))
+	size[0] = 0x01
+	return append(append(append([]byte{}, id...), size...), payload...)
+}
+
+func ebmlUint(id []byte, v uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+	return ebml(id, data)
+}
+
+func testWebm(duration_ms float64, width, height uint64) []byte {
+	dur := make([]byte, 8)
+	binary.BigEndian.PutUint64(dur, math.Float64bits(duration_ms))
+	return append(
+		ebml([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebml([]byte{0x42, 0x82}, []byte("webm"))),
+		ebml([]byte{0x18, 0x53, 0x80, 0x67},
+			ebml([]byte{0x15, 0x49, 0xA9, 0x66},
+				ebmlUint([]byte{0x2A, 0xD7, 0xB1}, 1000000),
+				ebml([]byte{0x44, 0x89}, dur)),
+			ebml([]byte{0x16, 0x54, 0xAE, 0x6B},
+				ebml([]byte{0xAE},
+					ebml([]byte{0xE0},
+						ebmlUint([]byte{0xB0}, width),
+						ebmlUint([]byte{0xBA}, height)))),
+			ebml([]byte{0x1F, 0x43, 0xB6, 0x75}, []byte{0, 0, 0, 0}))...)
+}
+
+func atom(kind string, children ...[]byte) []byte {
+	var payload []byte
+	for _, c := range children {
+		payload = append(payload, c...)
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(8+len(payload)))
+	copy(data[4:], kind)
+	return append(data, payload...)
+}
+
+func testMp4(created time.Time, seconds, width, height uint32) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[4:8], uint32(created.Unix()+mp4Epoch))
+	binary.BigEndian.PutUint32(mvhd[12:16], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:20], seconds*1000)
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:80], width<<16)
+	binary.BigEndian.PutUint32(tkhd[80:84], height<<16)
+	return append(atom("ftyp", []byte("isom")),
+		append(atom("mdat", make([]byte, 32)),
+			atom("moov", atom("mvhd", mvhd), atom("trak", atom("tkhd", tkhd)))...)...)
+}
+
+func Test_ReadVideoInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	ioutil.WriteFile(path.Join(dir, "a.webm"), testWebm(2500, 640, 480), 0777)
+	ioutil.WriteFile(path.Join(dir, "b.mp4"), testMp4(created, 3, 1920, 1080), 0777)
+	ioutil.WriteFile(path.Join(dir, "c.mkv"), []byte("not a video"), 0777)
+	// A header claiming 4GB.
+	huge := atom("moov", atom("mvhd", make([]byte, 100)))
+	binary.BigEndian.PutUint32(huge[8:12], 0xFFFFFFF0)
+	ioutil.WriteFile(path.Join(dir, "d.mp4"), huge, 0777)
+
+	info, err := readVideoInfo(path.Join(dir, "a.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.duration != 2500*time.Millisecond || info.width != 640 || info.height != 480 {
+		t.Errorf("bad webm info: %+v", info)
+	}
+	info, err = readVideoInfo(path.Join(dir, "b.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.duration != 3*time.Second || info.width != 1920 || info.height != 1080 ||
+		!info.created.Equal(created) {
+		t.Errorf("bad mp4 info: %+v", info)
+	}
+	if _, err = readVideoInfo(path.Join(dir, "c.mkv")); err == nil {
+		t.Error("read a bad video")
+	}
+	if _, err = readVideoInfo(path.Join(dir, "d.mp4")); err == nil {
+		t.Error("read a video with a huge header")
+	}
+}
+
+func Test_LoadVideos(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	ioutil.WriteFile(path.Join(orig, "b.webm"), testWebm(1500, 320, 240), 0777)
+
+	db := loadTestDatabase(t, orig, root)
+	b := imageNamed(db, "b.webm")
+	if b == nil || !b.IsVideo() || b.Duration() != 1500*time.Millisecond {
+		t.Fatalf("bad video: %v", b)
+	}
+	var jimg JsonImage
+	b.Json(&jimg)
+	if jimg.Mt != "video" || jimg.Dur != 1500 {
+		t.Errorf("bad json video: %+v", jimg)
+	}
+	if cover := db.Directories()[0].Cover(); cover == nil || cover.IsVideo() {
+		t.Errorf("bad cover: %v", cover)
+	}
+
+	// Videos survive a reload from the saved index.
+	db = loadTestDatabase(t, orig, root)
+	if b = imageNamed(db, "b.webm"); b == nil || b.Duration() != 1500*time.Millisecond {
+		t.Errorf("video lost on reload: %v", b)
+	}
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var watch_debounce = flag.Duration("watch_debounce", 5*time.Second,
+	"Quiet time after a change in the originals before reloading.")
+var watch_poll_interval = flag.Duration("watch_poll_interval", time.Minute,
+	"How often to scan the originals for changes when inotify is not available.")
+
+// Watches the originals and reloads the directories that change.
+type Watcher struct {
+	db          *Database
+	update_disk bool
+	changes     chan string // Relative paths of changed directories.
+	done        chan struct{}
+}
+
+// Start watching the originals of the database.  Changes are collected
+// until nothing changed for --watch_debounce, then the changed directories
+// are reloaded with ReloadDirectories.  Uses inotify where available, else
+// scans the originals every --watch_poll_interval.
+func (db *Database) Watch(update_disk bool) *Watcher {
+	w := &Watcher{db: db, update_disk: update_disk,
+		changes: make(chan string, 1024), done: make(chan struct{})}
+	err := notifyTree(db.orig_root, w.changes, w.done)
+	if err != nil {
+		log.Printf("%s: cannot watch, polling every %s: %s\n", db.orig_root,
+			*watch_poll_interval, err.Error())
+		go pollTree(db.orig_root, *watch_poll_interval, w.changes, w.done)
+	}
+	go w.run()
+	return w
+}
+
+// Stop watching.
+func (w *Watcher) Close() {
+	close(w.done)
+}
+
+func (w *Watcher) run() {
+	pending := make(map[string]bool)
+	var quiet, deadline <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case rel_pat := <-w.changes:
+			if len(pending) == 0 {
+				// Do not wait forever if the changes keep coming.
+				deadline = time.After(10 * *watch_debounce)
+			}
+			pending[rel_pat] = true
+			quiet = time.After(*watch_debounce)
+			continue
+		case <-quiet:
+		case <-deadline:
+		}
+		rel_pats := make([]string, 0, len(pending))
+		for rel_pat := range pending {
+			rel_pats = append(rel_pats, rel_pat)
+		}
+		sort.Strings(rel_pats)
+		pending = make(map[string]bool)
+		quiet, deadline = nil, nil
+		log.Printf("Changed directories: %v\n", rel_pats)
+		err := w.db.ReloadDirectories(rel_pats, w.update_disk, w.update_disk)
+		if err != nil {
+			log.Printf("Reload: %s\n", err.Error())
+		}
+	}
+}
+
+// Latest mod time of each directory under root and of the files it
+// contains, by relative path.
+func scanTree(root string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel_pat, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			rel_pat = filepath.Dir(rel_pat)
+		}
+		if rel_pat == "." {
+			rel_pat = ""
+		}
+		if info.ModTime().After(times[rel_pat]) {
+			times[rel_pat] = info.ModTime()
+		}
+		return nil
+	})
+	return times
+}
+
+// Scan root every interval and send the directories that changed.
+func pollTree(root string, interval time.Duration, changes chan<- string,
+	done <-chan struct{}) {
+	old := scanTree(root)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		cur := scanTree(root)
+		var changed []string
+		for rel_pat, t := range cur {
+			if ot, ok := old[rel_pat]; !ok || !ot.Equal(t) {
+				changed = append(changed, rel_pat)
+			}
+		}
+		for rel_pat := range old {
+			if _, ok := cur[rel_pat]; !ok {
+				changed = append(changed, rel_pat)
+			}
+		}
+		old = cur
+		for _, rel_pat := range changed {
+			select {
+			case changes <- rel_pat:
+			case <-done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_ONLYDIR
+
+type inotifyWatcher struct {
+	fd      int
+	root    string
+	paths   map[int32]string // Relative path by watch descriptor.
+	changes chan<- string
+	done    <-chan struct{}
+}
+
+func (iw *inotifyWatcher) send(rel_pat string) {
+	select {
+	case iw.changes <- rel_pat:
+	case <-iw.done:
+	}
+}
+
+// Watch all the directories under rel_pat.
+func (iw *inotifyWatcher) addTree(rel_pat string) {
+	wd, err := syscall.InotifyAddWatch(iw.fd, path.Join(iw.root, rel_pat),
+		inotifyMask)
+	if err != nil {
+		log.Printf("%s: cannot watch: %s\n", rel_pat, err.Error())
+		return
+	}
+	// Adding a watch for a moved directory returns its old descriptor.
+	iw.paths[int32(wd)] = rel_pat
+	fis, err := ioutil.ReadDir(path.Join(iw.root, rel_pat))
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			iw.addTree(path.Join(rel_pat, fi.Name()))
+		}
+	}
+}
+
+// Send the changed directories until the inotify file is closed.
+func (iw *inotifyWatcher) read(f *os.File) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name_start := off + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[name_start:name_start+int(ev.Len)], "\x00"))
+			off = name_start + int(ev.Len)
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Printf("%s: inotify overflow, reloading all\n", iw.root)
+				for _, rel_pat := range iw.paths {
+					iw.send(rel_pat)
+				}
+				continue
+			}
+			rel_pat, ok := iw.paths[ev.Wd]
+			if !ok {
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(iw.paths, ev.Wd)
+				continue
+			}
+			if ev.Mask&syscall.IN_ISDIR != 0 &&
+				ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				iw.addTree(path.Join(rel_pat, name))
+			}
+			iw.send(rel_pat)
+		}
+	}
+}
+
+// Watch root with inotify and send the directories that changed.
+func notifyTree(root string, changes chan<- string, done <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	iw := &inotifyWatcher{fd: fd, root: root, paths: make(map[int32]string),
+		changes: changes, done: done}
+	iw.addTree("")
+	if len(iw.paths) == 0 {
+		syscall.Close(fd)
+		return os.ErrNotExist
+	}
+	// Non blocking, so that closing the file stops the reader.
+	f := os.NewFile(uintptr(fd), "inotify")
+	go iw.read(f)
+	go func() {
+		<-done
+		f.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package model
+
+import "errors"
+
+func notifyTree(root string, changes chan<- string, done <-chan struct{}) error {
+	return errors.New("file notifications not supported")
+}
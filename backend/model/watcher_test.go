@@ -0,0 +1,87 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_ReloadDirectories(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg", "2002/c.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	b := imageNamed(db, "b.jpg")
+
+	ioutil.WriteFile(path.Join(orig, "2001/d.jpg"), nil, 0777)
+	os.MkdirAll(path.Join(orig, "2001/2001-02-03"), 0777)
+	ioutil.WriteFile(path.Join(orig, "2001/2001-02-03/e.jpg"), nil, 0777)
+	os.RemoveAll(path.Join(orig, "2002"))
+	err := db.ReloadDirectories([]string{"", "2001"}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Directories()) != 3 || countImages(db) != 4 {
+		t.Errorf("reloaded %d dirs, %d images", len(db.Directories()), countImages(db))
+	}
+	for _, name := range []string{"a.jpg", "b.jpg", "d.jpg", "e.jpg"} {
+		img := imageNamed(db, name)
+		if img == nil || db.Indexer().Image(img.Id) != img {
+			t.Errorf("%s not indexed", name)
+		}
+	}
+	if imageNamed(db, "c.jpg") != nil {
+		t.Error("removed image still there")
+	}
+	if imageNamed(db, "b.jpg").Id != b.Id {
+		t.Error("reload changed the id of an unchanged image")
+	}
+	if len(db.Indexer().Images("d.jpg")) != 1 || len(db.Indexer().Images("c.jpg")) != 0 {
+		t.Error("bad keyword index")
+	}
+}
+
+func Test_PollTree(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	changes := make(chan string, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go pollTree(orig, 10*time.Millisecond, changes, done)
+	time.Sleep(50 * time.Millisecond)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path.Join(orig, "2001/b.jpg"), future, future)
+	select {
+	case rel_pat := <-changes:
+		if rel_pat != "2001" {
+			t.Errorf("changed %q, want 2001", rel_pat)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not seen")
+	}
+}
+
+func Test_Watch(t *testing.T) {
+	orig, root := makeOrigTree(t, []string{"a.jpg", "2001/b.jpg"})
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	db := loadTestDatabase(t, orig, root)
+	old_debounce, old_poll := *watch_debounce, *watch_poll_interval
+	*watch_debounce, *watch_poll_interval = 50*time.Millisecond, 50*time.Millisecond
+	defer func() { *watch_debounce, *watch_poll_interval = old_debounce, old_poll }()
+	w := db.Watch(false)
+	defer w.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	os.MkdirAll(path.Join(orig, "2001/2001-02-03"), 0777)
+	ioutil.WriteFile(path.Join(orig, "2001/2001-02-03/c.jpg"), nil, 0777)
+	for i := 0; i < 100 && imageNamed(db.Snapshot(), "c.jpg") == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if imageNamed(db.Snapshot(), "c.jpg") == nil {
+		t.Error("new image not loaded")
+	}
+}
@@ -0,0 +1,585 @@
+package model
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+import "toutizes.com/go-photwo/backend/store"
+
+// Keyword edits are written back into the originals: the IPTC keywords
+// (2:25) are replaced, as well as the XMP dc:subject of the embedded
+// packet and of the sidecar when they have one.  Only the metadata
+// segments change, the compressed pixels are copied as they are.  The
+// directories are then reloaded, so the index is updated by
+// UpdateDirectory like for any other change of the originals.
+
+// Serializes the edits, which read and rewrite the originals.
+var writeback_mu sync.Mutex
+
+// An IPTC-IIM dataset, with its raw value.
+type iimDataset struct {
+	record, number byte
+	data           []byte
+}
+
+// Parse an IPTC-IIM stream.
+func parseIim(data []byte) ([]iimDataset, error) {
+	var ds []iimDataset
+	for len(data) > 0 {
+		if data[0] != 0x1C {
+			// Some writers pad the stream with zeros.
+			if bytes.Count(data, []byte{0}) == len(data) {
+				break
+			}
+			return nil, errors.New("bad IPTC tag marker")
+		}
+		if len(data) < 5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d := iimDataset{record: data[1], number: data[2]}
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		data = data[5:]
+		if size&0x8000 != 0 {
+			// Extended dataset, the size is in the next size&0x7FFF bytes.
+			n := size & 0x7FFF
+			if n > 4 || len(data) < n {
+				return nil, errors.New("bad IPTC extended dataset")
+			}
+			size = 0
+			for _, b := range data[:n] {
+				size = size<<8 | int(b)
+			}
+			data = data[n:]
+		}
+		if len(data) < size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d.data = data[:size]
+		data = data[size:]
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+func encodeIim(ds []iimDataset) []byte {
+	var buf bytes.Buffer
+	for _, d := range ds {
+		buf.Write([]byte{0x1C, d.record, d.number})
+		if len(d.data) < 0x8000 {
+			binary.Write(&buf, binary.BigEndian, uint16(len(d.data)))
+		} else {
+			binary.Write(&buf, binary.BigEndian, uint16(0x8004))
+			binary.Write(&buf, binary.BigEndian, uint32(len(d.data)))
+		}
+		buf.Write(d.data)
+	}
+	return buf.Bytes()
+}
+
+// Replace the keyword datasets of an IPTC stream, keeping the datasets
+// sorted by record and number.  The keywords are in UTF-8, which is
+// declared in 1:90 if some keyword is not ASCII.
+func setIimKeywords(ds []iimDataset, kwds []string) []iimDataset {
+	utf8_declared := false
+	non_ascii := false
+	for _, kwd := range kwds {
+		for i := 0; i < len(kwd); i++ {
+			if kwd[i] >= 0x80 {
+				non_ascii = true
+			}
+		}
+	}
+	kept := make([]iimDataset, 0, len(ds)+len(kwds)+1)
+	for _, d := range ds {
+		if d.record == 1 && d.number == 90 {
+			utf8_declared = true
+		}
+		if d.record == 2 && d.number == 25 {
+			continue
+		}
+		if d.record == 2 && d.number != 0 && !utf8.Valid(d.data) && non_ascii {
+			// Keep the other Latin-1 values readable once in UTF-8.
+			d.data = []byte(decodeIptcString("", d.data))
+		}
+		kept = append(kept, d)
+	}
+	if non_ascii && !utf8_declared {
+		kept = append(kept, iimDataset{1, 90, []byte("\x1B%G")})
+	}
+	if len(kwds) > 0 && !hasRecord2Version(kept) {
+		kept = append(kept, iimDataset{2, 0, []byte{0, 4}})
+	}
+	for _, kwd := range kwds {
+		kept = append(kept, iimDataset{2, 25, []byte(kwd)})
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].record != kept[j].record {
+			return kept[i].record < kept[j].record
+		}
+		return kept[i].number < kept[j].number
+	})
+	return kept
+}
+
+// The record version 2:00 must start record 2.
+func hasRecord2Version(ds []iimDataset) bool {
+	for _, d := range ds {
+		if d.record == 2 && d.number == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// A Photoshop image resource of an APP13 segment.
+type psResource struct {
+	id   uint16
+	name []byte // Pascal string, without its padding.
+	data []byte
+}
+
+const (
+	psSegmentHeader = "Photoshop 3.0\x00"
+	psIptcId        = 0x0404 // The IPTC-IIM stream.
+	psIptcDigestId  = 0x0425 // MD5 of the IPTC-IIM stream.
+)
+
+func parsePhotoshop(data []byte) ([]psResource, error) {
+	var rs []psResource
+	for len(data) > 0 {
+		if len(data) < 7 || string(data[:4]) != "8BIM" {
+			return nil, errors.New("bad Photoshop resource")
+		}
+		r := psResource{id: binary.BigEndian.Uint16(data[4:6])}
+		name_len := 1 + int(data[6])
+		name_len += name_len % 2
+		if len(data) < 6+name_len+4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.name = data[6 : 7+int(data[6])]
+		data = data[6+name_len:]
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		data = data[4:]
+		if len(data) < size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.data = data[:size]
+		data = data[size+min(size%2, len(data)-size):]
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func encodePhotoshop(rs []psResource) []byte {
+	var buf bytes.Buffer
+	for _, r := range rs {
+		buf.WriteString("8BIM")
+		binary.Write(&buf, binary.BigEndian, r.id)
+		buf.Write(r.name)
+		if len(r.name)%2 != 0 {
+			buf.WriteByte(0)
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(r.data)))
+		buf.Write(r.data)
+		if len(r.data)%2 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Replace the IPTC keywords of a JPEG, adding an APP13 segment after the
+// APPn segments if it has none.
+func setJpegIptcKeywords(sl *jpegstructure.SegmentList, kwds []string) error {
+	segments := sl.Segments()
+	var seg *jpegstructure.Segment
+	var rs []psResource
+	insert := 1
+	for i, s := range segments {
+		if s.MarkerId >= jpegstructure.MARKER_APP0 && s.MarkerId <= jpegstructure.MARKER_APP15 {
+			insert = i + 1
+		}
+		if s.MarkerId == jpegstructure.MARKER_APP13 &&
+			bytes.HasPrefix(s.Data, []byte(psSegmentHeader)) {
+			parsed, err := parsePhotoshop(s.Data[len(psSegmentHeader):])
+			if err != nil {
+				return err
+			}
+			seg, rs = s, parsed
+			break
+		}
+	}
+	var ds []iimDataset
+	for _, r := range rs {
+		if r.id == psIptcId {
+			parsed, err := parseIim(r.data)
+			if err != nil {
+				return err
+			}
+			ds = parsed
+		}
+	}
+	iim := encodeIim(setIimKeywords(ds, kwds))
+	found := false
+	for i := range rs {
+		switch rs[i].id {
+		case psIptcId:
+			rs[i].data, found = iim, true
+		case psIptcDigestId:
+			digest := md5.Sum(iim)
+			rs[i].data = digest[:]
+		}
+	}
+	if !found {
+		rs = append(rs, psResource{id: psIptcId, name: []byte{0}, data: iim})
+	}
+	data := append([]byte(psSegmentHeader), encodePhotoshop(rs)...)
+	if len(data) > 0xFFFF-2 {
+		return errors.New("IPTC segment too large")
+	}
+	if seg != nil {
+		seg.Data = data
+		return nil
+	}
+	seg = &jpegstructure.Segment{MarkerId: jpegstructure.MARKER_APP13, Data: data}
+	rest := append([]*jpegstructure.Segment{seg}, segments[insert:]...)
+	*sl = *jpegstructure.NewSegmentList(append(segments[:insert:insert], rest...))
+	return nil
+}
+
+// An edit of an XMP packet, replacing data[start:end].
+type xmpEdit struct {
+	start, end int
+	text       string
+}
+
+// Replace the dc:subject keywords of an XMP packet and drop the Lightroom
+// hierarchical subjects ending with a removed keyword.  Returns the packet
+// unchanged and false if it has no keywords.
+func setXmpKeywords(data []byte, kwds []string, removed []string) ([]byte, bool, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var stack []xml.Name
+	var edits []xmpEdit
+	has_subject := false
+	var bag_start, bag_content int // Offsets of the dc:subject array.
+	var li_start int
+	var text []byte
+	for {
+		start := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return data, false, err
+		}
+		end := int(dec.InputOffset())
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			text = text[:0]
+			if isXmpArray(stack, "subject") {
+				bag_start, bag_content = start, end
+			} else if t.Name.Space == xmpNsRdf && t.Name.Local == "li" {
+				li_start = start
+			}
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			switch {
+			case isXmpArray(stack, "subject"):
+				has_subject = true
+				tag := string(data[bag_start:bag_content])
+				qname := strings.Fields(strings.TrimRight(tag[1:], "/>"))[0]
+				prefix := qname[:strings.Index(qname, ":")+1]
+				var lis strings.Builder
+				for _, kwd := range kwds {
+					lis.WriteString("<" + prefix + "li>")
+					xml.EscapeText(&lis, []byte(kwd))
+					lis.WriteString("</" + prefix + "li>")
+				}
+				if bag_content == end {
+					// <rdf:Bag/>
+					edits = append(edits, xmpEdit{bag_start, end,
+						tag[:len(tag)-2] + ">" + lis.String() + "</" + qname + ">"})
+				} else {
+					edits = append(edits, xmpEdit{bag_content, start, lis.String()})
+				}
+			case len(stack) >= 3 && t.Name.Space == xmpNsRdf && t.Name.Local == "li" &&
+				stack[len(stack)-3].Space == xmpNsLr &&
+				stack[len(stack)-3].Local == "hierarchicalSubject":
+				path := strings.Split(strings.TrimSpace(string(text)), "|")
+				if containsFold(removed, path[len(path)-1]) {
+					edits = append(edits, xmpEdit{li_start, end, ""})
+				}
+			}
+			stack = stack[:len(stack)-1]
+			text = text[:0]
+		}
+	}
+	if !has_subject && len(edits) == 0 {
+		return data, false, nil
+	}
+	out := append([]byte{}, data...)
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		out = append(out[:e.start], append([]byte(e.text), out[e.end:]...)...)
+	}
+	return out, true, nil
+}
+
+// Whether the top of stack is the array of the dc property local.
+func isXmpArray(stack []xml.Name, local string) bool {
+	n := len(stack)
+	return n >= 2 && stack[n-1].Space == xmpNsRdf &&
+		(stack[n-1].Local == "Bag" || stack[n-1].Local == "Seq") &&
+		stack[n-2].Space == xmpNsDc && stack[n-2].Local == local
+}
+
+func containsFold(a []string, s string) bool {
+	for _, x := range a {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write the keywords into an original JPEG and its sidecar.
+func writeKeywords(file string, kwds []string, removed []string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	intfc, err := jpegstructure.NewJpegMediaParser().ParseBytes(data)
+	if err != nil {
+		return fmt.Errorf("%s: not a JPEG file: %s", file, err.Error())
+	}
+	sl := intfc.(*jpegstructure.SegmentList)
+	if err = setJpegIptcKeywords(sl, kwds); err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+	for _, s := range sl.Segments() {
+		if s.IsXmp() {
+			xmp, changed, err := setXmpKeywords(s.Data[len(xmpSegmentHeader):], kwds, removed)
+			if err != nil {
+				return fmt.Errorf("%s: embedded xmp: %s", file, err.Error())
+			}
+			if changed {
+				s.Data = append([]byte(xmpSegmentHeader), xmp...)
+				if len(s.Data) > 0xFFFF-2 {
+					return fmt.Errorf("%s: XMP segment too large", file)
+				}
+			}
+			break
+		}
+	}
+	var buf bytes.Buffer
+	if err = sl.Write(&buf); err != nil {
+		return err
+	}
+	if err = WriteFileAtomic(file, buf.Bytes(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	for _, sidecar := range sidecarNames(file) {
+		data, err := os.ReadFile(sidecar)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		xmp, changed, err := setXmpKeywords(data, kwds, removed)
+		if err != nil {
+			return fmt.Errorf("%s: %s", sidecar, err.Error())
+		}
+		if changed {
+			if fi, err = os.Stat(sidecar); err == nil {
+				err = WriteFileAtomic(sidecar, xmp, fi.Mode().Perm())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		break
+	}
+	return nil
+}
+
+// The keywords kwds with the keywords add and without the keywords
+// remove, case-insensitively.
+func editKeywords(kwds []string, add []string, remove []string) []string {
+	edited := make([]string, 0, len(kwds)+len(add))
+	for _, kwd := range append(append([]string{}, kwds...), add...) {
+		if !containsFold(remove, kwd) && !containsFold(edited, kwd) {
+			edited = append(edited, kwd)
+		}
+	}
+	return edited
+}
+
+// Add and remove keywords in the originals of some images, then reload
+// their directories.  Returns the number of images whose keywords changed.
+func (db *Database) WriteKeywords(c Change, ids []int, add []string, remove []string) (int, error) {
+	if err := checkKeywords(append(append([]string{}, add...), remove...)); err != nil {
+		return 0, err
+	}
+	writeback_mu.Lock()
+	defer writeback_mu.Unlock()
+	snap := db.Snapshot()
+	edited := make(map[string]map[string][]string) // Keywords by name by directory.
+	var rel_pats []string
+	for _, id := range ids {
+		img := snap.Indexer().Image(id)
+		if img == nil {
+			return 0, errors.New(fmt.Sprintf("Unknown image id: %d", id))
+		}
+		rel_pat := img.Directory().RelPat()
+		if edited[rel_pat] == nil {
+			edited[rel_pat] = make(map[string][]string)
+			rel_pats = append(rel_pats, rel_pat)
+		}
+		edited[rel_pat][img.Name()] = editKeywords(img.Keywords(), add, remove)
+	}
+	num_changed := 0
+	var err error
+	for i, rel_pat := range rel_pats {
+		// The directory is edited in the index too, so the images do not lose
+		// their keywords when the originals have none, and so they are read
+		// again even if their files keep the same time to the second.  When an
+		// original cannot be written, the ones written before it are kept in
+		// the index and journaled, the others are left untouched.
+		var write_err error
+		c.Originals = true
+		err = db.mutateItems(c, rel_pat, func(sdir *store.Directory) error {
+			names := make([]string, 0, len(edited[rel_pat]))
+			for name := range edited[rel_pat] {
+				item := findItem(sdir, name)
+				if item == nil || item.Image == nil {
+					return errors.New("Unknown image: " + name)
+				}
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				item, kwds := findItem(sdir, name), edited[rel_pat][name]
+				write_err = writeKeywords(path.Join(db.FullOrigPath(rel_pat), name), kwds, remove)
+				if write_err != nil {
+					return nil
+				}
+				if !stringsEqual(item.Keywords, kwds) {
+					num_changed++
+				}
+				// The overrides must not undo the edit when the originals are
+				// read again.
+				if ov := item.KeywordOverrides; ov.GetReplaced() {
+					(&keywordEdit{add: add, remove: remove}).apply(item)
+				} else if ov != nil {
+					ov.Added = dropKeywords(ov.Added, remove)
+					ov.Removed = dropKeywords(ov.Removed, add)
+					if len(ov.Added) == 0 && len(ov.Removed) == 0 {
+						item.KeywordOverrides = nil
+					}
+				}
+				item.Keywords = kwds
+				item.HierarchicalKeywords = dropLeaves(item.HierarchicalKeywords, remove)
+				item.FileTimestamp = nil
+			}
+			return nil
+		})
+		if err == nil {
+			err = write_err
+		}
+		if err != nil {
+			rel_pats = rel_pats[:i+1]
+			break
+		}
+	}
+	// Read again the originals written, even after an error.
+	if rerr := db.ReloadDirectories(rel_pats, true, false); err == nil {
+		err = rerr
+	} else if rerr != nil {
+		log.Printf("%s\n", rerr.Error())
+	}
+	return num_changed, err
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The hierarchical keywords whose leaf is not in remove.
+func dropLeaves(hkwds []string, remove []string) []string {
+	var kept []string
+	for _, hkwd := range hkwds {
+		if !containsFold(remove, hkwd[strings.LastIndex(hkwd, "|")+1:]) {
+			kept = append(kept, hkwd)
+		}
+	}
+	return kept
+}
+
+// POST with the image ids in "id" and the keywords to add and remove in
+// "add" and "remove", all repeatable.
+func HandleWriteKeywords(w http.ResponseWriter, r *http.Request, db *Database) {
+	var res EditResults
+	userEmail := r.Context().Value("userEmail").(string)
+	err := r.ParseForm()
+	var ids []int
+	if err == nil && r.Method != "POST" {
+		err = errors.New("Use POST to write keywords")
+	}
+	if err == nil {
+		for _, s := range r.Form["id"] {
+			id, e := strconv.Atoi(s)
+			if e != nil {
+				err = errors.New("Bad image id: " + s)
+				break
+			}
+			ids = append(ids, id)
+		}
+	}
+	if err == nil && len(ids) == 0 {
+		err = errors.New("Missing image id")
+	}
+	if err == nil {
+		log.Printf("Keywords from %s: %v +%q -%q", userEmail, ids, r.Form["add"],
+			r.Form["remove"])
+		res.Changed, err = db.WriteKeywords(Change{User: userEmail}, ids, r.Form["add"],
+			r.Form["remove"])
+	}
+	if err == nil {
+		res.Message = "ok"
+	} else {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(w).Encode(&res)
+}
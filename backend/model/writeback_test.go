@@ -0,0 +1,221 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+func Test_Iim(t *testing.T) {
+	ds := []iimDataset{{1, 90, []byte("\x1B%G")}, {2, 25, []byte("Lyon")},
+		{2, 120, bytes.Repeat([]byte("x"), 0x9000)}}
+	got, err := parseIim(append(encodeIim(ds), 0, 0))
+	if err != nil || !reflect.DeepEqual(got, ds) {
+		t.Errorf("bad round trip %v", err)
+	}
+	ds = setIimKeywords([]iimDataset{{2, 120, []byte("f\xeate")}, {2, 25, []byte("old")}},
+		[]string{"Noël", "Lyon"})
+	want := []iimDataset{{1, 90, []byte("\x1B%G")}, {2, 0, []byte{0, 4}},
+		{2, 25, []byte("Noël")}, {2, 25, []byte("Lyon")}, {2, 120, []byte("fête")}}
+	if !reflect.DeepEqual(ds, want) {
+		t.Errorf("bad keywords %q", ds)
+	}
+}
+
+func Test_SetXmpKeywords(t *testing.T) {
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:lr="http://ns.adobe.com/lightroom/1.0/">
+   <dc:subject><rdf:Bag><rdf:li>Lyon</rdf:li><rdf:li>Paris</rdf:li></rdf:Bag></dc:subject>
+   <lr:hierarchicalSubject><rdf:Bag>
+    <rdf:li>Lieux|France|Lyon</rdf:li>
+    <rdf:li>Lieux|France|Paris</rdf:li>
+   </rdf:Bag></lr:hierarchicalSubject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+	out, changed, err := setXmpKeywords([]byte(xmp), []string{"Paris", "A & B"}, []string{"lyon"})
+	if err != nil || !changed {
+		t.Fatal(changed, err)
+	}
+	meta, err := parseXmp(out)
+	if err != nil || !reflect.DeepEqual(meta.keywords, []string{"Paris", "A & B"}) ||
+		!reflect.DeepEqual(meta.hierarchical, []string{"Lieux|France|Paris"}) {
+		t.Errorf("bad packet %v %v:\n%s", meta, err, out)
+	}
+
+	empty := strings.Replace(xmp, "<rdf:Bag><rdf:li>Lyon</rdf:li><rdf:li>Paris</rdf:li></rdf:Bag>",
+		"<rdf:Bag/>", 1)
+	out, _, _ = setXmpKeywords([]byte(empty), []string{"Lyon"}, nil)
+	if meta, _ = parseXmp(out); !reflect.DeepEqual(meta.keywords, []string{"Lyon"}) {
+		t.Errorf("bad packet from an empty bag:\n%s", out)
+	}
+
+	if out, changed, _ = setXmpKeywords([]byte(pickXmp(`xmpDM:good="True"`)),
+		[]string{"Lyon"}, nil); changed {
+		t.Errorf("packet without keywords changed:\n%s", out)
+	}
+}
+
+// Parsing and writing a JPEG without changes gives the same bytes.
+func Test_JpegRoundTrip(t *testing.T) {
+	p := path.Join(t.TempDir(), "a.jpg")
+	writeTestJpeg(t, p, 8, 6)
+	embedIptc(t, p, map[byte]string{25: "Lyon"})
+	data, _ := ioutil.ReadFile(p)
+	intfc, err := jpegstructure.NewJpegMediaParser().ParseBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = intfc.(*jpegstructure.SegmentList).Write(&buf); err != nil ||
+		!bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("JPEG changed by a round trip %v", err)
+	}
+}
+
+// The bytes from the start of the scan.
+func scanData(t *testing.T, p string) []byte {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte{0xFF, 0xDA})
+	if i < 0 {
+		t.Fatalf("%s: no scan", p)
+	}
+	return data[i:]
+}
+
+func Test_WriteKeywords(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	a, b, c := path.Join(orig, "a.jpg"), path.Join(orig, "b.jpg"), path.Join(orig, "c.jpg")
+	for _, p := range []string{a, b, c} {
+		writeTestJpeg(t, p, 8, 6)
+	}
+	embedIptc(t, a, map[byte]string{5: "Marché", 25: "Lyon", 120: "Le marché"})
+	ioutil.WriteFile(path.Join(orig, "c.xmp"), []byte(testXmp("2", "Lyon", "Paris")), 0777)
+	scan := scanData(t, a)
+
+	db := loadTestDatabase(t, orig, root)
+	ids := []int{imageNamed(db, "a.jpg").Id, imageNamed(db, "b.jpg").Id,
+		imageNamed(db, "c.jpg").Id}
+	by := Change{User: "test@example.com"}
+	n, err := db.WriteKeywords(by, ids, []string{"noël"}, []string{"LYON"})
+	if err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	_, _, kwds, title, caption, _ := GetImageInfo2(a)
+	if !reflect.DeepEqual(kwds, []string{"noël"}) || title != "Marché" || caption != "Le marché" {
+		t.Errorf("bad IPTC %v %q %q", kwds, title, caption)
+	}
+	if !bytes.Equal(scanData(t, a), scan) {
+		t.Error("pixels changed")
+	}
+	if meta, _ := readSidecar(c); !reflect.DeepEqual(meta.keywords, []string{"Paris", "noël"}) {
+		t.Errorf("bad sidecar keywords %v", meta.keywords)
+	}
+	for q, want := range map[string]string{
+		"lyon":  "",
+		"noël":  "a.jpg b.jpg c.jpg",
+		"paris": "c.jpg",
+	} {
+		if got := queryNames(db, q); got != want {
+			t.Errorf("%q: got %q, want %q", q, got, want)
+		}
+	}
+	if itm := indexItem(t, db, "c.jpg"); !reflect.DeepEqual(itm.Keywords, []string{"Paris", "noël"}) {
+		t.Errorf("bad index %v", itm)
+	}
+
+	// The last keyword removed, even after a rescan.
+	if n, err = db.WriteKeywords(by, ids[1:2], nil, []string{"noël"}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if err = db.ReloadDirectories([]string{""}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if kwds := imageNamed(db, "b.jpg").Keywords(); len(kwds) != 0 {
+		t.Errorf("keywords back after a rescan: %v", kwds)
+	}
+	if n, _ = db.WriteKeywords(by, ids[:1], []string{"noël"}, nil); n != 0 {
+		t.Errorf("%d images changed by a no-op", n)
+	}
+	if _, err = db.WriteKeywords(by, ids[:1], []string{"a;b"}, nil); err == nil {
+		t.Error("bad keyword accepted")
+	}
+}
+
+func Test_HandleWriteKeywords(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+
+	write := func(method string, form url.Values) string {
+		req := httptest.NewRequest(method, "/write-keywords", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), "userEmail", "test@example.com"))
+		rec := httptest.NewRecorder()
+		HandleWriteKeywords(rec, req, db)
+		var res EditResults
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return res.Message + " " + strconv.Itoa(res.Changed)
+	}
+	id := []string{strconv.Itoa(imageNamed(db, "a.jpg").Id)}
+	if msg := write("GET", url.Values{"id": id, "add": {"plage"}}); !strings.Contains(msg, "POST") {
+		t.Errorf("GET accepted: %q", msg)
+	}
+	if msg := write("POST", url.Values{"id": id, "add": {"plage", "mer"}}); msg != "ok 1" {
+		t.Errorf("bad message %q", msg)
+	}
+	if got := queryNames(db, "plage"); got != "a.jpg" {
+		t.Errorf("keyword not added: %q", got)
+	}
+	if msg := write("POST", url.Values{"id": {"12"}, "add": {"plage"}}); msg != "Unknown image id: 12 0" {
+		t.Errorf("bad message %q", msg)
+	}
+}
+
+// The originals written before a failure keep their edit in the index and
+// the journal.
+func Test_WriteKeywordsPartialFailure(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		writeTestJpeg(t, path.Join(orig, name), 8, 6)
+	}
+	db := loadTestDatabase(t, orig, root)
+	db.publish()
+	ids := []int{imageNamed(db, "a.jpg").Id, imageNamed(db, "b.jpg").Id}
+	ioutil.WriteFile(path.Join(orig, "b.jpg"), []byte("not a jpeg"), 0644)
+
+	n, err := db.WriteKeywords(Change{User: "alice"}, ids, []string{"noël"}, nil)
+	if err == nil || n != 1 {
+		t.Errorf("got %d %v, want 1 and an error", n, err)
+	}
+	if got := queryNames(db, "noël"); got != "a.jpg" {
+		t.Errorf("written original not indexed: %q", got)
+	}
+	entries, err := db.ReadJournal(func(e *JournalEntry) bool { return true })
+	if err != nil || len(entries) != 1 || entries[0].ImageId != ids[0] || !entries[0].Originals {
+		t.Errorf("bad journal %+v %v", entries, err)
+	}
+}
@@ -0,0 +1,218 @@
+package model
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+import "github.com/golang/protobuf/proto"
+import "toutizes.com/go-photwo/backend/store"
+
+// The metadata of an image comes from, by increasing precedence, its IPTC
+// record, the XMP packet embedded in its APP1 segment, and its .xmp
+// sidecar file.  Each field is taken from the highest source that sets
+// it, so the sidecar keywords replace the embedded ones, which replace
+// the IPTC ones.
+
+// Prefix of the APP1 segments holding XMP.
+const xmpSegmentHeader = "http://ns.adobe.com/xap/1.0/\x00"
+
+const (
+	xmpNsRdf = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNsDc  = "http://purl.org/dc/elements/1.1/"
+	xmpNsLr  = "http://ns.adobe.com/lightroom/1.0/"
+	xmpNsXmp = "http://ns.adobe.com/xap/1.0/"
+	xmpNsDm  = "http://ns.adobe.com/xmp/1.0/DynamicMedia/"
+	xmpNsDk  = "http://www.digikam.org/ns/1.0/"
+)
+
+// Metadata read from one source.  Empty fields are unset.
+type imageMetadata struct {
+	keywords     []string
+	hierarchical []string // Lightroom hierarchical subjects, "a|b|c".
+	title        string
+	description  string
+	rating       *int32 // -1 for rejected, 0 to 5 otherwise.
+	pick         *int32 // 1 for picked, -1 for rejected.
+}
+
+// Set the fields of meta that are set in over.
+func (meta *imageMetadata) override(over *imageMetadata) {
+	if over == nil {
+		return
+	}
+	if len(over.keywords) > 0 {
+		meta.keywords = over.keywords
+	}
+	if len(over.hierarchical) > 0 {
+		meta.hierarchical = over.hierarchical
+	}
+	if over.title != "" {
+		meta.title = over.title
+	}
+	if over.description != "" {
+		meta.description = over.description
+	}
+	if over.rating != nil {
+		meta.rating = over.rating
+	}
+	if over.pick != nil {
+		meta.pick = over.pick
+	}
+}
+
+// Store the metadata in itm, keeping the fields of itm that are unset.
+func (meta *imageMetadata) setItem(itm *store.Item) {
+	if len(meta.keywords) > 0 {
+		itm.Keywords = meta.keywords
+	}
+	if len(meta.hierarchical) > 0 {
+		itm.HierarchicalKeywords = meta.hierarchical
+	}
+	if meta.title != "" {
+		itm.Title = proto.String(meta.title)
+	}
+	if meta.description != "" {
+		itm.Description = proto.String(meta.description)
+	}
+	if meta.rating != nil {
+		itm.Rating = proto.Int32(*meta.rating)
+	}
+	if meta.pick != nil {
+		itm.Pick = proto.Int32(*meta.pick)
+	}
+}
+
+func (meta *imageMetadata) setRating(value string) {
+	if r, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		meta.rating = proto.Int32(int32(r))
+	}
+}
+
+// The pick flags of digiKam, PickLabel 1 is rejected and 3 accepted, and
+// of Bridge and Premiere, xmpDM:good.
+func (meta *imageMetadata) setPick(name xml.Name, value string) {
+	value = strings.TrimSpace(value)
+	switch {
+	case name.Space == xmpNsDk && name.Local == "PickLabel":
+		switch value {
+		case "1":
+			meta.pick = proto.Int32(-1)
+		case "3":
+			meta.pick = proto.Int32(1)
+		}
+	case name.Space == xmpNsDm && name.Local == "good":
+		if strings.EqualFold(value, "true") {
+			meta.pick = proto.Int32(1)
+		} else if strings.EqualFold(value, "false") {
+			meta.pick = proto.Int32(-1)
+		}
+	}
+}
+
+// Simple properties can be attributes of rdf:Description.
+func (meta *imageMetadata) setAttr(name xml.Name, value string) {
+	if name.Space == xmpNsXmp && name.Local == "Rating" {
+		meta.setRating(value)
+	}
+	meta.setPick(name, value)
+}
+
+// Handle the text of the element at the top of stack.
+func (meta *imageMetadata) setElement(stack []xml.Name, value string) {
+	name := stack[len(stack)-1]
+	if name.Space == xmpNsXmp && name.Local == "Rating" {
+		meta.setRating(value)
+		return
+	}
+	meta.setPick(name, value)
+	// Arrays are property/rdf:Bag/rdf:li, property/rdf:Alt/rdf:li, etc.
+	if name.Space != xmpNsRdf || name.Local != "li" || len(stack) < 3 {
+		return
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	switch prop := stack[len(stack)-3]; {
+	case prop.Space == xmpNsDc && prop.Local == "subject":
+		meta.keywords = append(meta.keywords, value)
+	case prop.Space == xmpNsLr && prop.Local == "hierarchicalSubject":
+		meta.hierarchical = append(meta.hierarchical, value)
+	// Titles and descriptions are language alternatives, use the first one.
+	case prop.Space == xmpNsDc && prop.Local == "title" && meta.title == "":
+		meta.title = value
+	case prop.Space == xmpNsDc && prop.Local == "description" && meta.description == "":
+		meta.description = value
+	}
+}
+
+// Read the metadata of an XMP packet.  On errors, returns what was read
+// before the error.
+func parseXmp(data []byte) (*imageMetadata, error) {
+	meta := new(imageMetadata)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var stack []xml.Name
+	var text []byte
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return meta, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space == xmpNsRdf && t.Name.Local == "Description" {
+				for _, attr := range t.Attr {
+					meta.setAttr(attr.Name, attr.Value)
+				}
+			}
+			stack = append(stack, t.Name)
+			text = text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				meta.setElement(stack, string(text))
+				stack = stack[:len(stack)-1]
+			}
+			text = text[:0]
+		}
+	}
+	return meta, nil
+}
+
+// Names of the possible sidecars of an image: Lightroom uses IMG_1.xmp,
+// other tools IMG_1.jpg.xmp.
+func sidecarNames(name string) []string {
+	return []string{strings.TrimSuffix(name, path.Ext(name)) + ".xmp", name + ".xmp"}
+}
+
+// Read the sidecar of an image file, nil if there is none.
+func readSidecar(file string) (*imageMetadata, error) {
+	for _, sidecar := range sidecarNames(file) {
+		data, err := os.ReadFile(sidecar)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return parseXmp(data)
+	}
+	return nil, nil
+}
+
+func hasSidecar(file string) bool {
+	for _, sidecar := range sidecarNames(file) {
+		if _, err := os.Stat(sidecar); err == nil {
+			return true
+		}
+	}
+	return false
+}
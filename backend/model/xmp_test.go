@@ -0,0 +1,148 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+import "toutizes.com/go-photwo/backend/store"
+
+func testXmp(rating string, subjects ...string) string {
+	bag := ""
+	for _, s := range subjects {
+		bag += "<rdf:li>" + s + "</rdf:li>"
+	}
+	return `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:lr="http://ns.adobe.com/lightroom/1.0/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmp:Rating="` + rating + `">
+   <dc:subject><rdf:Bag>` + bag + `</rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+}
+
+// Insert an XMP APP1 segment after the SOI marker of a JPEG file.
+func embedXmp(t *testing.T, p string, xmp string) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte(xmpSegmentHeader), xmp...)
+	var seg bytes.Buffer
+	seg.Write([]byte{0xFF, 0xE1})
+	binary.Write(&seg, binary.BigEndian, uint16(len(payload)+2))
+	seg.Write(payload)
+	out := append(append(append([]byte{}, data[:2]...), seg.Bytes()...), data[2:]...)
+	if err = ioutil.WriteFile(p, out, 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ParseXmp(t *testing.T) {
+	meta, err := parseXmp([]byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:lr="http://ns.adobe.com/lightroom/1.0/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+   <xmp:Rating>4</xmp:Rating>
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Plage</rdf:li></rdf:Alt></dc:title>
+   <dc:description><rdf:Alt><rdf:li xml:lang="x-default">Au bord de la mer</rdf:li></rdf:Alt></dc:description>
+   <dc:subject><rdf:Bag><rdf:li>Julien</rdf:li><rdf:li>Paris</rdf:li></rdf:Bag></dc:subject>
+   <lr:hierarchicalSubject><rdf:Bag>
+    <rdf:li>Famille|Devin|Julien</rdf:li><rdf:li>Lieux|France|Paris</rdf:li>
+   </rdf:Bag></lr:hierarchicalSubject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.keywords) != 2 || meta.keywords[0] != "Julien" || meta.keywords[1] != "Paris" {
+		t.Errorf("bad keywords %q", meta.keywords)
+	}
+	if len(meta.hierarchical) != 2 || meta.hierarchical[1] != "Lieux|France|Paris" {
+		t.Errorf("bad hierarchical keywords %q", meta.hierarchical)
+	}
+	if meta.title != "Plage" || meta.description != "Au bord de la mer" {
+		t.Errorf("bad title %q or description %q", meta.title, meta.description)
+	}
+	if meta.rating == nil || *meta.rating != 4 {
+		t.Errorf("bad rating %v", meta.rating)
+	}
+}
+
+func indexItem(t *testing.T, db *Database, name string) *store.Item {
+	var sdir store.Directory
+	if err := readIndex(db.IndexPath(""), &sdir); err != nil {
+		t.Fatal(err)
+	}
+	return findItem(&sdir, name)
+}
+
+func Test_LoadXmp(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	embedXmp(t, path.Join(orig, "a.jpg"), testXmp("3", "embedded"))
+	// The sidecar rating wins, the embedded keywords are kept.
+	ioutil.WriteFile(path.Join(orig, "a.xmp"), []byte(testXmp("5")), 0777)
+	writeTestImage(t, path.Join(orig, "b.png"), 8, 6)
+	ioutil.WriteFile(path.Join(orig, "b.png.xmp"), []byte(testXmp("1", "sidecar")), 0777)
+
+	db := loadTestDatabase(t, orig, root)
+	a := indexItem(t, db, "a.jpg")
+	if a == nil || len(a.Keywords) != 1 || a.Keywords[0] != "embedded" || a.GetRating() != 5 {
+		t.Errorf("bad item %v", a)
+	}
+	if a.Image.GetWidth() != 8 {
+		t.Errorf("lost the dimensions: %v", a)
+	}
+	b := imageNamed(db, "b.png")
+	if b == nil || len(b.Keywords()) != 1 || b.Keywords()[0] != "sidecar" {
+		t.Errorf("bad image %v", b)
+	}
+
+	// Editing a sidecar reloads its image.
+	ioutil.WriteFile(path.Join(orig, "b.png.xmp"), []byte(testXmp("2", "edited")), 0777)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path.Join(orig, "b.png.xmp"), future, future)
+	os.Chtimes(orig, future, future)
+	db = loadTestDatabase(t, orig, root)
+	if b = imageNamed(db, "b.png"); b == nil || len(b.Keywords()) != 1 || b.Keywords()[0] != "edited" {
+		t.Errorf("sidecar edit not loaded: %v", b)
+	}
+	if a = indexItem(t, db, "a.jpg"); a.GetRating() != 5 {
+		t.Errorf("rating lost on rescan: %v", a)
+	}
+}
+
+// The metadata survives indexes written from the model.
+func Test_XmpToProto(t *testing.T) {
+	orig, root := makeOrigTree(t, nil)
+	defer os.RemoveAll(orig)
+	defer os.RemoveAll(root)
+	writeTestJpeg(t, path.Join(orig, "a.jpg"), 8, 6)
+	ioutil.WriteFile(path.Join(orig, "a.xmp"), []byte(testXmp("4", "kwd")), 0777)
+
+	db := loadTestDatabase(t, orig, root)
+	if err := db.SaveDirectory(db.Directories()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if a := indexItem(t, db, "a.jpg"); a.GetRating() != 4 {
+		t.Errorf("rating lost in the saved index: %v", a)
+	}
+	if a := imageNamed(db, "a.jpg"); a.Rating() != 4 {
+		t.Errorf("bad image %v", a)
+	}
+}
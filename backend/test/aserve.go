@@ -31,6 +31,7 @@ var force_reload = flag.Bool("force_reload", false, "If true force a reload of i
 var use_https = flag.Bool("use_https", false, "If true listen for HTTPS in 443.")
 var firebase_creds = flag.String("firebase_creds", "", "Path to the Firebase service account credentials JSON file")
 var log_dir = flag.String("log_dir", "", "Path to directory containing query log files for analysis")
+var watch = flag.Bool("watch", false, "If true watch orig_root and reload the albums that change.")
 var use_lr_parser = flag.Bool("use_lr_parser", false, "If true use Lightroom-style query parser (comma-separated keywords)")
 
 var authClient *auth.Client
@@ -193,6 +194,9 @@ func main() {
 
 	db := model.NewDatabase2(*orig_root, *root, *static_root)
 	db.Load(*update_db, *update_db, *force_reload)
+	if *watch {
+		db.Watch(*update_db)
+	}
 	
 	// Configure query parser
 	model.UseLRParser = *use_lr_parser
@@ -275,6 +279,86 @@ func main() {
 				model.HandleRecentKeywordGroups(w, r, db)
 			})(w, r)
 		})
+	mux.HandleFunc(*url_prefix+"/set",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/set", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleSet(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/history",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/history", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleHistory(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/undo",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/undo", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleUndo(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/keywords",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/keywords", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleKeywords(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/write-keywords",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/write-keywords", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleWriteKeywords(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/album",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/album", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleAlbum(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/saved-searches",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/saved-searches", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleSavedSearches(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/collections",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/collections", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleCollections(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/keyword-tree",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/keyword-tree", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleKeywordTree(w, r, db)
+			})(w, r)
+		})
+	mux.HandleFunc(*url_prefix+"/geojson",
+		func(w http.ResponseWriter, r *http.Request) {
+			Log("/geojson", r)
+			AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				AddCorsHeaders(w, r)
+				model.HandleGeoJson(w, r, db)
+			})(w, r)
+		})
 	mux.HandleFunc(*url_prefix+"/user-queries",
 		func(w http.ResponseWriter, r *http.Request) {
 			Log("/user-queries", r)
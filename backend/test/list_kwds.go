@@ -11,13 +11,14 @@ import (
 
 func main() {
   filepath := os.Args[1]
-  h, w, kwds, err := model.GetImageInfo2(filepath)
+  h, w, kwds, title, caption, err := model.GetImageInfo2(filepath)
   if err != nil {
     log.Printf("%v: %v", filepath, err.Error())
     return
   }
 
   log.Printf("%v: %v x %v", filepath, w, h)
+  log.Printf("%v: %q %q", filepath, title, caption)
   log.Printf("%v: %v", filepath, len(kwds))
   for _, kwd := range kwds {
     log.Printf("%s", kwd)
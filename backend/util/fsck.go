@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+import (
+	"toutizes.com/go-photwo/backend/model"
+)
+
+var orig_root = flag.String("orig_root", "", "path to the original images")
+var root = flag.String("root", "", "path to the database index, mini, etc")
+var repair = flag.Bool("repair", false, "If true rebuild the indexes with issues.")
+
+func main() {
+	flag.Parse()
+	if *orig_root == "" {
+		log.Fatal("Must pass --orig_root")
+	}
+	if *root == "" {
+		log.Fatal("Must pass --root")
+	}
+	db := model.NewDatabase2(*orig_root, *root, "")
+	issues, err := db.Fsck(*repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, issue := range issues {
+		fmt.Println(issue.String())
+	}
+	log.Printf("%d issues", len(issues))
+}
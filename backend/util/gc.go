@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+import (
+	"toutizes.com/go-photwo/backend/model"
+)
+
+var orig_root = flag.String("orig_root", "", "path to the original images")
+var root = flag.String("root", "", "path to the database index, mini, etc")
+var do_delete = flag.Bool("delete", false, "If true delete the orphaned files, else only list them.")
+
+func main() {
+	flag.Parse()
+	if *orig_root == "" {
+		log.Fatal("Must pass --orig_root")
+	}
+	if *root == "" {
+		log.Fatal("Must pass --root")
+	}
+	db := model.NewDatabase2(*orig_root, *root, "")
+	err := db.Load(false, false, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := db.CollectGarbage(*do_delete)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range report.Orphans {
+		fmt.Println(p)
+	}
+	if report.Deleted {
+		log.Printf("Deleted %d files, reclaimed %d bytes", len(report.Orphans), report.Bytes)
+	} else {
+		log.Printf("%d orphaned files, %d bytes", len(report.Orphans), report.Bytes)
+	}
+}
@@ -7,6 +7,7 @@ toolchain go1.23.7
 require (
 	github.com/golang/protobuf v1.5.4
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	golang.org/x/image v0.25.0
 	google.golang.org/protobuf v1.36.5
 )
 